@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// What a token (or a browser session, which can do anything) may do
+const (
+	ScopeRead = "read"
+	ScopeAdd = "add"
+	ScopeFull = "full"
+	ScopeSession = "session"
+)
+
+var APIScopes = []string{ ScopeRead, ScopeAdd, ScopeFull }
+
+type APIToken struct {
+	TokenID int
+	Username string
+	Name string
+	TokenHash string
+	Scope string
+	AllowedIPs string
+	CreatedOn string
+	Expires string
+	LastUsed string
+}
+
+type WebAPIToken struct {
+	TokenID int
+	Name string
+	Scope string
+	AllowedIPs string
+	CreatedOn string
+	CreatedOnRFC3339 string
+	Expires string
+	ExpiresRFC3339 string
+	LastUsed string
+	LastUsedRFC3339 string
+}
+
+func NewAPIToken() (string) {
+	bytes := make([]byte, 24)
+	rand.Read(bytes)
+	return "bw_" + hex.EncodeToString(bytes)
+}
+
+func ValidScope(scope string) (bool) {
+	for _, s := range APIScopes {
+		if s == scope { return true }
+	}
+	return false
+}
+
+// Whether something logged in with this scope may do what needs another
+func ScopeAllows(have, want string) (bool) {
+	switch(have) {
+	case ScopeSession:
+		return true
+	case ScopeFull:
+		return want != ScopeSession
+	case ScopeAdd:
+		return want == ScopeAdd || want == ScopeRead
+	case ScopeRead:
+		return want == ScopeRead
+	}
+	return false
+}
+
+func (ux *UserExperience) Can(scope string) (bool) {
+	return ux.LoggedIn && ScopeAllows(ux.Scope, scope)
+}
+
+// Allowlists are IPs or CIDR ranges separated by commas or whitespace;
+// returns the normalized list or false if any entry is junk
+func ParseAllowedIPs(list string) (string, bool) {
+	var ok []string
+	for _, f := range strings.FieldsFunc(list, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\n' || r == '\r' || r == '\t'
+	}) {
+		if _, _, err := net.ParseCIDR(f); err == nil {
+			ok = append(ok, f)
+		} else if ip := net.ParseIP(f); ip != nil {
+			ok = append(ok, ip.String())
+		} else {
+			return "", false
+		}
+	}
+	return strings.Join(ok, ","), true
+}
+
+func (t *APIToken) AllowsIP(addr string) (bool) {
+	if t.AllowedIPs == "" { return true }
+	ip := net.ParseIP(addr)
+	if ip == nil { return false }
+	for _, f := range strings.Split(t.AllowedIPs, ",") {
+		if _, cidr, err := net.ParseCIDR(f); err == nil {
+			if cidr.Contains(ip) { return true }
+		} else if net.ParseIP(f).Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// RealIP without the port RemoteAddr comes with
+func ClientIP(r *http.Request) (string) {
+	addr := RealIP(r)
+	if host, _, err := net.SplitHostPort(addr); err == nil { return host }
+	return addr
+}
+
+func BearerToken(r *http.Request) (string) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") { return "" }
+	return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+}
+
+func (t *APIToken) AsWebEntity() (wt WebAPIToken) {
+	created, _ := ParseDBDate(t.CreatedOn)
+
+	wt.TokenID = t.TokenID
+	wt.Name = t.Name
+	wt.Scope = t.Scope
+	wt.AllowedIPs = t.AllowedIPs
+	wt.CreatedOn = WebDate(created)
+	wt.CreatedOnRFC3339 = RFC3339Date(created)
+	if t.Expires != "" {
+		e, _ := ParseDBDate(t.Expires)
+		wt.Expires = WebDate(e)
+		wt.ExpiresRFC3339 = RFC3339Date(e)
+	}
+	if t.LastUsed != "" {
+		u, _ := ParseDBDate(t.LastUsed)
+		wt.LastUsed = WebDate(u)
+		wt.LastUsedRFC3339 = RFC3339Date(u)
+	}
+	return
+}
@@ -14,6 +14,8 @@ type WebBookmark struct {
 	Title string
 	Unread bool
 	Archived bool
+	Private bool
+	Via string
 	AddedOn string
 	AddedOnRFC3339 string
 }
@@ -26,6 +28,12 @@ type Bookmark struct {
 	Unread bool
 	Archived bool
 	AddedOn string
+	// Only ever shown to its owner
+	Private bool
+	// Whose feed it was saved from, if anyone's
+	Via string
+	// Set when it belongs to an org; Username is then whoever added it
+	OrgName string
 }
 
 type URLError struct {
@@ -35,7 +43,7 @@ type URLError struct {
 }
 
 func (e *URLError) Error() string {
-	if e.ParseError { return "URL must start with http:// or https://" }
+	if e.BadScheme { return "URL must start with http:// or https://" }
 	if e.NoHost { return "No host was specified" }
 	return "Not a URL"
 }
@@ -49,12 +57,21 @@ func (e *URLError) Error() string {
 
 func IsURL(str string) error {
 	u, err := url.Parse(str)
+	if err != nil { return &URLError{ ParseError: true } }
 
 	if !(u.Scheme == "http" || u.Scheme == "https") {
 		return &URLError{ BadScheme: true } }
 	if u.Host == "" { return &URLError{ NoHost: true } }
 
-	return err
+	return nil
+}
+
+// What anyone but the owner gets to see
+func (marks Bookmarks) Public() (public Bookmarks) {
+	for _, b := range marks {
+		if !b.Private { public = append(public, b) }
+	}
+	return
 }
 
 func (marks Bookmarks) AsWebEntities() (wb []WebBookmark) {
@@ -70,9 +87,14 @@ func (b *Bookmark) AsWebEntity() (wb WebBookmark) {
 	wb.BId = b.BId
 	wb.Username = b.Username
 	wb.URL = Settings.Web.Canon + "out/" + strconv.Itoa(b.BId)
+	if b.OrgName != "" {
+		wb.URL = Settings.Web.Canon + "o/" + b.OrgName + "/out/" +
+			strconv.Itoa(b.BId) }
 	wb.Title = b.Title
 	wb.Unread = b.Unread
 	wb.Archived = b.Archived
+	wb.Private = b.Private
+	wb.Via = b.Via
 	wb.AddedOn = WebDate(t)
 	wb.AddedOnRFC3339 = RFC3339Date(t)
 	return
@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestIsURL(t *testing.T) {
+	cases := []struct {
+		url string
+		ok bool
+	}{
+		{ "https://example.com/a?b=c", true },
+		{ "http://[::1]:8080/", true },
+		{ "ftp://example.com/", false },
+		{ "javascript:alert(1)", false },
+		{ "https://", false },
+		{ "", false },
+		// Used to panic: url.Parse fails and hands back nil
+		{ "http://[::1", false },
+		{ "http://a b.com/%zz", false },
+	}
+	for _, c := range cases {
+		if err := IsURL(c.url); (err == nil) != c.ok {
+			t.Errorf("IsURL(%q) = %v", c.url, err) }
+	}
+}
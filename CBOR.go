@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// Just enough of RFC 8949 to read WebAuthn attestation objects and COSE
+// keys; integers always come out as int64 so COSE labels compare sanely
+
+var ErrCBOR = errors.New("Malformed CBOR")
+
+func DecodeCBOR(b []byte) (interface{}, []byte, error) {
+	if len(b) == 0 { return nil, nil, ErrCBOR }
+	major := b[0] >> 5
+	info := b[0] & 0x1f
+	b = b[1:]
+
+	// Floats and simple values hide behind major type 7
+	if major == 7 {
+		switch(info) {
+		case 20: return false, b, nil
+		case 21: return true, b, nil
+		case 22, 23: return nil, b, nil
+		case 26:
+			if len(b) < 4 { return nil, nil, ErrCBOR }
+			return float64(math.Float32frombits(
+				binary.BigEndian.Uint32(b))), b[4:], nil
+		case 27:
+			if len(b) < 8 { return nil, nil, ErrCBOR }
+			return math.Float64frombits(
+				binary.BigEndian.Uint64(b)), b[8:], nil
+		}
+		return nil, nil, ErrCBOR
+	}
+
+	var n uint64
+	switch {
+	case info < 24: n = uint64(info)
+	case info == 24:
+		if len(b) < 1 { return nil, nil, ErrCBOR }
+		n, b = uint64(b[0]), b[1:]
+	case info == 25:
+		if len(b) < 2 { return nil, nil, ErrCBOR }
+		n, b = uint64(binary.BigEndian.Uint16(b)), b[2:]
+	case info == 26:
+		if len(b) < 4 { return nil, nil, ErrCBOR }
+		n, b = uint64(binary.BigEndian.Uint32(b)), b[4:]
+	case info == 27:
+		if len(b) < 8 { return nil, nil, ErrCBOR }
+		n, b = binary.BigEndian.Uint64(b), b[8:]
+	default:
+		// Indefinite lengths never show up in WebAuthn
+		return nil, nil, ErrCBOR
+	}
+
+	switch(major) {
+	case 0:
+		if n > math.MaxInt64 { return nil, nil, ErrCBOR }
+		return int64(n), b, nil
+	case 1:
+		if n > math.MaxInt64 { return nil, nil, ErrCBOR }
+		return -1 - int64(n), b, nil
+	case 2, 3:
+		if uint64(len(b)) < n { return nil, nil, ErrCBOR }
+		data := append([]byte(nil), b[:n]...)
+		if major == 3 { return string(data), b[n:], nil }
+		return data, b[n:], nil
+	case 4:
+		var arr []interface{}
+		for i := uint64(0); i < n; i++ {
+			var v interface{}
+			var err error
+			v, b, err = DecodeCBOR(b)
+			if err != nil { return nil, nil, err }
+			arr = append(arr, v)
+		}
+		return arr, b, nil
+	case 5:
+		m := make(map[interface{}]interface{})
+		for i := uint64(0); i < n; i++ {
+			var k, v interface{}
+			var err error
+			k, b, err = DecodeCBOR(b)
+			if err != nil { return nil, nil, err }
+			v, b, err = DecodeCBOR(b)
+			if err != nil { return nil, nil, err }
+			switch k.(type) {
+			case int64, string:
+				m[k] = v
+			default:
+				return nil, nil, ErrCBOR
+			}
+		}
+		return m, b, nil
+	case 6:
+		// Tags are dropped; we only care about what they wrap
+		return DecodeCBOR(b)
+	}
+	return nil, nil, ErrCBOR
+}
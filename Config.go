@@ -8,12 +8,24 @@ import (
 )
 
 type Config struct {
+	Admins []string
 	MaxUsernameLength int
 	MaxDisplaynameLength int
 	MinimumPasswordLength int
 	Web WebSettings
 	Database DBSettings
+	Payments PaymentSettings
+	Activation ActivationSettings
 	PayPal PayPalSettings
+	Stripe StripeSettings
+	Subscriptions SubscriptionSettings
+	Mail MailSettings
+	Feeds FeedSettings
+	MailIn MailInSettings
+	Webhooks WebhookSettings
+	Login LoginSettings
+	Password PasswordSettings
+	OAuth OAuthSettings
 	Templates []TemplateSettings }
 
 type DBSettings struct {
@@ -24,22 +36,103 @@ type TemplateSettings struct {
 	Name string
 	Dependencies []string }
 
+type PaymentSettings struct {
+	Providers []string
+	OneTimeCost float64
+	DomesticCurrency string
+	DomesticCurrencySigil string }
+
+type ActivationSettings struct {
+	Mode string
+	InvitesPerUser int
+	InviteExpiryDays int }
+
 type PayPalSettings struct {
 	OAuthAPI string
 	OrderAPI string
+	CaptureAPI string
 	Client string
 	Secret string
-	OneTimeCost float64
-	DomesticCurrency string
-	DomesticCurrencySigil string
+	MerchantID string
 }
 
+type StripeSettings struct {
+	API string
+	SecretKey string
+	WebhookSecret string }
+
+type SubscriptionSettings struct {
+	GraceDays int
+	// What accounts without a current plan get
+	Free Entitlements
+	Plans []Plan }
+
+type MailSettings struct {
+	Transport string
+	From string
+	SMTPHost string
+	SMTPPort int
+	SMTPUsername string
+	SMTPPassword string
+	SendmailPath string
+	FilePath string
+	TokenExpiryMinutes int }
+
+type FeedSettings struct {
+	PollMinutes int
+	MaxBackoffHours int
+	// Per poll, per feed
+	MaxNewItems int
+	MaxKiB int
+	// Feeds polled each minute, at most
+	BatchSize int }
+
+type MailInSettings struct {
+	// Empty turns save-by-email off
+	Domain string
+	LocalPart string
+	// Links saved from one message, at most
+	MaxLinks int
+	MaxKiB int }
+
+type WebhookSettings struct {
+	MaxAttempts int
+	BaseDelaySeconds int
+	MaxDelayMinutes int
+	// Deliveries tried every ten seconds, at most
+	BatchSize int
+	// Deliveries shown in settings
+	LogLength int }
+
+type LoginSettings struct {
+	FreeAttempts int
+	BaseDelaySeconds int
+	MaxDelaySeconds int
+	LockoutAfter int
+	LockoutMinutes int
+	WarnAfter int
+	ForgetMinutes int }
+
+type PasswordSettings struct {
+	Algorithm string
+	BcryptCost int
+	Argon2Time uint32
+	Argon2MemoryKiB uint32
+	Argon2Threads uint8
+	Pepper string }
+
+type OAuthSettings struct {
+	AccessTokenMinutes int
+	RefreshTokenDays int
+	CodeMinutes int }
+
 type WebSettings struct {
 	Canon string
 	SessionCookie string
 	SessionExpiryDays int
 	Host string
-	DateFormat string }
+	DateFormat string
+	ShareSecret string }
 
 var CONFIG_DEFAULT_LOCS = [...]string{
 	"Config.toml" }
@@ -57,7 +150,59 @@ func ReadDefaultConfig(c *Config) (error) {
 func ReadConfig(c *Config, fpath string) (err error) {
 	log.Printf("Loading configuration file: %s\n", fpath)
 	_, err = toml.DecodeFile(fpath, c)
-	return
+	if err != nil { return }
+	c.SetDefaults()
+	return c.Password.Validate()
+}
+
+// Config files written before a section existed leave it all zeroes, which
+// for most of these means "never" or "nothing"; 0 always means the default
+func (c *Config) SetDefaults() {
+	l := &c.Login
+	defaultInt(&l.FreeAttempts, 3)
+	defaultInt(&l.BaseDelaySeconds, 2)
+	defaultInt(&l.MaxDelaySeconds, 300)
+	defaultInt(&l.LockoutAfter, 10)
+	defaultInt(&l.LockoutMinutes, 15)
+	defaultInt(&l.WarnAfter, 20)
+	defaultInt(&l.ForgetMinutes, 60)
+
+	o := &c.OAuth
+	defaultInt(&o.AccessTokenMinutes, 60)
+	defaultInt(&o.RefreshTokenDays, 90)
+	defaultInt(&o.CodeMinutes, 10)
+
+	defaultInt(&c.Mail.TokenExpiryMinutes, 60)
+
+	h := &c.Webhooks
+	defaultInt(&h.MaxAttempts, 8)
+	defaultInt(&h.BaseDelaySeconds, 30)
+	defaultInt(&h.MaxDelayMinutes, 360)
+	defaultInt(&h.BatchSize, 50)
+	defaultInt(&h.LogLength, 50)
+
+	f := &c.Feeds
+	defaultInt(&f.PollMinutes, 30)
+	defaultInt(&f.MaxBackoffHours, 24)
+	defaultInt(&f.MaxNewItems, 10)
+	defaultInt(&f.MaxKiB, 2048)
+	defaultInt(&f.BatchSize, 50)
+
+	m := &c.MailIn
+	if m.LocalPart == "" { m.LocalPart = "save" }
+	defaultInt(&m.MaxLinks, 20)
+	defaultInt(&m.MaxKiB, 1024)
+}
+
+func defaultInt(v *int, def int) {
+	if *v <= 0 { *v = def }
+}
+
+func IsAdmin(uname string) (bool) {
+	for _, a := range Settings.Admins {
+		if a == uname { return true }
+	}
+	return false
 }
 
 func FExists(fname string) bool {
@@ -2,8 +2,10 @@ package main
 
 import (
 	"database/sql"
+	"net/http"
 	"time"
 	"errors"
+	"log"
 	_ "github.com/go-sql-driver/mysql"
 )
 
@@ -28,18 +30,504 @@ func DBConnect(c *Config) (*sql.DB, error) {
 	return GlobalDB, GlobalDB.Ping()
 }
 
-func PromoDiscount(db *sql.DB, promo string) (discount float64, err error) {
-	selForm, err := db.Prepare(`SELECT Discount
-		FROM Promos WHERE Code=? AND
-		Expires >= CURRENT_TIMESTAMP`)
+// A code only counts while it's enabled, unexpired and not used up
+const promoUsable = `(NOT Disabled AND
+	(MaxRedemptions IS NULL OR Redemptions < MaxRedemptions) AND
+	(Expires IS NULL OR Expires >= CURRENT_TIMESTAMP))`
+
+// Every code with how it has been used, newest first
+func Promos(db *sql.DB) ([]Promo, error) {
+	var promos []Promo
+	q := `SELECT p.Code, p.Kind, p.Discount, COALESCE(p.MaxRedemptions, 0),
+		p.Redemptions, p.Disabled, p.Batch, COALESCE(p.Expires, ''),
+		p.CreatedOn, ` + promoUsable + `,
+		COUNT(pay.PaymentID),
+		COALESCE(SUM(CASE WHEN pay.Status='paid' THEN pay.Amount END), 0),
+		COALESCE(SUM(pay.Status='refunded'), 0)
+		FROM Promos p
+		LEFT JOIN Payments pay ON pay.Promo=p.Code
+		GROUP BY p.Code ORDER BY p.CreatedOn DESC, p.Code`
+	selForm, err := db.Prepare(q)
+	if err != nil { return promos, err }
+	rows, err := selForm.Query()
+	if err != nil { return promos, err }
+	defer rows.Close()
+	var p Promo
+	for rows.Next() {
+		err = rows.Scan(
+			&p.Code,
+			&p.Kind,
+			&p.Discount,
+			&p.MaxRedemptions,
+			&p.Redemptions,
+			&p.Disabled,
+			&p.Batch,
+			&p.Expires,
+			&p.CreatedOn,
+			&p.Usable,
+			&p.Paid,
+			&p.Revenue,
+			&p.Refunded)
+		if err != nil { return nil, err }
+		promos = append(promos, p)
+	}
+	return promos, rows.Err()
+}
+
+// expiryDays of zero means the code never expires
+func (p Promo) Add(db *sql.DB, expiryDays int) (error) {
+	q := `INSERT INTO Promos
+		(Code, Kind, Discount, MaxRedemptions, Batch, Expires)
+		VALUES (?, ?, ?, NULLIF(?, 0), ?, IF(? > 0,
+			CURRENT_TIMESTAMP + INTERVAL ? DAY, NULL))`
+	insForm, err := db.Prepare(q)
+	if err != nil { return err }
+	_, err = insForm.Exec(p.Code, p.Kind, p.Discount, p.MaxRedemptions,
+		p.Batch, expiryDays, expiryDays)
+	return err
+}
+
+func (p Promo) SetDisabled(db *sql.DB, disabled bool) (error) {
+	q := `UPDATE Promos SET Disabled=? WHERE Code=?`
+	updForm, err := db.Prepare(q)
+	if err != nil { return err }
+	_, err = updForm.Exec(disabled, p.Code)
+	return err
+}
+
+// Files a signup away until it's paid for and returns the token for it.
+// The price is settled here, once: whatever the promo code takes off now is
+// what the customer pays, and the code counts as redeemed from now on (it's
+// given back if the signup expires unpaid)
+func (p *PendingSignup) Add(db *sql.DB) (string, error) {
+	if err := ExpirePendingSignups(db); err != nil { return "", err }
+
+	tx, err := db.Begin()
+	if err != nil { return "", err }
+	defer tx.Rollback()
+
+	p.Amount = Settings.Payments.OneTimeCost
+	p.Currency = Settings.Payments.DomesticCurrency
+	if p.Promo != "" {
+		var promo Promo
+		err = tx.QueryRow(`SELECT Kind, Discount FROM Promos
+			WHERE Code=? AND ` + promoUsable + ` FOR UPDATE`, p.Promo).Scan(
+			&promo.Kind, &promo.Discount)
+		if err != nil && err != sql.ErrNoRows { return "", err }
+		off := 0.0
+		if err == nil { off = promo.Off(p.Amount) }
+		// Only a code that took something off gets redeemed
+		if off > 0 {
+			_, err = tx.Exec(`UPDATE Promos SET Redemptions=Redemptions+1
+				WHERE Code=?`, p.Promo)
+			if err != nil { return "", err }
+			p.Amount -= off
+		} else { p.Promo = "" }
+	}
+
+	token := MailToken()
+	p.TokenHash = HashToken(token)
+	_, err = tx.Exec(`INSERT INTO PendingSignups
+		(TokenHash, Username, DisplayName, Shadow, Promo, Amount, Currency,
+		Expires)
+		VALUES (?, ?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP + INTERVAL ? MINUTE)`,
+		p.TokenHash, p.Username, p.DisplayName, p.Shadow, p.Promo, p.Amount,
+		p.Currency, int(PendingSignupLifetime.Minutes()))
+	if err != nil { return "", err }
+	return token, tx.Commit()
+}
+
+// Drops signups nobody paid for in time, and gives back the promo codes
+// they were holding
+func ExpirePendingSignups(db *sql.DB) (error) {
+	tx, err := db.Begin()
+	if err != nil { return err }
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT TokenHash, Promo FROM PendingSignups
+		WHERE Expires < CURRENT_TIMESTAMP FOR UPDATE`)
+	if err != nil { return err }
+	var expired []PendingSignup
+	var p PendingSignup
+	for rows.Next() {
+		if err := rows.Scan(&p.TokenHash, &p.Promo); err != nil {
+			rows.Close()
+			return err
+		}
+		expired = append(expired, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil { return err }
+
+	for _, p := range expired {
+		_, err = tx.Exec(`DELETE FROM PendingSignups WHERE TokenHash=?`,
+			p.TokenHash)
+		if err != nil { return err }
+		if p.Promo == "" { continue }
+		_, err = tx.Exec(`UPDATE Promos SET Redemptions=Redemptions-1
+			WHERE Code=? AND Redemptions > 0`, p.Promo)
+		if err != nil { return err }
+	}
+	_, err = tx.Exec(`DELETE FROM PendingSignupOrders
+		WHERE TokenHash NOT IN (SELECT TokenHash FROM PendingSignups)`)
+	if err != nil { return err }
+	return tx.Commit()
+}
+
+func PendingSignupByToken(db *sql.DB, token string) (PendingSignup, error) {
+	return pendingSignupWhere(db, `TokenHash=?`, HashToken(token))
+}
+
+// For customers (and webhooks) coming back from a provider's checkout
+func PendingSignupByOrder(db *sql.DB, provider, orderID string) (PendingSignup, error) {
+	return pendingSignupWhere(db, `TokenHash=(SELECT TokenHash
+		FROM PendingSignupOrders WHERE Provider=? AND OrderID=?)`,
+		provider, orderID)
+}
+
+func pendingSignupWhere(db *sql.DB, where string, args ...interface{}) (p PendingSignup, err error) {
+	selForm, err := db.Prepare(`SELECT TokenHash, Username, DisplayName,
+		Shadow, Promo, Amount, Currency
+		FROM PendingSignups WHERE ` + where + `
+		AND Expires >= CURRENT_TIMESTAMP`)
+	if err != nil { return }
+	err = selForm.QueryRow(args...).Scan(
+		&p.TokenHash,
+		&p.Username,
+		&p.DisplayName,
+		&p.Shadow,
+		&p.Promo,
+		&p.Amount,
+		&p.Currency)
+	return
+}
+
+// Ties an order to this signup; only this signup can be finished with it
+func (p PendingSignup) AddOrder(db *sql.DB, provider, orderID string) (error) {
+	q := `INSERT INTO PendingSignupOrders (Provider, OrderID, TokenHash)
+		VALUES (?, ?, ?)`
+	insForm, err := db.Prepare(q)
+	if err != nil { return err }
+	_, err = insForm.Exec(provider, orderID, p.TokenHash)
+	return err
+}
+
+func (p PendingSignup) HasOrder(db *sql.DB, provider, orderID string) (bool, error) {
+	var n int
+	selForm, err := db.Prepare(`SELECT COUNT(*) FROM PendingSignupOrders
+		WHERE Provider=? AND OrderID=? AND TokenHash=?`)
+	if err != nil { return false, err }
+	err = selForm.QueryRow(provider, orderID, p.TokenHash).Scan(&n)
+	return n > 0, err
+}
+
+// Creates the account, records the payment for it and drops the pending
+// signup all at once; of several attempts on one signup or one order (a
+// refresh, the webhook racing the browser, a replayed order) only the first
+// wins
+func (p PendingSignup) Finish(db *sql.DB, pay Payment) (UserProfile, error) {
+	tx, err := db.Begin()
+	if err != nil { return UserProfile{}, err }
+	defer tx.Rollback()
+
+	displayname := p.DisplayName
+	if displayname == "" { displayname = p.Username }
+	_, err = tx.Exec(`INSERT INTO Users (Username, DisplayName, Shadow)
+		VALUES (?, ?, ?)`, p.Username, displayname, p.Shadow)
+	if err != nil { return UserProfile{}, err }
+
+	result, err := tx.Exec(`INSERT IGNORE INTO Payments
+		(Provider, OrderID, Username, Amount, Currency, Promo, Status)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		pay.Provider, pay.OrderID, p.Username, pay.Amount, pay.Currency,
+		pay.Promo, PaymentPaid)
+	if err != nil { return UserProfile{}, err }
+	if n, _ := result.RowsAffected(); n == 0 {
+		return UserProfile{}, ErrPaymentRedeemed }
+
+	result, err = tx.Exec(`DELETE FROM PendingSignups WHERE TokenHash=?`,
+		p.TokenHash)
+	if err != nil { return UserProfile{}, err }
+	if n, _ := result.RowsAffected(); n == 0 {
+		return UserProfile{}, sql.ErrNoRows }
+
+	if err := tx.Commit(); err != nil { return UserProfile{}, err }
+
+	err = UpdateSiteStats(db, "Users", 1)
+	if err != nil { log.Println(err) }
+	return UserByName(db, p.Username)
+}
+
+const inviteUsable = `(UsedBy IS NULL AND UsedOn IS NULL AND
+	(Expires IS NULL OR Expires >= CURRENT_TIMESTAMP))`
+
+// Makes the account straight away, without a payment: active when an invite
+// is given, otherwise in whatever state it's told
+func (p PendingSignup) Create(db *sql.DB, status, invite string) (UserProfile, error) {
+	tx, err := db.Begin()
+	if err != nil { return UserProfile{}, err }
+	defer tx.Rollback()
+
+	displayname := p.DisplayName
+	if displayname == "" { displayname = p.Username }
+	_, err = tx.Exec(`INSERT INTO Users (Username, DisplayName, Shadow, Status)
+		VALUES (?, ?, ?, ?)`, p.Username, displayname, p.Shadow, status)
+	if err != nil { return UserProfile{}, err }
+
+	if invite != "" {
+		result, err := tx.Exec(`UPDATE Invites
+			SET UsedBy=?, UsedOn=CURRENT_TIMESTAMP
+			WHERE Code=? AND ` + inviteUsable, p.Username, invite)
+		if err != nil { return UserProfile{}, err }
+		if n, _ := result.RowsAffected(); n == 0 {
+			return UserProfile{}, ErrInviteUsed }
+	}
+
+	if err := tx.Commit(); err != nil { return UserProfile{}, err }
+
+	if status == AccountActive {
+		err = UpdateSiteStats(db, "Users", 1)
+		if err != nil { log.Println(err) }
+	}
+	return UserByName(db, p.Username)
+}
+
+func (i Invite) Add(db *sql.DB, expiryDays int) (error) {
+	q := `INSERT INTO Invites (Code, CreatedBy, Expires)
+		VALUES (?, ?, IF(? > 0, CURRENT_TIMESTAMP + INTERVAL ? DAY, NULL))`
+	insForm, err := db.Prepare(q)
+	if err != nil { return err }
+	_, err = insForm.Exec(i.Code, i.CreatedBy, expiryDays, expiryDays)
+	return err
+}
+
+// Newest first
+func (u UserProfile) Invites(db *sql.DB) ([]Invite, error) {
+	selForm, err := db.Prepare(`SELECT Code, CreatedBy, CreatedOn,
+		COALESCE(Expires, ''), COALESCE(UsedBy, ''), COALESCE(UsedOn, ''), ` +
+		inviteUsable + ` FROM Invites WHERE CreatedBy=?
+		ORDER BY CreatedOn DESC`)
+	if err != nil { return nil, err }
+	rows, err := selForm.Query(u.Username)
+	if err != nil { return nil, err }
+	defer rows.Close()
+
+	var invites []Invite
+	var i Invite
+	for rows.Next() {
+		err = rows.Scan(
+			&i.Code,
+			&i.CreatedBy,
+			&i.CreatedOn,
+			&i.Expires,
+			&i.UsedBy,
+			&i.UsedOn,
+			&i.Usable)
+		if err != nil { return nil, err }
+		invites = append(invites, i)
+	}
+	return invites, rows.Err()
+}
+
+func (u UserProfile) InviteCount(db *sql.DB) (n int, err error) {
+	q := `SELECT COUNT(*) FROM Invites WHERE CreatedBy=?`
+	selForm, err := db.Prepare(q)
+	if err != nil { return }
+	err = selForm.QueryRow(u.Username).Scan(&n)
+	return
+}
+
+// Oldest first, so they're dealt with in the order they came in
+func PendingApprovals(db *sql.DB) ([]UserProfile, error) {
+	selForm, err := db.Prepare(`SELECT Username, DisplayName, JoinedOn
+		FROM Users WHERE Status=? ORDER BY JoinedOn`)
+	if err != nil { return nil, err }
+	rows, err := selForm.Query(AccountPending)
+	if err != nil { return nil, err }
+	defer rows.Close()
+
+	var users []UserProfile
+	var u UserProfile
+	for rows.Next() {
+		err = rows.Scan(&u.Username, &u.DisplayName, &u.JoinedOn)
+		if err != nil { return nil, err }
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+func ApproveUser(db *sql.DB, uname string) (error) {
+	updForm, err := db.Prepare(`UPDATE Users SET Status=?
+		WHERE Username=? AND Status=?`)
+	if err != nil { return err }
+	result, err := updForm.Exec(AccountActive, uname, AccountPending)
+	if err != nil { return err }
+	if n, _ := result.RowsAffected(); n == 0 { return sql.ErrNoRows }
+	return UpdateSiteStats(db, "Users", 1)
+}
+
+// Only ever drops accounts that were never let in
+func RejectUser(db *sql.DB, uname string) (error) {
+	delForm, err := db.Prepare(`DELETE FROM Users
+		WHERE Username=? AND Status=?`)
+	if err != nil { return err }
+	result, err := delForm.Exec(uname, AccountPending)
+	if err != nil { return err }
+	if n, _ := result.RowsAffected(); n == 0 { return sql.ErrNoRows }
+	return nil
+}
+
+const paymentColumns = `PaymentID, Provider, OrderID,
+	COALESCE(Username, ''), Amount, Currency, Promo, Status, CreatedOn,
+	COALESCE(RefundedOn, ''), COALESCE(RefundedBy, '')`
+
+func scanPayments(rows *sql.Rows) ([]Payment, error) {
+	var payments []Payment
+	defer rows.Close()
+	var p Payment
+	for rows.Next() {
+		err := rows.Scan(
+			&p.PaymentID,
+			&p.Provider,
+			&p.OrderID,
+			&p.Username,
+			&p.Amount,
+			&p.Currency,
+			&p.Promo,
+			&p.Status,
+			&p.CreatedOn,
+			&p.RefundedOn,
+			&p.RefundedBy)
+		if err != nil { return nil, err }
+		payments = append(payments, p)
+	}
+	return payments, rows.Err()
+}
+
+// Newest first
+func (u UserProfile) Payments(db *sql.DB) ([]Payment, error) {
+	selForm, err := db.Prepare(`SELECT ` + paymentColumns + `
+		FROM Payments WHERE Username=? ORDER BY PaymentID DESC`)
+	if err != nil { return nil, err }
+	rows, err := selForm.Query(u.Username)
+	if err != nil { return nil, err }
+	return scanPayments(rows)
+}
+
+func RecentPayments(db *sql.DB, limit int) ([]Payment, error) {
+	selForm, err := db.Prepare(`SELECT ` + paymentColumns + `
+		FROM Payments ORDER BY PaymentID DESC LIMIT ?`)
+	if err != nil { return nil, err }
+	rows, err := selForm.Query(limit)
+	if err != nil { return nil, err }
+	return scanPayments(rows)
+}
+
+func PaymentByID(db *sql.DB, paymentID int) (Payment, error) {
+	selForm, err := db.Prepare(`SELECT ` + paymentColumns + `
+		FROM Payments WHERE PaymentID=?`)
+	if err != nil { return Payment{}, err }
+	rows, err := selForm.Query(paymentID)
+	if err != nil { return Payment{}, err }
+	payments, err := scanPayments(rows)
+	if err == nil && len(payments) == 0 { err = sql.ErrNoRows }
+	if err != nil { return Payment{}, err }
+	return payments[0], nil
+}
+
+// Once the money's gone back the account closes: it's signed out everywhere
+// and can't sign in again
+func (pay Payment) MarkRefunded(db *sql.DB, by string) (error) {
+	tx, err := db.Begin()
+	if err != nil { return err }
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`UPDATE Payments SET Status=?,
+		RefundedOn=CURRENT_TIMESTAMP, RefundedBy=?
+		WHERE PaymentID=? AND Status=?`,
+		PaymentRefunded, by, pay.PaymentID, PaymentPaid)
+	if err != nil { return err }
+	if n, _ := result.RowsAffected(); n == 0 { return sql.ErrNoRows }
+
+	if pay.Username != "" {
+		_, err = tx.Exec(`UPDATE Users SET Status=? WHERE Username=?`,
+			AccountRefunded, pay.Username)
+		if err != nil { return err }
+		_, err = tx.Exec(`DELETE FROM Sessions WHERE Username=?`,
+			pay.Username)
+		if err != nil { return err }
+		_, err = tx.Exec(`DELETE FROM APITokens WHERE Username=?`,
+			pay.Username)
+		if err != nil { return err }
+	}
+	return tx.Commit()
+}
+
+// Whether the plan still applies: paid up to CurrentPeriodEnd, plus a grace
+// period while a renewal is late but hasn't been given up on
+const subscriptionCurrent = `(Status<>'canceled' AND
+	(CurrentPeriodEnd > CURRENT_TIMESTAMP OR (NOT CancelAtPeriodEnd AND
+	CurrentPeriodEnd + INTERVAL ? DAY > CURRENT_TIMESTAMP)))`
+
+func (u UserProfile) Subscription(db *sql.DB) (s Subscription, err error) {
+	selForm, err := db.Prepare(`SELECT Username, PlanID, Period, Provider,
+		ExternalID, Status, CurrentPeriodEnd, CancelAtPeriodEnd, ` +
+		subscriptionCurrent + ` FROM Subscriptions WHERE Username=?`)
+	if err != nil { return }
+	err = selForm.QueryRow(Settings.Subscriptions.GraceDays, u.Username).Scan(
+		&s.Username,
+		&s.PlanID,
+		&s.Period,
+		&s.Provider,
+		&s.ExternalID,
+		&s.Status,
+		&s.CurrentPeriodEnd,
+		&s.CancelAtPeriodEnd,
+		&s.Current)
+	return
+}
+
+// One subscription per user; starting another replaces the old one
+func (s Subscription) Save(db *sql.DB, periodEnd int64) (error) {
+	insForm, err := db.Prepare(`INSERT INTO Subscriptions
+		(Username, PlanID, Period, Provider, ExternalID, Status,
+		CurrentPeriodEnd, CancelAtPeriodEnd)
+		VALUES (?, ?, ?, ?, ?, ?, FROM_UNIXTIME(?), ?)
+		ON DUPLICATE KEY UPDATE PlanID=VALUES(PlanID), Period=VALUES(Period),
+		Provider=VALUES(Provider), ExternalID=VALUES(ExternalID),
+		Status=VALUES(Status), CurrentPeriodEnd=VALUES(CurrentPeriodEnd),
+		CancelAtPeriodEnd=VALUES(CancelAtPeriodEnd),
+		UpdatedOn=CURRENT_TIMESTAMP`)
+	if err != nil { return err }
+	_, err = insForm.Exec(s.Username, s.PlanID, s.Period, s.Provider,
+		s.ExternalID, s.Status, periodEnd, s.CancelAtPeriodEnd)
+	return err
+}
+
+func (s Subscription) SetCancelAtPeriodEnd(db *sql.DB, cancel bool) (error) {
+	updForm, err := db.Prepare(`UPDATE Subscriptions
+		SET CancelAtPeriodEnd=?, UpdatedOn=CURRENT_TIMESTAMP
+		WHERE Username=? AND ExternalID=?`)
+	if err != nil { return err }
+	_, err = updForm.Exec(cancel, s.Username, s.ExternalID)
+	return err
+}
+
+func (u UserProfile) BookmarkCount(db *sql.DB) (n int, err error) {
+	q := `SELECT COUNT(*) FROM Bookmarks WHERE Username=?`
+	selForm, err := db.Prepare(q)
 	if err != nil { return }
-	err = selForm.QueryRow(promo).Scan(&discount)
+	err = selForm.QueryRow(u.Username).Scan(&n)
 	return
 }
 
 func UserByName(db *sql.DB, uname string) (u UserProfile, err error) {
 	selForm, err := db.Prepare(`SELECT
-		Username, DisplayName, JoinedOn, Shadow, APISecret
+		Username, DisplayName, JoinedOn, Shadow,
+		TOTPSecret, TOTPEnabled, TOTPLastStep, Email, EmailVerified,
+		Status, Visibility,
+		(SELECT COUNT(*) FROM Follows WHERE Followee=Username),
+		(SELECT COUNT(*) FROM Follows WHERE Follower=Username)
 		FROM Users WHERE Username=?`)
 	if err != nil { return }
 	err = selForm.QueryRow(uname).Scan(
@@ -47,7 +535,15 @@ func UserByName(db *sql.DB, uname string) (u UserProfile, err error) {
 		&u.DisplayName,
 		&u.JoinedOn,
 		&u.Shadow,
-		&u.APISecret)
+		&u.TOTPSecret,
+		&u.TOTPEnabled,
+		&u.TOTPLastStep,
+		&u.Email,
+		&u.EmailVerified,
+		&u.Status,
+		&u.Visibility,
+		&u.Followers,
+		&u.Following)
 
 	/* if err == sql.ErrNoRows {
 		return
@@ -59,25 +555,34 @@ func UserByName(db *sql.DB, uname string) (u UserProfile, err error) {
 }
 
 func (b Bookmark) Add(db *sql.DB) (error) {
+	_, err := b.AddWithID(db)
+	return err
+}
+
+// Add, but also says what BId the new bookmark got
+func (b Bookmark) AddWithID(db *sql.DB) (int, error) {
 	err := UpdateSiteStats(db, "Bookmarks", 1)
-	if err != nil { return err }
+	if err != nil { return 0, err }
 
 	q := `INSERT INTO Bookmarks
-		(Username, Title, URL) VALUES (?, ?, ?)`
+		(Username, Title, URL, Private, Via)
+		VALUES (?, ?, ?, ?, NULLIF(?, ''))`
 	insForm, err := db.Prepare(q)
-	if err != nil { return err }
+	if err != nil { return 0, err }
 
-	_, err = insForm.Exec(b.Username, b.Title, b.URL)
-	return err
+	result, err := insForm.Exec(b.Username, b.Title, b.URL, b.Private, b.Via)
+	if err != nil { return 0, err }
+	id, err := result.LastInsertId()
+	return int(id), err
 }
 
 func (b Bookmark) Edit(db *sql.DB) (error) {
 	q := `UPDATE Bookmarks
-		SET Title=?, URL=? WHERE BId=? AND Username=?`
+		SET Title=?, URL=?, Private=? WHERE BId=? AND Username=?`
 	insForm, err := db.Prepare(q)
 	if err != nil { return err }
 
-	_, err = insForm.Exec(b.Title, b.URL, b.BId, b.Username)
+	_, err = insForm.Exec(b.Title, b.URL, b.Private, b.BId, b.Username)
 	return err
 }
 
@@ -116,23 +621,37 @@ func (b Bookmark) Del(db *sql.DB) (error) {
 
 func (ws WebSession) Associated(db *sql.DB) (s Session, err error) {
 	selForm, err := db.Prepare(`SELECT
-		SessID, Username, Expires
+		SessID, Username, Expires, UserAgent, IP, CreatedOn, LastSeen
 		FROM Sessions WHERE SessID=?`)
 	if err != nil { return }
 	err = selForm.QueryRow(ws.SessID).Scan(
 		&s.SessID,
 		&s.Username,
-		&s.Expires)
+		&s.Expires,
+		&s.UserAgent,
+		&s.IP,
+		&s.CreatedOn,
+		&s.LastSeen)
 
 	return
 }
 
-func (ws WebSession) Associate(db *sql.DB, uname string) (error) {
+func (ws WebSession) Associate(db *sql.DB, uname string, r *http.Request) (error) {
 	q := `INSERT INTO Sessions
-		(SessID, Username) VALUES (?, ?)`
+		(SessID, Username, UserAgent, IP) VALUES (?, ?, ?, ?)`
 	insForm, err := db.Prepare(q)
 	if err != nil { return err }
-	_, err = insForm.Exec(ws.SessID, uname)
+	_, err = insForm.Exec(ws.SessID, uname, r.UserAgent(), RealIP(r))
+	return err
+}
+
+// Bump the last-seen time (and address) of a logged-in session
+func (s Session) Touch(db *sql.DB, r *http.Request) (error) {
+	q := `UPDATE Sessions SET LastSeen=CURRENT_TIMESTAMP, IP=?
+		WHERE SessID=?`
+	upForm, err := db.Prepare(q)
+	if err != nil { return err }
+	_, err = upForm.Exec(RealIP(r), s.SessID)
 	return err
 }
 
@@ -163,6 +682,14 @@ func (b Bookmark) MarkUnread(db *sql.DB) (error) {
 	return err
 }
 
+func (u UserProfile) SetVisibility(db *sql.DB, visibility string) error {
+	q := `UPDATE Users SET Visibility=? WHERE Username=?`
+	upForm, err := db.Prepare(q)
+	if err != nil { return err }
+	_, err = upForm.Exec(visibility, u.Username)
+	return err
+}
+
 func (u UserProfile) ChangeDisplayName(db *sql.DB, newname string) error {
 	q := `UPDATE Users SET DisplayName=? WHERE Username=?`
 	upForm, err := db.Prepare(q)
@@ -179,6 +706,41 @@ func (u UserProfile) DeleteSessions(db *sql.DB) (error) {
 	return err
 }
 
+// Sign out everywhere except for the session we are using right now
+func (u UserProfile) DeleteOtherSessions(db *sql.DB, keep string) (error) {
+	q := `DELETE FROM Sessions WHERE Username=? AND SessID!=?`
+	delForm, err := db.Prepare(q)
+	if err != nil { return err }
+	_, err = delForm.Exec(u.Username, keep)
+	return err
+}
+
+func (u UserProfile) Sessions(db *sql.DB) ([]Session, error) {
+	var sessions []Session
+	q := `SELECT
+		SessID, Username, Expires, UserAgent, IP, CreatedOn, LastSeen
+		FROM Sessions WHERE Username=? ORDER BY LastSeen DESC`
+	selForm, err := db.Prepare(q)
+	if err != nil { return sessions, err }
+	rows, err := selForm.Query(u.Username)
+	if err != nil { return sessions, err }
+	defer rows.Close()
+	var s Session
+	for rows.Next() {
+		err = rows.Scan(
+			&s.SessID,
+			&s.Username,
+			&s.Expires,
+			&s.UserAgent,
+			&s.IP,
+			&s.CreatedOn,
+			&s.LastSeen)
+		if err != nil { return nil, err }
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
 func UpdateSiteStats(db *sql.DB, metric string, num int) error {
 	// Update site-wide statistics
 	q := `INSERT INTO SiteUsage (Metric, Value) VALUES
@@ -210,7 +772,8 @@ func (u UserProfile) Derez(db *sql.DB) (error) {
 func (u UserProfile) ArchivedBookmarks(db *sql.DB, order *BOrder) (Bookmarks, error) {
 	var marks []Bookmark
 	q := `SELECT
-		BId, Username, URL, Title, Unread, Archived, AddedOn
+		BId, Username, URL, Title, Unread, Archived, AddedOn, Private,
+		COALESCE(Via, '')
 		FROM Bookmarks WHERE Username=? AND Archived ORDER BY ` +
 		order.Parameter + " " + order.Order
 	selForm, err := db.Prepare(q)
@@ -224,7 +787,9 @@ func (u UserProfile) ArchivedBookmarks(db *sql.DB, order *BOrder) (Bookmarks, er
 		&m.Title,
 		&m.Unread,
 		&m.Archived,
-		&m.AddedOn)
+		&m.AddedOn,
+		&m.Private,
+		&m.Via)
 		marks = append(marks, m)
 	}
 	return marks,err
@@ -233,7 +798,8 @@ func (u UserProfile) ArchivedBookmarks(db *sql.DB, order *BOrder) (Bookmarks, er
 func BookmarkByID(db *sql.DB, bID int) (Bookmark, error) {
 	var m Bookmark
 	q := `SELECT
-		BId, Username, URL, Title, Unread, Archived, AddedOn
+		BId, Username, URL, Title, Unread, Archived, AddedOn, Private,
+		COALESCE(Via, '')
 		FROM Bookmarks WHERE BId=?`
 	selForm, err := db.Prepare(q)
 	if err != nil { return m, err }
@@ -244,14 +810,17 @@ func BookmarkByID(db *sql.DB, bID int) (Bookmark, error) {
 		&m.Title,
 		&m.Unread,
 		&m.Archived,
-		&m.AddedOn)
-	return m, nil
+		&m.AddedOn,
+		&m.Private,
+		&m.Via)
+	return m, err
 }
 
 func (u UserProfile) UnarchivedBookmarks(db *sql.DB, order *BOrder) (Bookmarks, error) {
 	var marks []Bookmark
 	q := `SELECT
-		BId, Username, URL, Title, Unread, Archived, AddedOn
+		BId, Username, URL, Title, Unread, Archived, AddedOn, Private,
+		COALESCE(Via, '')
 		FROM Bookmarks WHERE Username=? AND !Archived ORDER BY ` +
 		order.Parameter + " " + order.Order
 	selForm, err := db.Prepare(q)
@@ -265,7 +834,9 @@ func (u UserProfile) UnarchivedBookmarks(db *sql.DB, order *BOrder) (Bookmarks,
 		&m.Title,
 		&m.Unread,
 		&m.Archived,
-		&m.AddedOn)
+		&m.AddedOn,
+		&m.Private,
+		&m.Via)
 		marks = append(marks, m)
 	}
 	return marks,err
@@ -274,7 +845,8 @@ func (u UserProfile) UnarchivedBookmarks(db *sql.DB, order *BOrder) (Bookmarks,
 func (u UserProfile) Bookmarks(db *sql.DB) (map[int]Bookmark, error) {
 	marks := make(map[int]Bookmark)
 	q := `SELECT
-		BId, Username, URL, Title, Unread, Archived, AddedOn
+		BId, Username, URL, Title, Unread, Archived, AddedOn, Private,
+		COALESCE(Via, '')
 		FROM Bookmarks WHERE Username=?`
 	selForm, err := db.Prepare(q)
 	if err != nil { return marks, err }
@@ -287,96 +859,1502 @@ func (u UserProfile) Bookmarks(db *sql.DB) (map[int]Bookmark, error) {
 		&m.Title,
 		&m.Unread,
 		&m.Archived,
-		&m.AddedOn)
+		&m.AddedOn,
+		&m.Private,
+		&m.Via)
 		marks[m.BId] = m
 	}
 	return marks,err
 }
 
-func SiteUsage(db *sql.DB) (*Usage, error) {
-	ret := new(Usage)
-	q := `SELECT Metric, Value, Period FROM SiteUsage
-		ORDER BY Metric, Period`
-	selForm, err := db.Prepare(q)
-	if err != nil { return nil, err }
-
-	var u *UsageStat
-	var metric, lastMetric, period string
-	var runningSum, value int
-	rows, err := selForm.Query()
-	for rows.Next() {
-		rows.Scan(&metric, &value, &period)
+func (o Org) Add(db *sql.DB, owner string) (error) {
+	tx, err := db.Begin()
+	if err != nil { return err }
+	defer tx.Rollback()
 
-		if metric != lastMetric {
-			runningSum = 0
-			u = new(UsageStat)
-			switch (metric) {
-			case "Users":
-				ret.Users = u
-				u.Title = "User Growth"
-			case "Bookmarks":
-				ret.Bookmarks = u
-				u.Title = "Bookmarks Indexed"
-			}
-		}
+	_, err = tx.Exec(`INSERT INTO Orgs (OrgName, DisplayName) VALUES (?, ?)`,
+		o.OrgName, o.DisplayName)
+	if err != nil { return err }
+	_, err = tx.Exec(`INSERT INTO OrgMembers (OrgName, Username, Role)
+		VALUES (?, ?, ?)`, o.OrgName, owner, OrgOwner)
+	if err != nil { return err }
+	return tx.Commit()
+}
 
-		runningSum += value
+func OrgByName(db *sql.DB, orgname string) (o Org, err error) {
+	selForm, err := db.Prepare(`SELECT OrgName, DisplayName, CreatedOn
+		FROM Orgs WHERE OrgName=?`)
+	if err != nil { return }
+	err = selForm.QueryRow(orgname).Scan(
+		&o.OrgName,
+		&o.DisplayName,
+		&o.CreatedOn)
+	return
+}
 
-		u.Values = append(u.Values, runningSum)
-		u.Titles = append(u.Titles, period)
+const orgMemberColumns = `OrgMembers.OrgName, Orgs.DisplayName,
+	OrgMembers.Username, Users.DisplayName, OrgMembers.Role,
+	OrgMembers.JoinedOn`
 
-		if runningSum > u.Max {
-			u.Max = runningSum }
+const orgMemberJoins = `FROM OrgMembers
+	JOIN Orgs ON Orgs.OrgName=OrgMembers.OrgName
+	JOIN Users ON Users.Username=OrgMembers.Username`
 
-		lastMetric = metric
+func scanOrgMembers(rows *sql.Rows) ([]OrgMember, error) {
+	var members []OrgMember
+	defer rows.Close()
+	var m OrgMember
+	for rows.Next() {
+		err := rows.Scan(
+			&m.OrgName,
+			&m.OrgDisplayName,
+			&m.Username,
+			&m.DisplayName,
+			&m.Role,
+			&m.JoinedOn)
+		if err != nil { return nil, err }
+		members = append(members, m)
 	}
+	return members, rows.Err()
+}
 
-	return ret, nil
+func (o Org) Member(db *sql.DB, uname string) (OrgMember, error) {
+	selForm, err := db.Prepare(`SELECT ` + orgMemberColumns + ` ` +
+		orgMemberJoins + ` WHERE OrgMembers.OrgName=? AND OrgMembers.Username=?`)
+	if err != nil { return OrgMember{}, err }
+	rows, err := selForm.Query(o.OrgName, uname)
+	if err != nil { return OrgMember{}, err }
+	members, err := scanOrgMembers(rows)
+	if err == nil && len(members) == 0 { err = sql.ErrNoRows }
+	if err != nil { return OrgMember{}, err }
+	return members[0], nil
 }
 
-func (u UserProfile) NewPassword(db *sql.DB, pass string) error {
-	shadow := DoShadow(pass)
-	q := `UPDATE Users SET Shadow=? WHERE Username=?`
-	upForm, err := db.Prepare(q)
-	if err != nil { return err }
+func (o Org) Members(db *sql.DB) ([]OrgMember, error) {
+	selForm, err := db.Prepare(`SELECT ` + orgMemberColumns + ` ` +
+		orgMemberJoins + ` WHERE OrgMembers.OrgName=?
+		ORDER BY FIELD(OrgMembers.Role, 'owner', 'editor', 'viewer'),
+		OrgMembers.Username`)
+	if err != nil { return nil, err }
+	rows, err := selForm.Query(o.OrgName)
+	if err != nil { return nil, err }
+	return scanOrgMembers(rows)
+}
 
-	_, err = upForm.Exec(shadow, u.Username)
+func (u UserProfile) Orgs(db *sql.DB) ([]OrgMember, error) {
+	selForm, err := db.Prepare(`SELECT ` + orgMemberColumns + ` ` +
+		orgMemberJoins + ` WHERE OrgMembers.Username=?
+		ORDER BY Orgs.DisplayName`)
+	if err != nil { return nil, err }
+	rows, err := selForm.Query(u.Username)
+	if err != nil { return nil, err }
+	return scanOrgMembers(rows)
+}
+
+func (o Org) OwnerCount(db *sql.DB) (n int, err error) {
+	q := `SELECT COUNT(*) FROM OrgMembers WHERE OrgName=? AND Role=?`
+	selForm, err := db.Prepare(q)
+	if err != nil { return }
+	err = selForm.QueryRow(o.OrgName, OrgOwner).Scan(&n)
+	return
+}
+
+// Adds the user, or changes their role if they're in already
+func (o Org) SetMember(db *sql.DB, uname, role string) (error) {
+	insForm, err := db.Prepare(`INSERT INTO OrgMembers (OrgName, Username, Role)
+		VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE Role=VALUES(Role)`)
+	if err != nil { return err }
+	_, err = insForm.Exec(o.OrgName, uname, role)
 	return err
 }
 
-func (u UserProfile) Create(db *sql.DB, pass string) (UserProfile, error) {
-	shadow := DoShadow(pass)
-	apisecret := APISecret()
+func (o Org) RemoveMember(db *sql.DB, uname string) (error) {
+	tx, err := db.Begin()
+	if err != nil { return err }
+	defer tx.Rollback()
 
-	q := `INSERT INTO Users
-	(Username, DisplayName, Shadow, APISecret) VALUES
-	(?, ?, ?, ?)`
+	_, err = tx.Exec(`DELETE FROM OrgMembers WHERE OrgName=? AND Username=?`,
+		o.OrgName, uname)
+	if err != nil { return err }
+	_, err = tx.Exec(`DELETE OrgBookmarkReads FROM OrgBookmarkReads
+		JOIN OrgBookmarks ON OrgBookmarks.BId=OrgBookmarkReads.BId
+		WHERE OrgBookmarks.OrgName=? AND OrgBookmarkReads.Username=?`,
+		o.OrgName, uname)
+	if err != nil { return err }
+	return tx.Commit()
+}
 
-	err := UpdateSiteStats(db, "Users", 1)
-	if err != nil { return UserProfile{}, err }
+// Unread is worked out for the given member
+const orgBookmarkColumns = `OrgBookmarks.BId, COALESCE(OrgBookmarks.AddedBy, ''),
+	OrgBookmarks.URL, OrgBookmarks.Title, OrgBookmarkReads.BId IS NULL,
+	OrgBookmarks.Archived, OrgBookmarks.AddedOn, OrgBookmarks.OrgName
+	FROM OrgBookmarks LEFT JOIN OrgBookmarkReads
+	ON OrgBookmarkReads.BId=OrgBookmarks.BId AND OrgBookmarkReads.Username=?`
 
-	insForm, err := db.Prepare(q)
-	if err != nil { return UserProfile{}, err }
-	_, err = insForm.Exec(
-		u.Username,
-		u.DisplayName,
-		shadow,
-		apisecret)
-	if err != nil { return UserProfile{}, err }
+func scanOrgBookmarks(rows *sql.Rows) (Bookmarks, error) {
+	var marks Bookmarks
+	defer rows.Close()
+	var m Bookmark
+	for rows.Next() {
+		err := rows.Scan(
+			&m.BId,
+			&m.Username,
+			&m.URL,
+			&m.Title,
+			&m.Unread,
+			&m.Archived,
+			&m.AddedOn,
+			&m.OrgName)
+		if err != nil { return nil, err }
+		marks = append(marks, m)
+	}
+	return marks, rows.Err()
+}
 
-	return UserByName(db, u.Username)
+func (o Org) Bookmarks(db *sql.DB, uname string, archived bool, order *BOrder) (Bookmarks, error) {
+	q := `SELECT ` + orgBookmarkColumns + `
+		WHERE OrgBookmarks.OrgName=? AND OrgBookmarks.Archived=?
+		ORDER BY OrgBookmarks.` + order.Parameter + " " + order.Order
+	selForm, err := db.Prepare(q)
+	if err != nil { return nil, err }
+	rows, err := selForm.Query(uname, o.OrgName, archived)
+	if err != nil { return nil, err }
+	return scanOrgBookmarks(rows)
 }
 
-func LetMeIn(db *sql.DB, uname, pass string) (UserProfile, error) {
-	u, err := UserByName(db, uname)
-	if err != nil { return u, errors.New("Login Error") }
+func (o Org) BookmarkByID(db *sql.DB, uname string, bID int) (Bookmark, error) {
+	selForm, err := db.Prepare(`SELECT ` + orgBookmarkColumns + `
+		WHERE OrgBookmarks.OrgName=? AND OrgBookmarks.BId=?`)
+	if err != nil { return Bookmark{}, err }
+	rows, err := selForm.Query(uname, o.OrgName, bID)
+	if err != nil { return Bookmark{}, err }
+	marks, err := scanOrgBookmarks(rows)
+	if err == nil && len(marks) == 0 { err = sql.ErrNoRows }
+	if err != nil { return Bookmark{}, err }
+	return marks[0], nil
+}
+
+func (b Bookmark) AddToOrg(db *sql.DB) (error) {
+	err := UpdateSiteStats(db, "Bookmarks", 1)
+	if err != nil { return err }
+
+	q := `INSERT INTO OrgBookmarks
+		(OrgName, AddedBy, Title, URL) VALUES (?, ?, ?, ?)`
+	insForm, err := db.Prepare(q)
+	if err != nil { return err }
+	_, err = insForm.Exec(b.OrgName, b.Username, b.Title, b.URL)
+	return err
+}
+
+func (b Bookmark) OrgEdit(db *sql.DB) (error) {
+	q := `UPDATE OrgBookmarks SET Title=?, URL=? WHERE BId=? AND OrgName=?`
+	upForm, err := db.Prepare(q)
+	if err != nil { return err }
+	_, err = upForm.Exec(b.Title, b.URL, b.BId, b.OrgName)
+	return err
+}
+
+func (b Bookmark) OrgSetArchived(db *sql.DB, archived bool) (error) {
+	q := `UPDATE OrgBookmarks SET Archived=? WHERE BId=? AND OrgName=?`
+	upForm, err := db.Prepare(q)
+	if err != nil { return err }
+	_, err = upForm.Exec(archived, b.BId, b.OrgName)
+	return err
+}
+
+func (b Bookmark) OrgDel(db *sql.DB) (error) {
+	err := UpdateSiteStats(db, "Bookmarks", -1)
+	if err != nil { return err }
+
+	q := `DELETE FROM OrgBookmarks WHERE BId=? AND OrgName=?`
+	delForm, err := db.Prepare(q)
+	if err != nil { return err }
+	_, err = delForm.Exec(b.BId, b.OrgName)
+	return err
+}
+
+func (b Bookmark) OrgMarkRead(db *sql.DB, uname string) (error) {
+	q := `INSERT IGNORE INTO OrgBookmarkReads (BId, Username) VALUES (?, ?)`
+	insForm, err := db.Prepare(q)
+	if err != nil { return err }
+	_, err = insForm.Exec(b.BId, uname)
+	return err
+}
+
+func (b Bookmark) OrgMarkUnread(db *sql.DB, uname string) (error) {
+	q := `DELETE FROM OrgBookmarkReads WHERE BId=? AND Username=?`
+	delForm, err := db.Prepare(q)
+	if err != nil { return err }
+	_, err = delForm.Exec(b.BId, uname)
+	return err
+}
+
+func SiteUsage(db *sql.DB) (*Usage, error) {
+	ret := new(Usage)
+	q := `SELECT Metric, Value, Period FROM SiteUsage
+		ORDER BY Metric, Period`
+	selForm, err := db.Prepare(q)
+	if err != nil { return nil, err }
+
+	var u *UsageStat
+	var metric, lastMetric, period string
+	var runningSum, value int
+	rows, err := selForm.Query()
+	for rows.Next() {
+		rows.Scan(&metric, &value, &period)
+
+		if metric != lastMetric {
+			runningSum = 0
+			u = new(UsageStat)
+			switch (metric) {
+			case "Users":
+				ret.Users = u
+				u.Title = "User Growth"
+			case "Bookmarks":
+				ret.Bookmarks = u
+				u.Title = "Bookmarks Indexed"
+			}
+		}
+
+		runningSum += value
+
+		u.Values = append(u.Values, runningSum)
+		u.Titles = append(u.Titles, period)
+
+		if runningSum > u.Max {
+			u.Max = runningSum }
+
+		lastMetric = metric
+	}
+
+	return ret, nil
+}
+
+func (u UserProfile) NewPassword(db *sql.DB, pass string) error {
+	shadow, err := DoShadow(pass)
+	if err != nil { return err }
+	q := `UPDATE Users SET Shadow=? WHERE Username=?`
+	upForm, err := db.Prepare(q)
+	if err != nil { return err }
+
+	_, err = upForm.Exec(shadow, u.Username)
+	if err != nil { return err }
+
+	// Anybody holding the old password is signed out
+	return u.DeleteSessions(db)
+}
+
+func (u UserProfile) Create(db *sql.DB, pass string) (UserProfile, error) {
+	shadow, err := DoShadow(pass)
+	if err != nil { return UserProfile{}, err }
+
+	q := `INSERT INTO Users
+	(Username, DisplayName, Shadow) VALUES
+	(?, ?, ?)`
+
+	err = UpdateSiteStats(db, "Users", 1)
+	if err != nil { return UserProfile{}, err }
+
+	insForm, err := db.Prepare(q)
+	if err != nil { return UserProfile{}, err }
+	_, err = insForm.Exec(
+		u.Username,
+		u.DisplayName,
+		shadow)
+	if err != nil { return UserProfile{}, err }
+
+	return UserByName(db, u.Username)
+}
+
+func LetMeIn(db *sql.DB, uname, pass string) (UserProfile, error) {
+	u, err := UserByName(db, uname)
+	if err != nil {
+		// Take as long as a real check so nobody can time whether
+		// the account exists
+		CompareShadow(DummyShadow(), pass)
+		return u, errors.New("Login Error")
+	}
 
 	fail := CompareShadow(u.Shadow, pass)
 	if fail != nil { return u, errors.New("Login Error") }
 
+	// Only now do we have the password to upgrade an old hash with
+	if ShadowOutdated(u.Shadow) {
+		err = u.Rehash(db, pass)
+		if err != nil {
+			log.Printf("Failed to re-hash @%s: %s", u.Username, err)
+		} else {
+			log.Printf("Re-hashed @%s (was %s)",
+				u.Username, ShadowScheme(u.Shadow))
+		}
+	}
+
+	if u.Status == AccountPending { return u, ErrPendingApproval }
+	if !u.Active() { return u, ErrInactive }
 	return u, nil
 }
 
+// Same password, new shadow; unlike NewPassword nobody is signed out
+func (u UserProfile) Rehash(db *sql.DB, pass string) (error) {
+	shadow, err := DoShadow(pass)
+	if err != nil { return err }
+	q := `UPDATE Users SET Shadow=? WHERE Username=? AND Shadow=?`
+	upForm, err := db.Prepare(q)
+	if err != nil { return err }
+	_, err = upForm.Exec(shadow, u.Username, u.Shadow)
+	return err
+}
+
+// How many accounts use each hashing scheme and how many of them are due
+// an upgrade
+func ShadowReport(db *sql.DB) (schemes map[string]int, outdated int, err error) {
+	schemes = make(map[string]int)
+	selForm, err := db.Prepare(`SELECT Shadow FROM Users`)
+	if err != nil { return }
+	rows, err := selForm.Query()
+	if err != nil { return }
+	defer rows.Close()
+
+	var shadow string
+	for rows.Next() {
+		err = rows.Scan(&shadow)
+		if err != nil { return nil, 0, err }
+		schemes[ShadowScheme(shadow)]++
+		if ShadowOutdated(shadow) { outdated++ }
+	}
+	return schemes, outdated, rows.Err()
+}
+
+// Passwords are right but we still want a TOTP / recovery code
+func (u UserProfile) VerifySecondFactor(db *sql.DB, code string) (error) {
+	// No secret means no codes, recovery ones included
+	if !u.TOTPEnabled { return errors.New("Login Error") }
+	if step, ok := CheckTOTP(u.TOTPSecret, code, u.TOTPLastStep); ok {
+		return u.AcceptTOTPStep(db, step)
+	}
+
+	used, err := u.UseRecoveryCode(db, code)
+	if err != nil { return err }
+	if !used { return errors.New("Login Error") }
+
+	log.Printf("User %s (@%s) signed in with a recovery code",
+		u.DisplayName, u.Username)
+	return nil
+}
+
+// Stash a secret which isn't enforced until EnableTOTP
+func (u UserProfile) SetTOTPSecret(db *sql.DB, secret string) (error) {
+	q := `UPDATE Users SET TOTPSecret=?, TOTPEnabled=false, TOTPLastStep=0
+		WHERE Username=?`
+	upForm, err := db.Prepare(q)
+	if err != nil { return err }
+	_, err = upForm.Exec(secret, u.Username)
+	return err
+}
+
+func (u UserProfile) EnableTOTP(db *sql.DB, step int64) (error) {
+	q := `UPDATE Users SET TOTPEnabled=true, TOTPLastStep=?
+		WHERE Username=?`
+	upForm, err := db.Prepare(q)
+	if err != nil { return err }
+	_, err = upForm.Exec(step, u.Username)
+	return err
+}
+
+func (u UserProfile) DisableTOTP(db *sql.DB) (error) {
+	q := `UPDATE Users SET TOTPSecret='', TOTPEnabled=false, TOTPLastStep=0
+		WHERE Username=?`
+	upForm, err := db.Prepare(q)
+	if err != nil { return err }
+	_, err = upForm.Exec(u.Username)
+	if err != nil { return err }
+	return u.SetRecoveryCodes(db, nil)
+}
+
+// Check and update in one go, so two logins racing with the same code can't
+// both get in
+func (u UserProfile) AcceptTOTPStep(db *sql.DB, step int64) (error) {
+	q := `UPDATE Users SET TOTPLastStep=?
+		WHERE Username=? AND TOTPLastStep < ?`
+	upForm, err := db.Prepare(q)
+	if err != nil { return err }
+	result, err := upForm.Exec(step, u.Username, step)
+	if err != nil { return err }
+	n, err := result.RowsAffected()
+	if err != nil { return err }
+	if n == 0 { return errors.New("Login Error") }
+	return nil
+}
+
+// Replaces every recovery code the user had with these, all or nothing
+func (u UserProfile) SetRecoveryCodes(db *sql.DB, codes []string) (error) {
+	tx, err := db.Begin()
+	if err != nil { return err }
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`DELETE FROM RecoveryCodes WHERE Username=?`, u.Username)
+	if err != nil { return err }
+	for _, c := range codes {
+		_, err = tx.Exec(`INSERT INTO RecoveryCodes (Username, CodeHash)
+			VALUES (?, ?)`, u.Username, HashRecoveryCode(c))
+		if err != nil { return err }
+	}
+	return tx.Commit()
+}
+
+// A fresh set of recovery codes, already stored; the only time anybody sees
+// them in plain text
+func (u UserProfile) NewRecoveryCodes(db *sql.DB) ([]string, error) {
+	codes, err := NewRecoveryCodes()
+	if err != nil { return nil, err }
+	if err = u.SetRecoveryCodes(db, codes); err != nil { return nil, err }
+	return codes, nil
+}
+
+func (u UserProfile) UseRecoveryCode(db *sql.DB, code string) (bool, error) {
+	q := `DELETE FROM RecoveryCodes WHERE Username=? AND CodeHash=?`
+	delForm, err := db.Prepare(q)
+	if err != nil { return false, err }
+	result, err := delForm.Exec(u.Username, HashRecoveryCode(code))
+	if err != nil { return false, err }
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (u UserProfile) RecoveryCodesLeft(db *sql.DB) (n int, err error) {
+	q := `SELECT COUNT(*) FROM RecoveryCodes WHERE Username=?`
+	selForm, err := db.Prepare(q)
+	if err != nil { return }
+	err = selForm.QueryRow(u.Username).Scan(&n)
+	return
+}
+
+// Returns the plaintext token; this is the only time anybody sees it
+func (u UserProfile) AddAPIToken(db *sql.DB, t APIToken, expiryDays int) (string, error) {
+	token := NewAPIToken()
+	q := `INSERT INTO APITokens
+		(Username, Name, TokenHash, Scope, AllowedIPs, Expires)
+		VALUES (?, ?, ?, ?, ?, IF(? > 0,
+			CURRENT_TIMESTAMP + INTERVAL ? DAY, NULL))`
+	insForm, err := db.Prepare(q)
+	if err != nil { return "", err }
+	_, err = insForm.Exec(u.Username, t.Name, HashToken(token), t.Scope,
+		t.AllowedIPs, expiryDays, expiryDays)
+	return token, err
+}
+
+func (u UserProfile) APITokens(db *sql.DB) ([]APIToken, error) {
+	var tokens []APIToken
+	q := `SELECT TokenID, Username, Name, TokenHash, Scope, AllowedIPs,
+		CreatedOn, COALESCE(Expires, ''), COALESCE(LastUsed, '')
+		FROM APITokens WHERE Username=? AND GrantID IS NULL
+		ORDER BY CreatedOn`
+	selForm, err := db.Prepare(q)
+	if err != nil { return tokens, err }
+	rows, err := selForm.Query(u.Username)
+	if err != nil { return tokens, err }
+	defer rows.Close()
+	var t APIToken
+	for rows.Next() {
+		err = rows.Scan(
+			&t.TokenID,
+			&t.Username,
+			&t.Name,
+			&t.TokenHash,
+			&t.Scope,
+			&t.AllowedIPs,
+			&t.CreatedOn,
+			&t.Expires,
+			&t.LastUsed)
+		if err != nil { return nil, err }
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// Unexpired tokens only
+func APITokenByToken(db *sql.DB, token string) (t APIToken, err error) {
+	q := `SELECT TokenID, Username, Name, TokenHash, Scope, AllowedIPs,
+		CreatedOn, COALESCE(Expires, ''), COALESCE(LastUsed, '')
+		FROM APITokens WHERE TokenHash=? AND
+		(Expires IS NULL OR Expires >= CURRENT_TIMESTAMP)`
+	selForm, err := db.Prepare(q)
+	if err != nil { return }
+	err = selForm.QueryRow(HashToken(token)).Scan(
+		&t.TokenID,
+		&t.Username,
+		&t.Name,
+		&t.TokenHash,
+		&t.Scope,
+		&t.AllowedIPs,
+		&t.CreatedOn,
+		&t.Expires,
+		&t.LastUsed)
+	return
+}
+
+func (t APIToken) Used(db *sql.DB) (error) {
+	q := `UPDATE APITokens SET LastUsed=CURRENT_TIMESTAMP WHERE TokenID=?`
+	upForm, err := db.Prepare(q)
+	if err != nil { return err }
+	_, err = upForm.Exec(t.TokenID)
+	return err
+}
+
+func (t APIToken) Revoke(db *sql.DB) (error) {
+	q := `DELETE FROM APITokens WHERE TokenID=? AND Username=?`
+	delForm, err := db.Prepare(q)
+	if err != nil { return err }
+	_, err = delForm.Exec(t.TokenID, t.Username)
+	return err
+}
+
+// Password was accepted; remember who is halfway through logging in
+func (ws WebSession) Challenge(db *sql.DB, uname string) (error) {
+	q := `REPLACE INTO LoginChallenges (SessID, Username, Expires)
+		VALUES (?, ?, CURRENT_TIMESTAMP + INTERVAL 5 MINUTE)`
+	insForm, err := db.Prepare(q)
+	if err != nil { return err }
+	_, err = insForm.Exec(ws.SessID, uname)
+	return err
+}
+
+func (ws WebSession) Challenged(db *sql.DB) (uname string, err error) {
+	q := `SELECT Username FROM LoginChallenges
+		WHERE SessID=? AND Expires >= CURRENT_TIMESTAMP`
+	selForm, err := db.Prepare(q)
+	if err != nil { return }
+	err = selForm.QueryRow(ws.SessID).Scan(&uname)
+	return
+}
+
+func (ws WebSession) ClearChallenge(db *sql.DB) (error) {
+	q := `DELETE FROM LoginChallenges WHERE SessID=?`
+	delForm, err := db.Prepare(q)
+	if err != nil { return err }
+	_, err = delForm.Exec(ws.SessID)
+	return err
+}
+
+func PasskeyByID(db *sql.DB, credID string) (p Passkey, err error) {
+	q := `SELECT CredID, Username, Name, PublicKey, SignCount,
+		CreatedOn, COALESCE(LastUsed, '')
+		FROM Passkeys WHERE CredID=?`
+	selForm, err := db.Prepare(q)
+	if err != nil { return }
+	err = selForm.QueryRow(credID).Scan(
+		&p.CredID,
+		&p.Username,
+		&p.Name,
+		&p.PublicKey,
+		&p.SignCount,
+		&p.CreatedOn,
+		&p.LastUsed)
+	return
+}
+
+func (u UserProfile) Passkeys(db *sql.DB) ([]Passkey, error) {
+	var keys []Passkey
+	q := `SELECT CredID, Username, Name, PublicKey, SignCount,
+		CreatedOn, COALESCE(LastUsed, '')
+		FROM Passkeys WHERE Username=? ORDER BY CreatedOn`
+	selForm, err := db.Prepare(q)
+	if err != nil { return keys, err }
+	rows, err := selForm.Query(u.Username)
+	if err != nil { return keys, err }
+	defer rows.Close()
+	var p Passkey
+	for rows.Next() {
+		err = rows.Scan(
+			&p.CredID,
+			&p.Username,
+			&p.Name,
+			&p.PublicKey,
+			&p.SignCount,
+			&p.CreatedOn,
+			&p.LastUsed)
+		if err != nil { return nil, err }
+		keys = append(keys, p)
+	}
+	return keys, rows.Err()
+}
+
+func (p Passkey) Add(db *sql.DB) (error) {
+	q := `INSERT INTO Passkeys
+		(CredID, Username, Name, PublicKey, SignCount)
+		VALUES (?, ?, ?, ?, ?)`
+	insForm, err := db.Prepare(q)
+	if err != nil { return err }
+	_, err = insForm.Exec(p.CredID, p.Username, p.Name,
+		p.PublicKey, p.SignCount)
+	return err
+}
+
+func (p Passkey) Rename(db *sql.DB, name string) (error) {
+	q := `UPDATE Passkeys SET Name=? WHERE CredID=? AND Username=?`
+	upForm, err := db.Prepare(q)
+	if err != nil { return err }
+	_, err = upForm.Exec(name, p.CredID, p.Username)
+	return err
+}
+
+func (p Passkey) Del(db *sql.DB) (error) {
+	q := `DELETE FROM Passkeys WHERE CredID=? AND Username=?`
+	delForm, err := db.Prepare(q)
+	if err != nil { return err }
+	_, err = delForm.Exec(p.CredID, p.Username)
+	return err
+}
+
+func (p Passkey) Used(db *sql.DB, count uint32) (error) {
+	q := `UPDATE Passkeys SET SignCount=?, LastUsed=CURRENT_TIMESTAMP
+		WHERE CredID=?`
+	upForm, err := db.Prepare(q)
+	if err != nil { return err }
+	_, err = upForm.Exec(count, p.CredID)
+	return err
+}
+
+// One outstanding WebAuthn ceremony per session; uname is empty for a
+// passwordless sign-in where we don't know who is coming yet
+func (ws WebSession) SetWebAuthnChallenge(db *sql.DB, challenge, uname string) (error) {
+	q := `REPLACE INTO WebAuthnChallenges (SessID, Challenge, Username, Expires)
+		VALUES (?, ?, ?, CURRENT_TIMESTAMP + INTERVAL 5 MINUTE)`
+	insForm, err := db.Prepare(q)
+	if err != nil { return err }
+	_, err = insForm.Exec(ws.SessID, challenge, uname)
+	return err
+}
+
+// Challenges are single-use so this also forgets it
+func (ws WebSession) TakeWebAuthnChallenge(db *sql.DB) (challenge, uname string, err error) {
+	q := `SELECT Challenge, Username FROM WebAuthnChallenges
+		WHERE SessID=? AND Expires >= CURRENT_TIMESTAMP`
+	selForm, err := db.Prepare(q)
+	if err != nil { return }
+	err = selForm.QueryRow(ws.SessID).Scan(&challenge, &uname)
+	if err != nil { return }
+
+	q = `DELETE FROM WebAuthnChallenges WHERE SessID=?`
+	delForm, err := db.Prepare(q)
+	if err != nil { return }
+	_, err = delForm.Exec(ws.SessID)
+	return
+}
+
+// Only verified addresses can be used to find an account
+func UserByEmail(db *sql.DB, email string) (u UserProfile, err error) {
+	var uname string
+	q := `SELECT Username FROM Users WHERE VerifiedEmail=?`
+	selForm, err := db.Prepare(q)
+	if err != nil { return }
+	err = selForm.QueryRow(email).Scan(&uname)
+	if err != nil { return }
+	return UserByName(db, uname)
+}
+
+// Reset links already sent to any other address stop working
+func (u UserProfile) SetEmail(db *sql.DB, email string) (error) {
+	if err := u.EmailFree(db, email); err != nil { return err }
+
+	tx, err := db.Begin()
+	if err != nil { return err }
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`UPDATE Users SET Email=?, EmailVerified=false
+		WHERE Username=?`, email, u.Username)
+	if err != nil { return err }
+	_, err = tx.Exec(`DELETE FROM MailTokens
+		WHERE Username=? AND Purpose=? AND Email<>?`,
+		u.Username, MailTokenReset, email)
+	if err != nil { return err }
+	return tx.Commit()
+}
+
+// Only verifies the address the token was sent to, in case it was changed
+// again in the meantime. The unique index on VerifiedEmail settles two
+// accounts confirming the same address at once
+func (u UserProfile) VerifyEmail(db *sql.DB, email string) (error) {
+	if err := u.EmailFree(db, email); err != nil { return err }
+
+	q := `UPDATE Users SET EmailVerified=true WHERE Username=? AND Email=?`
+	upForm, err := db.Prepare(q)
+	if err != nil { return err }
+	_, err = upForm.Exec(u.Username, email)
+	return err
+}
+
+// ErrEmailTaken if another account has already confirmed this address
+func (u UserProfile) EmailFree(db *sql.DB, email string) (error) {
+	other, err := UserByEmail(db, email)
+	if err == sql.ErrNoRows { return nil }
+	if err != nil { return err }
+	if other.Username != u.Username { return ErrEmailTaken }
+	return nil
+}
+
+func (u UserProfile) NewMailToken(db *sql.DB, purpose, email string) (string, error) {
+	token := MailToken()
+	q := `INSERT INTO MailTokens (TokenHash, Username, Purpose, Email, Expires)
+		VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP + INTERVAL ? MINUTE)`
+	insForm, err := db.Prepare(q)
+	if err != nil { return "", err }
+	_, err = insForm.Exec(HashToken(token), u.Username, purpose, email,
+		Settings.Mail.TokenExpiryMinutes)
+	return token, err
+}
+
+func MailTokenOwner(db *sql.DB, token, purpose string) (uname, email string, err error) {
+	q := `SELECT Username, Email FROM MailTokens
+		WHERE TokenHash=? AND Purpose=? AND Expires >= CURRENT_TIMESTAMP`
+	selForm, err := db.Prepare(q)
+	if err != nil { return }
+	err = selForm.QueryRow(HashToken(token), purpose).Scan(&uname, &email)
+	return
+}
+
+// Whoever deletes the row gets to use the token; nobody else does
+func ConsumeMailToken(db *sql.DB, token string) (bool, error) {
+	q := `DELETE FROM MailTokens WHERE TokenHash=?`
+	delForm, err := db.Prepare(q)
+	if err != nil { return false, err }
+	result, err := delForm.Exec(HashToken(token))
+	if err != nil { return false, err }
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (u UserProfile) DeleteMailTokens(db *sql.DB, purpose string) (error) {
+	q := `DELETE FROM MailTokens WHERE Username=? AND Purpose=?`
+	delForm, err := db.Prepare(q)
+	if err != nil { return err }
+	_, err = delForm.Exec(u.Username, purpose)
+	return err
+}
+
+func OAuthClientByID(db *sql.DB, clientID string) (c OAuthClient, err error) {
+	q := `SELECT ClientID, SecretHash, Name, RedirectURIs, CreatedOn
+		FROM OAuthClients WHERE ClientID=?`
+	selForm, err := db.Prepare(q)
+	if err != nil { return }
+	err = selForm.QueryRow(clientID).Scan(
+		&c.ClientID,
+		&c.SecretHash,
+		&c.Name,
+		&c.RedirectURIs,
+		&c.CreatedOn)
+	return
+}
+
+func OAuthClients(db *sql.DB) ([]OAuthClient, error) {
+	var clients []OAuthClient
+	q := `SELECT ClientID, SecretHash, Name, RedirectURIs, CreatedOn
+		FROM OAuthClients ORDER BY Name`
+	selForm, err := db.Prepare(q)
+	if err != nil { return clients, err }
+	rows, err := selForm.Query()
+	if err != nil { return clients, err }
+	defer rows.Close()
+	var c OAuthClient
+	for rows.Next() {
+		err = rows.Scan(
+			&c.ClientID,
+			&c.SecretHash,
+			&c.Name,
+			&c.RedirectURIs,
+			&c.CreatedOn)
+		if err != nil { return nil, err }
+		clients = append(clients, c)
+	}
+	return clients, rows.Err()
+}
+
+func (c OAuthClient) Add(db *sql.DB) (error) {
+	q := `INSERT INTO OAuthClients (ClientID, SecretHash, Name, RedirectURIs)
+		VALUES (?, ?, ?, ?)`
+	insForm, err := db.Prepare(q)
+	if err != nil { return err }
+	_, err = insForm.Exec(c.ClientID, c.SecretHash, c.Name, c.RedirectURIs)
+	return err
+}
+
+// Takes every grant (and so every token) for the client with it
+func (c OAuthClient) Del(db *sql.DB) (error) {
+	q := `DELETE FROM OAuthClients WHERE ClientID=?`
+	delForm, err := db.Prepare(q)
+	if err != nil { return err }
+	_, err = delForm.Exec(c.ClientID)
+	return err
+}
+
+func (u UserProfile) NewOAuthCode(db *sql.DB, c OAuthCode) (string, error) {
+	code := MailToken()
+	q := `INSERT INTO OAuthCodes (CodeHash, ClientID, Username, RedirectURI,
+		Scope, Challenge, Expires) VALUES (?, ?, ?, ?, ?, ?,
+		CURRENT_TIMESTAMP + INTERVAL ? MINUTE)`
+	insForm, err := db.Prepare(q)
+	if err != nil { return "", err }
+	_, err = insForm.Exec(HashToken(code), c.ClientID, u.Username,
+		c.RedirectURI, c.Scope, c.Challenge, Settings.OAuth.CodeMinutes)
+	return code, err
+}
+
+// Codes are single-use; whoever deletes the row gets it
+func TakeOAuthCode(db *sql.DB, code string) (c OAuthCode, err error) {
+	q := `SELECT ClientID, Username, RedirectURI, Scope, Challenge
+		FROM OAuthCodes WHERE CodeHash=? AND Expires >= CURRENT_TIMESTAMP`
+	selForm, err := db.Prepare(q)
+	if err != nil { return }
+	err = selForm.QueryRow(HashToken(code)).Scan(
+		&c.ClientID,
+		&c.Username,
+		&c.RedirectURI,
+		&c.Scope,
+		&c.Challenge)
+	if err != nil { return }
+
+	delForm, err := db.Prepare(`DELETE FROM OAuthCodes WHERE CodeHash=?`)
+	if err != nil { return }
+	result, err := delForm.Exec(HashToken(code))
+	if err != nil { return }
+	if n, _ := result.RowsAffected(); n == 0 { err = sql.ErrNoRows }
+	return
+}
+
+// One grant per user and app; approving again just updates the scope
+func (u UserProfile) GrantOAuth(db *sql.DB, clientID, scope string) (grantID int, err error) {
+	q := `INSERT INTO OAuthGrants (ClientID, Username, Scope)
+		VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE
+		Scope=VALUES(Scope), GrantID=LAST_INSERT_ID(GrantID)`
+	insForm, err := db.Prepare(q)
+	if err != nil { return }
+	result, err := insForm.Exec(clientID, u.Username, scope)
+	if err != nil { return }
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+func (u UserProfile) OAuthGrants(db *sql.DB) ([]OAuthGrant, error) {
+	var grants []OAuthGrant
+	q := `SELECT g.GrantID, g.ClientID, c.Name, g.Username, g.Scope,
+		g.CreatedOn, COALESCE(MAX(t.LastUsed), '')
+		FROM OAuthGrants g
+		JOIN OAuthClients c ON c.ClientID=g.ClientID
+		LEFT JOIN APITokens t ON t.GrantID=g.GrantID
+		WHERE g.Username=? GROUP BY g.GrantID ORDER BY c.Name`
+	selForm, err := db.Prepare(q)
+	if err != nil { return grants, err }
+	rows, err := selForm.Query(u.Username)
+	if err != nil { return grants, err }
+	defer rows.Close()
+	var g OAuthGrant
+	for rows.Next() {
+		err = rows.Scan(
+			&g.GrantID,
+			&g.ClientID,
+			&g.ClientName,
+			&g.Username,
+			&g.Scope,
+			&g.CreatedOn,
+			&g.LastUsed)
+		if err != nil { return nil, err }
+		grants = append(grants, g)
+	}
+	return grants, rows.Err()
+}
+
+func OAuthGrantByID(db *sql.DB, grantID int) (g OAuthGrant, err error) {
+	q := `SELECT GrantID, ClientID, Username, Scope, CreatedOn
+		FROM OAuthGrants WHERE GrantID=?`
+	selForm, err := db.Prepare(q)
+	if err != nil { return }
+	err = selForm.QueryRow(grantID).Scan(
+		&g.GrantID,
+		&g.ClientID,
+		&g.Username,
+		&g.Scope,
+		&g.CreatedOn)
+	return
+}
+
+// Access and refresh tokens hang off the grant and go with it
+func (g OAuthGrant) Revoke(db *sql.DB) (error) {
+	q := `DELETE FROM OAuthGrants WHERE GrantID=? AND Username=?`
+	delForm, err := db.Prepare(q)
+	if err != nil { return err }
+	_, err = delForm.Exec(g.GrantID, g.Username)
+	return err
+}
+
+// Short-lived bearer token plus a refresh token to get the next one with
+func (g OAuthGrant) IssueTokens(db *sql.DB, clientName string) (access, refresh string, err error) {
+	if err = ExpireOAuthTokens(db); err != nil { return }
+
+	access = NewAPIToken()
+	q := `INSERT INTO APITokens
+		(Username, Name, TokenHash, Scope, GrantID, Expires)
+		VALUES (?, ?, ?, ?, ?, CURRENT_TIMESTAMP + INTERVAL ? MINUTE)`
+	insForm, err := db.Prepare(q)
+	if err != nil { return }
+	_, err = insForm.Exec(g.Username, clientName, HashToken(access),
+		OAuthScopes[g.Scope], g.GrantID, Settings.OAuth.AccessTokenMinutes)
+	if err != nil { return }
+
+	refresh = MailToken()
+	q = `INSERT INTO OAuthRefreshTokens (TokenHash, GrantID, Expires)
+		VALUES (?, ?, CURRENT_TIMESTAMP + INTERVAL ? DAY)`
+	insForm, err = db.Prepare(q)
+	if err != nil { return }
+	_, err = insForm.Exec(HashToken(refresh), g.GrantID,
+		Settings.OAuth.RefreshTokenDays)
+	return
+}
+
+// OAuth access and refresh tokens past their expiry are never any use
+// again. Expired tokens people made themselves stay listed until they're
+// deleted
+func ExpireOAuthTokens(db *sql.DB) (error) {
+	q := `DELETE FROM APITokens
+		WHERE GrantID IS NOT NULL AND Expires < CURRENT_TIMESTAMP`
+	delForm, err := db.Prepare(q)
+	if err != nil { return err }
+	_, err = delForm.Exec()
+	if err != nil { return err }
+
+	q = `DELETE FROM OAuthRefreshTokens WHERE Expires < CURRENT_TIMESTAMP`
+	delForm, err = db.Prepare(q)
+	if err != nil { return err }
+	_, err = delForm.Exec()
+	return err
+}
+
+// Refresh tokens rotate: using one deletes it
+func TakeOAuthRefreshToken(db *sql.DB, token string) (grantID int, err error) {
+	q := `SELECT GrantID FROM OAuthRefreshTokens
+		WHERE TokenHash=? AND Expires >= CURRENT_TIMESTAMP`
+	selForm, err := db.Prepare(q)
+	if err != nil { return }
+	err = selForm.QueryRow(HashToken(token)).Scan(&grantID)
+	if err != nil { return }
+
+	q = `DELETE FROM OAuthRefreshTokens WHERE TokenHash=?`
+	delForm, err := db.Prepare(q)
+	if err != nil { return }
+	result, err := delForm.Exec(HashToken(token))
+	if err != nil { return }
+	if n, _ := result.RowsAffected(); n == 0 { err = sql.ErrNoRows }
+	return
+}
+
+func (u UserProfile) Follow(db *sql.DB, followee string) (error) {
+	insForm, err := db.Prepare(`INSERT IGNORE INTO Follows
+		(Follower, Followee) VALUES (?, ?)`)
+	if err != nil { return err }
+	_, err = insForm.Exec(u.Username, followee)
+	return err
+}
+
+func (u UserProfile) Unfollow(db *sql.DB, followee string) (error) {
+	delForm, err := db.Prepare(`DELETE FROM Follows
+		WHERE Follower=? AND Followee=?`)
+	if err != nil { return err }
+	_, err = delForm.Exec(u.Username, followee)
+	return err
+}
+
+func (u UserProfile) IsFollowing(db *sql.DB, followee string) (following bool, err error) {
+	selForm, err := db.Prepare(`SELECT COUNT(*) > 0 FROM Follows
+		WHERE Follower=? AND Followee=?`)
+	if err != nil { return }
+	err = selForm.QueryRow(u.Username, followee).Scan(&following)
+	return
+}
+
+// Bookmarks that show up in a follower's feed: public ones, from active
+// accounts that haven't gone private since
+const followingFeed = `SELECT
+	m.BId, m.Username, m.URL, m.Title, m.Unread, m.Archived, m.AddedOn,
+	m.Private, COALESCE(m.Via, '')
+	FROM Follows f
+	JOIN Bookmarks m ON m.Username=f.Followee
+	JOIN Users o ON o.Username=f.Followee
+	WHERE f.Follower=? AND !m.Private AND o.Status='` + AccountActive + `'
+	AND o.Visibility != '` + VisibilityPrivate + `'`
+
+// Newest first
+func (u UserProfile) FollowingFeed(db *sql.DB, limit int) (Bookmarks, error) {
+	var marks []Bookmark
+	selForm, err := db.Prepare(followingFeed +
+		` ORDER BY m.AddedOn DESC LIMIT ?`)
+	if err != nil { return marks, err }
+	rows, err := selForm.Query(u.Username, limit)
+	if err != nil { return marks, err }
+	defer rows.Close()
+	var m Bookmark
+	for rows.Next() {
+		err = rows.Scan(
+			&m.BId,
+			&m.Username,
+			&m.URL,
+			&m.Title,
+			&m.Unread,
+			&m.Archived,
+			&m.AddedOn,
+			&m.Private,
+			&m.Via)
+		if err != nil { return nil, err }
+		marks = append(marks, m)
+	}
+	return marks, rows.Err()
+}
+
+// One bookmark out of the user's feed; sql.ErrNoRows if it isn't in it
+func (u UserProfile) FeedBookmark(db *sql.DB, bID int) (m Bookmark, err error) {
+	selForm, err := db.Prepare(followingFeed + ` AND m.BId=?`)
+	if err != nil { return }
+	err = selForm.QueryRow(u.Username, bID).Scan(
+		&m.BId,
+		&m.Username,
+		&m.URL,
+		&m.Title,
+		&m.Unread,
+		&m.Archived,
+		&m.AddedOn,
+		&m.Private,
+		&m.Via)
+	return
+}
+
+// Whether the user already has this URL saved, archived or not
+func (u UserProfile) HasURL(db *sql.DB, url string) (has bool, err error) {
+	selForm, err := db.Prepare(`SELECT COUNT(*) > 0 FROM Bookmarks
+		WHERE Username=? AND URL=?`)
+	if err != nil { return }
+	err = selForm.QueryRow(u.Username, url).Scan(&has)
+	return
+}
+
+const feedSubscriptionColumns = `FeedID, Username, URL, COALESCE(Title, ''),
+	Keywords, Private, COALESCE(ETag, ''), COALESCE(LastModified, ''),
+	COALESCE(LastChecked, ''), NextCheck, Failures, COALESCE(LastError, ''),
+	Added, CreatedOn`
+
+func scanFeedSubscriptions(rows *sql.Rows) ([]FeedSubscription, error) {
+	defer rows.Close()
+	var feeds []FeedSubscription
+	var f FeedSubscription
+	for rows.Next() {
+		err := rows.Scan(
+			&f.FeedID,
+			&f.Username,
+			&f.URL,
+			&f.Title,
+			&f.Keywords,
+			&f.Private,
+			&f.ETag,
+			&f.LastModified,
+			&f.LastChecked,
+			&f.NextCheck,
+			&f.Failures,
+			&f.LastError,
+			&f.Added,
+			&f.CreatedOn)
+		if err != nil { return nil, err }
+		feeds = append(feeds, f)
+	}
+	return feeds, rows.Err()
+}
+
+func (f FeedSubscription) Add(db *sql.DB) (error) {
+	insForm, err := db.Prepare(`INSERT INTO FeedSubscriptions
+		(Username, URL, Keywords, Private) VALUES (?, ?, ?, ?)`)
+	if err != nil { return err }
+	_, err = insForm.Exec(f.Username, f.URL, f.Keywords, f.Private)
+	return err
+}
+
+func (u UserProfile) FeedSubscriptions(db *sql.DB) ([]FeedSubscription, error) {
+	selForm, err := db.Prepare(`SELECT ` + feedSubscriptionColumns +
+		` FROM FeedSubscriptions WHERE Username=? ORDER BY CreatedOn`)
+	if err != nil { return nil, err }
+	rows, err := selForm.Query(u.Username)
+	if err != nil { return nil, err }
+	return scanFeedSubscriptions(rows)
+}
+
+// Oldest first, and only for accounts still in use
+func DueFeeds(db *sql.DB, limit int) ([]FeedSubscription, error) {
+	selForm, err := db.Prepare(`SELECT ` + feedSubscriptionColumns +
+		` FROM FeedSubscriptions
+		WHERE NextCheck <= CURRENT_TIMESTAMP AND Username IN
+			(SELECT Username FROM Users WHERE Status='` + AccountActive + `')
+		ORDER BY NextCheck LIMIT ?`)
+	if err != nil { return nil, err }
+	rows, err := selForm.Query(limit)
+	if err != nil { return nil, err }
+	return scanFeedSubscriptions(rows)
+}
+
+func (u UserProfile) RemoveFeed(db *sql.DB, feedID string) (error) {
+	delForm, err := db.Prepare(`DELETE FROM FeedSubscriptions
+		WHERE FeedID=? AND Username=?`)
+	if err != nil { return err }
+	_, err = delForm.Exec(feedID, u.Username)
+	return err
+}
+
+func (u UserProfile) CheckFeedNow(db *sql.DB, feedID string) (error) {
+	upForm, err := db.Prepare(`UPDATE FeedSubscriptions
+		SET NextCheck=CURRENT_TIMESTAMP WHERE FeedID=? AND Username=?`)
+	if err != nil { return err }
+	_, err = upForm.Exec(feedID, u.Username)
+	return err
+}
+
+// Records that an item has been through the poller; false if it already had
+func (f FeedSubscription) MarkSeen(db *sql.DB, itemID string) (bool, error) {
+	insForm, err := db.Prepare(`INSERT IGNORE INTO FeedItemsSeen
+		(FeedID, ItemHash) VALUES (?, ?)`)
+	if err != nil { return false, err }
+	result, err := insForm.Exec(f.FeedID, HashToken(itemID))
+	if err != nil { return false, err }
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (f FeedSubscription) Checked(db *sql.DB, title, etag, lastModified string, added, delayMinutes int) (error) {
+	upForm, err := db.Prepare(`UPDATE FeedSubscriptions
+		SET Title=?, ETag=NULLIF(?, ''), LastModified=NULLIF(?, ''),
+		LastChecked=CURRENT_TIMESTAMP,
+		NextCheck=CURRENT_TIMESTAMP + INTERVAL ? MINUTE,
+		Failures=0, LastError=NULL, Added=Added + ?
+		WHERE FeedID=?`)
+	if err != nil { return err }
+	_, err = upForm.Exec(title, etag, lastModified, delayMinutes, added,
+		f.FeedID)
+	return err
+}
+
+func (f FeedSubscription) Failed(db *sql.DB, reason string, delayMinutes int) (error) {
+	upForm, err := db.Prepare(`UPDATE FeedSubscriptions
+		SET LastChecked=CURRENT_TIMESTAMP,
+		NextCheck=CURRENT_TIMESTAMP + INTERVAL ? MINUTE,
+		Failures=Failures + 1, LastError=?
+		WHERE FeedID=?`)
+	if err != nil { return err }
+	if len(reason) > 255 { reason = reason[:255] }
+	_, err = upForm.Exec(delayMinutes, reason, f.FeedID)
+	return err
+}
+
+func MailInAddressByToken(db *sql.DB, token string) (a MailInAddress, err error) {
+	selForm, err := db.Prepare(`SELECT Username, Token, AllowedSenders
+		FROM MailInAddresses WHERE Token=?`)
+	if err != nil { return }
+	err = selForm.QueryRow(token).Scan(&a.Username, &a.Token,
+		&a.AllowedSenders)
+	return
+}
+
+func (u UserProfile) MailInAddress(db *sql.DB) (a MailInAddress, err error) {
+	selForm, err := db.Prepare(`SELECT Username, Token, AllowedSenders
+		FROM MailInAddresses WHERE Username=?`)
+	if err != nil { return }
+	err = selForm.QueryRow(u.Username).Scan(&a.Username, &a.Token,
+		&a.AllowedSenders)
+	return
+}
+
+// One address per user; saving a new token retires the old one
+func (a MailInAddress) Save(db *sql.DB) (error) {
+	insForm, err := db.Prepare(`INSERT INTO MailInAddresses
+		(Username, Token, AllowedSenders) VALUES (?, ?, ?)
+		ON DUPLICATE KEY UPDATE
+		Token=VALUES(Token), AllowedSenders=VALUES(AllowedSenders)`)
+	if err != nil { return err }
+	_, err = insForm.Exec(a.Username, a.Token, a.AllowedSenders)
+	return err
+}
+
+func (u UserProfile) DeleteMailInAddress(db *sql.DB) (error) {
+	delForm, err := db.Prepare(`DELETE FROM MailInAddresses WHERE Username=?`)
+	if err != nil { return err }
+	_, err = delForm.Exec(u.Username)
+	return err
+}
+
+func (h Webhook) Add(db *sql.DB) (error) {
+	insForm, err := db.Prepare(`INSERT INTO Webhooks
+		(Username, URL, Secret, Events) VALUES (?, ?, ?, ?)`)
+	if err != nil { return err }
+	_, err = insForm.Exec(h.Username, h.URL, h.Secret, h.Events)
+	return err
+}
+
+func WebhookByID(db *sql.DB, hookID int) (h Webhook, err error) {
+	selForm, err := db.Prepare(`SELECT HookID, Username, URL, Secret, Events,
+		CreatedOn FROM Webhooks WHERE HookID=?`)
+	if err != nil { return }
+	err = selForm.QueryRow(hookID).Scan(
+		&h.HookID,
+		&h.Username,
+		&h.URL,
+		&h.Secret,
+		&h.Events,
+		&h.CreatedOn)
+	return
+}
+
+func (u UserProfile) Webhooks(db *sql.DB) ([]Webhook, error) {
+	selForm, err := db.Prepare(`SELECT HookID, Username, URL, Secret, Events,
+		CreatedOn FROM Webhooks WHERE Username=? ORDER BY CreatedOn`)
+	if err != nil { return nil, err }
+	rows, err := selForm.Query(u.Username)
+	if err != nil { return nil, err }
+	defer rows.Close()
+
+	var hooks []Webhook
+	var h Webhook
+	for rows.Next() {
+		err = rows.Scan(
+			&h.HookID,
+			&h.Username,
+			&h.URL,
+			&h.Secret,
+			&h.Events,
+			&h.CreatedOn)
+		if err != nil { return nil, err }
+		hooks = append(hooks, h)
+	}
+	return hooks, rows.Err()
+}
+
+// Takes its deliveries (and their log) with it
+func (u UserProfile) RemoveWebhook(db *sql.DB, hookID string) (error) {
+	delForm, err := db.Prepare(`DELETE FROM Webhooks
+		WHERE HookID=? AND Username=?`)
+	if err != nil { return err }
+	_, err = delForm.Exec(hookID, u.Username)
+	return err
+}
+
+func (h Webhook) Queue(db *sql.DB, event, payload string) (error) {
+	insForm, err := db.Prepare(`INSERT INTO WebhookDeliveries
+		(HookID, Event, Payload, Status) VALUES (?, ?, ?, ?)`)
+	if err != nil { return err }
+	_, err = insForm.Exec(h.HookID, event, payload, DeliveryPending)
+	return err
+}
+
+const webhookDeliveryColumns = `d.DeliveryID, d.HookID, h.URL, d.Event,
+	d.Payload, d.Status, d.Attempts, COALESCE(d.ResponseCode, 0),
+	d.NextAttempt, COALESCE(d.LastAttempt, ''), d.CreatedOn`
+
+func scanWebhookDeliveries(rows *sql.Rows) ([]WebhookDelivery, error) {
+	defer rows.Close()
+	var deliveries []WebhookDelivery
+	var d WebhookDelivery
+	for rows.Next() {
+		err := rows.Scan(
+			&d.DeliveryID,
+			&d.HookID,
+			&d.HookURL,
+			&d.Event,
+			&d.Payload,
+			&d.Status,
+			&d.Attempts,
+			&d.ResponseCode,
+			&d.NextAttempt,
+			&d.LastAttempt,
+			&d.CreatedOn)
+		if err != nil { return nil, err }
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// Oldest first
+func DueWebhookDeliveries(db *sql.DB, limit int) ([]WebhookDelivery, error) {
+	selForm, err := db.Prepare(`SELECT ` + webhookDeliveryColumns + `
+		FROM WebhookDeliveries d JOIN Webhooks h ON h.HookID=d.HookID
+		WHERE d.Status=? AND d.NextAttempt <= CURRENT_TIMESTAMP
+		ORDER BY d.NextAttempt LIMIT ?`)
+	if err != nil { return nil, err }
+	rows, err := selForm.Query(DeliveryPending, limit)
+	if err != nil { return nil, err }
+	return scanWebhookDeliveries(rows)
+}
+
+// Newest first, across all of the user's webhooks
+func (u UserProfile) WebhookDeliveries(db *sql.DB, limit int) ([]WebhookDelivery, error) {
+	selForm, err := db.Prepare(`SELECT ` + webhookDeliveryColumns + `
+		FROM WebhookDeliveries d JOIN Webhooks h ON h.HookID=d.HookID
+		WHERE h.Username=? ORDER BY d.CreatedOn DESC, d.DeliveryID DESC
+		LIMIT ?`)
+	if err != nil { return nil, err }
+	rows, err := selForm.Query(u.Username, limit)
+	if err != nil { return nil, err }
+	return scanWebhookDeliveries(rows)
+}
+
+func (d WebhookDelivery) Delivered(db *sql.DB, code int) (error) {
+	upForm, err := db.Prepare(`UPDATE WebhookDeliveries
+		SET Status=?, Attempts=Attempts + 1, ResponseCode=?,
+		LastAttempt=CURRENT_TIMESTAMP WHERE DeliveryID=?`)
+	if err != nil { return err }
+	_, err = upForm.Exec(DeliveryDelivered, code, d.DeliveryID)
+	return err
+}
+
+// Schedules the next try, or gives up after MaxAttempts; code is 0 when
+// there was no response at all
+func (d WebhookDelivery) Failed(db *sql.DB, code int) (error) {
+	status := DeliveryPending
+	if d.Attempts + 1 >= Settings.Webhooks.MaxAttempts { status = DeliveryFailed }
+	upForm, err := db.Prepare(`UPDATE WebhookDeliveries
+		SET Status=?, Attempts=Attempts + 1, ResponseCode=NULLIF(?, 0),
+		LastAttempt=CURRENT_TIMESTAMP,
+		NextAttempt=CURRENT_TIMESTAMP + INTERVAL ? SECOND
+		WHERE DeliveryID=?`)
+	if err != nil { return err }
+	_, err = upForm.Exec(status, code, webhookDelay(d.Attempts + 1),
+		d.DeliveryID)
+	return err
+}
+
+// Queues a fresh copy of one of the user's deliveries, keeping the old one
+// in the log
+func (u UserProfile) Redeliver(db *sql.DB, deliveryID string) (error) {
+	insForm, err := db.Prepare(`INSERT INTO WebhookDeliveries
+		(HookID, Event, Payload, Status)
+		SELECT d.HookID, d.Event, d.Payload, ?
+		FROM WebhookDeliveries d JOIN Webhooks h ON h.HookID=d.HookID
+		WHERE d.DeliveryID=? AND h.Username=?`)
+	if err != nil { return err }
+	result, err := insForm.Exec(DeliveryPending, deliveryID, u.Username)
+	if err != nil { return err }
+	if n, _ := result.RowsAffected(); n == 0 { return sql.ErrNoRows }
+	return nil
+}
+
+const shareLive = `(Expires IS NULL OR Expires >= CURRENT_TIMESTAMP)`
+
+// Stores the link and its selection, and reads it back so Expires matches
+// what later lookups will sign
+func (s ShareLink) Add(db *sql.DB, expiryDays int, picked []int) (ShareLink, error) {
+	tx, err := db.Begin()
+	if err != nil { return s, err }
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT INTO ShareLinks (ShareID, Username, Name, Kind,
+		Expires) VALUES (?, ?, ?, ?,
+		IF(? > 0, CURRENT_TIMESTAMP + INTERVAL ? DAY, NULL))`,
+		s.ShareID, s.Username, s.Name, s.Kind, expiryDays, expiryDays)
+	if err != nil { return s, err }
+
+	if s.Kind == ShareSelection {
+		for _, bID := range picked {
+			// Only the owner's own bookmarks make it in
+			_, err = tx.Exec(`INSERT IGNORE INTO ShareLinkBookmarks (ShareID, BId)
+				SELECT ?, BId FROM Bookmarks WHERE BId=? AND Username=?`,
+				s.ShareID, bID, s.Username)
+			if err != nil { return s, err }
+		}
+	}
+
+	if err := tx.Commit(); err != nil { return s, err }
+	return ShareLinkByID(db, s.ShareID)
+}
+
+func ShareLinkByID(db *sql.DB, id string) (s ShareLink, err error) {
+	selForm, err := db.Prepare(`SELECT ShareID, Username, Name, Kind,
+		COALESCE(Expires, ''), CreatedOn,
+		(SELECT COUNT(*) FROM ShareLinkBookmarks b
+			WHERE b.ShareID=ShareLinks.ShareID), ` +
+		shareLive + ` FROM ShareLinks WHERE ShareID=?`)
+	if err != nil { return }
+	err = selForm.QueryRow(id).Scan(
+		&s.ShareID,
+		&s.Username,
+		&s.Name,
+		&s.Kind,
+		&s.Expires,
+		&s.CreatedOn,
+		&s.Count,
+		&s.Live)
+	return
+}
+
+// Newest first
+func (u UserProfile) ShareLinks(db *sql.DB) ([]ShareLink, error) {
+	selForm, err := db.Prepare(`SELECT ShareID, Username, Name, Kind,
+		COALESCE(Expires, ''), CreatedOn,
+		(SELECT COUNT(*) FROM ShareLinkBookmarks b
+			WHERE b.ShareID=ShareLinks.ShareID), ` +
+		shareLive + ` FROM ShareLinks WHERE Username=?
+		ORDER BY CreatedOn DESC`)
+	if err != nil { return nil, err }
+	rows, err := selForm.Query(u.Username)
+	if err != nil { return nil, err }
+	defer rows.Close()
+
+	var shares []ShareLink
+	var s ShareLink
+	for rows.Next() {
+		err = rows.Scan(
+			&s.ShareID,
+			&s.Username,
+			&s.Name,
+			&s.Kind,
+			&s.Expires,
+			&s.CreatedOn,
+			&s.Count,
+			&s.Live)
+		if err != nil { return nil, err }
+		shares = append(shares, s)
+	}
+	return shares, rows.Err()
+}
+
+func (u UserProfile) RevokeShareLink(db *sql.DB, id string) (error) {
+	delForm, err := db.Prepare(`DELETE FROM ShareLinks
+		WHERE ShareID=? AND Username=?`)
+	if err != nil { return err }
+	_, err = delForm.Exec(id, u.Username)
+	return err
+}
+
+// Newest first
+func (s ShareLink) SelectedBookmarks(db *sql.DB) (Bookmarks, error) {
+	var marks []Bookmark
+	q := `SELECT
+		m.BId, m.Username, m.URL, m.Title, m.Unread, m.Archived, m.AddedOn,
+		m.Private, COALESCE(m.Via, '')
+		FROM ShareLinkBookmarks s JOIN Bookmarks m ON m.BId=s.BId
+		WHERE s.ShareID=? AND m.Username=? ORDER BY m.AddedOn DESC`
+	selForm, err := db.Prepare(q)
+	if err != nil { return marks, err }
+	rows, err := selForm.Query(s.ShareID, s.Username)
+	if err != nil { return marks, err }
+	defer rows.Close()
+	var m Bookmark
+	for rows.Next() {
+		err = rows.Scan(
+			&m.BId,
+			&m.Username,
+			&m.URL,
+			&m.Title,
+			&m.Unread,
+			&m.Archived,
+			&m.AddedOn,
+			&m.Private,
+			&m.Via)
+		if err != nil { return nil, err }
+		marks = append(marks, m)
+	}
+	return marks, rows.Err()
+}
+
 func FormatDBDate(d string) (string) {
 	t, _ := time.Parse(Settings.Database.DatetimeFormat, d)
 	return t.Format(Settings.Web.DateFormat)
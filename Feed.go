@@ -0,0 +1,267 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// What a feed says about itself
+type FeedMeta struct {
+	Title string
+	// The HTML page the feed mirrors
+	Link string
+	// Where the feed itself lives
+	Self string
+	Author string
+}
+
+type AtomFeed struct {
+	XMLName xml.Name `xml:"feed"`
+	XMLNS string `xml:"xmlns,attr"`
+	ID string `xml:"id"`
+	Title string `xml:"title"`
+	Updated string `xml:"updated"`
+	Author *AtomPerson `xml:"author,omitempty"`
+	Links []AtomLink `xml:"link"`
+	Entries []AtomEntry `xml:"entry"`
+}
+
+type AtomPerson struct {
+	Name string `xml:"name"`
+}
+
+type AtomLink struct {
+	Rel string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type AtomEntry struct {
+	ID string `xml:"id"`
+	Title string `xml:"title"`
+	Updated string `xml:"updated"`
+	Link AtomLink `xml:"link"`
+}
+
+type RSSFeed struct {
+	XMLName xml.Name `xml:"rss"`
+	Version string `xml:"version,attr"`
+	XMLNSAtom string `xml:"xmlns:atom,attr"`
+	Channel RSSChannel `xml:"channel"`
+}
+
+type RSSChannel struct {
+	Title string `xml:"title"`
+	Link string `xml:"link"`
+	Description string `xml:"description"`
+	Self AtomLink `xml:"atom:link"`
+	LastBuildDate string `xml:"lastBuildDate,omitempty"`
+	Items []RSSItem `xml:"item"`
+}
+
+type RSSItem struct {
+	Title string `xml:"title"`
+	Link string `xml:"link"`
+	GUID RSSGUID `xml:"guid"`
+	PubDate string `xml:"pubDate"`
+}
+
+type RSSGUID struct {
+	IsPermaLink bool `xml:"isPermaLink,attr"`
+	Value string `xml:",chardata"`
+}
+
+// https://www.jsonfeed.org/version/1.1/
+type JSONFeed struct {
+	Version string `json:"version"`
+	Title string `json:"title"`
+	HomePageURL string `json:"home_page_url"`
+	FeedURL string `json:"feed_url"`
+	Authors []JSONFeedAuthor `json:"authors,omitempty"`
+	Items []JSONFeedItem `json:"items"`
+}
+
+type JSONFeedAuthor struct {
+	Name string `json:"name"`
+}
+
+type JSONFeedItem struct {
+	ID string `json:"id"`
+	URL string `json:"url"`
+	Title string `json:"title"`
+	ContentText string `json:"content_text"`
+	DatePublished string `json:"date_published"`
+}
+
+// Entries are identified by the page they're on plus the bookmark ID, so a
+// bookmark turns up as a new item in each feed it's in
+func feedEntryID(meta FeedMeta, b Bookmark) (string) {
+	return meta.Link + "#" + strconv.Itoa(b.BId)
+}
+
+func feedDate(b Bookmark) (string) {
+	t, _ := ParseDBDate(b.AddedOn)
+	return RFC3339Date(t)
+}
+
+func WriteAtom(w http.ResponseWriter, meta FeedMeta, marks Bookmarks) (error) {
+	feed := AtomFeed{
+		XMLNS: "http://www.w3.org/2005/Atom",
+		ID: meta.Link,
+		Title: meta.Title,
+		Updated: RFC3339Date(time.Now()),
+		Links: []AtomLink{
+			{ Rel: "alternate", Type: "text/html", Href: meta.Link },
+			{ Rel: "self", Type: "application/atom+xml", Href: meta.Self } } }
+	if meta.Author != "" { feed.Author = &AtomPerson{ Name: meta.Author } }
+	if len(marks) > 0 { feed.Updated = feedDate(marks[0]) }
+
+	for _, b := range marks {
+		feed.Entries = append(feed.Entries, AtomEntry{
+			ID: feedEntryID(meta, b),
+			Title: b.Title,
+			Updated: feedDate(b),
+			Link: AtomLink{ Rel: "alternate", Href: b.URL } })
+	}
+
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	return xml.NewEncoder(w).Encode(feed)
+}
+
+func WriteRSS(w http.ResponseWriter, meta FeedMeta, marks Bookmarks) (error) {
+	feed := RSSFeed{
+		Version: "2.0",
+		XMLNSAtom: "http://www.w3.org/2005/Atom",
+		Channel: RSSChannel{
+			Title: meta.Title,
+			Link: meta.Link,
+			Description: meta.Title,
+			Self: AtomLink{ Rel: "self", Type: "application/rss+xml",
+				Href: meta.Self } } }
+
+	for i, b := range marks {
+		t, _ := ParseDBDate(b.AddedOn)
+		if i == 0 { feed.Channel.LastBuildDate = t.Format(time.RFC1123Z) }
+		feed.Channel.Items = append(feed.Channel.Items, RSSItem{
+			Title: b.Title,
+			Link: b.URL,
+			GUID: RSSGUID{ Value: feedEntryID(meta, b) },
+			PubDate: t.Format(time.RFC1123Z) })
+	}
+
+	w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	return xml.NewEncoder(w).Encode(feed)
+}
+
+func WriteJSONFeed(w http.ResponseWriter, meta FeedMeta, marks Bookmarks) (error) {
+	feed := JSONFeed{
+		Version: "https://jsonfeed.org/version/1.1",
+		Title: meta.Title,
+		HomePageURL: meta.Link,
+		FeedURL: meta.Self,
+		Items: []JSONFeedItem{} }
+	if meta.Author != "" {
+		feed.Authors = []JSONFeedAuthor{ { Name: meta.Author } } }
+
+	for _, b := range marks {
+		feed.Items = append(feed.Items, JSONFeedItem{
+			ID: feedEntryID(meta, b),
+			URL: b.URL,
+			Title: b.Title,
+			ContentText: b.Title,
+			DatePublished: feedDate(b) })
+	}
+
+	w.Header().Set("Content-Type", "application/feed+json; charset=utf-8")
+	return json.NewEncoder(w).Encode(feed)
+}
+
+// Sets the validators for marks and answers 304 when the client already has
+// them. Last-Modified only moves when something is added, so the ETag (which
+// also notices edits and removals) wins whenever the client sends both
+func FeedNotModified(w http.ResponseWriter, r *http.Request, format string, marks Bookmarks) (bool) {
+	hash := sha256.New()
+	hash.Write([]byte(format))
+	var modified time.Time
+	for _, b := range marks {
+		hash.Write([]byte("\x00" + strconv.Itoa(b.BId) + "\x00" + b.Title +
+			"\x00" + b.URL))
+		if t, err := ParseDBDate(b.AddedOn); err == nil && t.After(modified) {
+			modified = t }
+	}
+	etag := `"` + hex.EncodeToString(hash.Sum(nil))[:32] + `"`
+
+	w.Header().Set("ETag", etag)
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat)) }
+
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		if match != etag && match != "*" { return false }
+	} else {
+		since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+		if err != nil || modified.IsZero() ||
+			modified.Truncate(time.Second).After(since) { return false }
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// A user's bookmarks as a feed at /u/{USER}/{FORMAT}, or their archive at
+// /u/{USER}/archive/{FORMAT}
+func (ux *UserExperience) HandleUserFeedFile(res *ServerRes, uname string, archived bool, format string) {
+	w := res.Writer
+	r := res.Request
+	db := res.DB
+
+	write, ok := map[string]func(http.ResponseWriter, FeedMeta, Bookmarks) error{
+		"feed.atom": WriteAtom,
+		"feed.rss": WriteRSS,
+		"feed.json": WriteJSONFeed }[format]
+	if !ok {
+		HandleWebError(w, r, http.StatusNotFound)
+		return
+	}
+
+	user, err := UserByName(db, uname)
+	if err != nil || !user.Active() || !user.VisibleTo(ux) {
+		HandleWebError(w, r, http.StatusNotFound)
+		if err != nil && err != sql.ErrNoRows { log.Println(err) }
+		return
+	}
+
+	order := &BOrder{ Parameter: SortByAdded, Order: OrderDescending }
+	meta := FeedMeta{
+		Title: user.DisplayName + "'s bookmarks",
+		Link: Settings.Web.Canon + "u/" + uname,
+		Author: user.DisplayName }
+	var marks Bookmarks
+	if archived {
+		meta.Title = user.DisplayName + "'s archive"
+		meta.Link += "/archive"
+		marks, err = user.ArchivedBookmarks(db, order)
+	} else { marks, err = user.UnarchivedBookmarks(db, order) }
+	if err != nil {
+		HandleWebError(w, r, http.StatusServiceUnavailable)
+		log.Println(err)
+		return
+	}
+	meta.Self = meta.Link + "/" + format
+	// Feed readers don't log in, so the feed is the same for everyone
+	marks = marks.Public()
+
+	if user.Visibility != VisibilityPublic {
+		w.Header().Set("X-Robots-Tag", "noindex") }
+	if FeedNotModified(w, r, format, marks) { return }
+	if err := write(w, meta, marks); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// An outside feed a user has subscribed to; new items become unread bookmarks
+type FeedSubscription struct {
+	FeedID int
+	Username string
+	URL string
+	Title string
+	// Items only come in when their title has one of these (comma-separated)
+	Keywords string
+	// Whether new items are saved as private bookmarks
+	Private bool
+	ETag string
+	LastModified string
+	LastChecked string
+	NextCheck string
+	// Failed polls in a row; reset by any successful one
+	Failures int
+	LastError string
+	Added int
+	CreatedOn string
+}
+
+type WebFeedSubscription struct {
+	FeedID int
+	URL string
+	Title string
+	Keywords string
+	Private bool
+	Failures int
+	LastError string
+	Added int
+	LastChecked string
+	LastCheckedRFC3339 string
+	NextCheck string
+	NextCheckRFC3339 string
+}
+
+type UserFeedsPage struct {
+	Canon string
+	Title string
+	User WebUserProfile
+	Feeds []WebFeedSubscription
+	Error bool
+	// After an OPML import
+	Imported int
+	Skipped []OPMLSkip
+	ImportError bool
+	UX *UserExperience
+	Settings *Config }
+
+// One entry from any kind of feed, whittled down to what a bookmark needs
+type FeedItem struct {
+	ID string
+	Title string
+	URL string
+}
+
+type parsedXMLFeed struct {
+	XMLName xml.Name
+	// Atom
+	Title string `xml:"title"`
+	Entries []struct {
+		ID string `xml:"id"`
+		Title string `xml:"title"`
+		Links []AtomLink `xml:"link"`
+	} `xml:"entry"`
+	// RSS 2.0
+	Channel struct {
+		Title string `xml:"title"`
+		Items []parsedRSSItem `xml:"item"`
+	} `xml:"channel"`
+	// RSS 1.0 keeps its items beside the channel
+	Items []parsedRSSItem `xml:"item"`
+}
+
+type parsedRSSItem struct {
+	GUID string `xml:"guid"`
+	Title string `xml:"title"`
+	Link string `xml:"link"`
+}
+
+var ErrFeedFormat = errors.New("not an RSS, Atom or JSON feed")
+
+var FeedClient = http.Client{
+	Timeout: 30 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: publicOnly }).DialContext } }
+
+var privateNets = []string{ "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16",
+	"100.64.0.0/10", "fc00::/7" }
+
+// Keeps users from pointing the poller at anything on our own network
+func publicOnly(network, address string, c syscall.RawConn) (error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil { return err }
+	refused := fmt.Errorf("refusing to fetch from %s", host)
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
+		return refused
+	}
+	for _, cidr := range privateNets {
+		_, block, _ := net.ParseCIDR(cidr)
+		if block.Contains(ip) { return refused }
+	}
+	return nil
+}
+
+func (f *FeedSubscription) AsWebEntity() (wf WebFeedSubscription) {
+	wf.FeedID = f.FeedID
+	wf.URL = f.URL
+	wf.Title = f.Title
+	if wf.Title == "" { wf.Title = f.URL }
+	wf.Keywords = f.Keywords
+	wf.Private = f.Private
+	wf.Failures = f.Failures
+	wf.LastError = f.LastError
+	wf.Added = f.Added
+	if f.LastChecked != "" {
+		checked, _ := ParseDBDate(f.LastChecked)
+		wf.LastChecked = WebDate(checked)
+		wf.LastCheckedRFC3339 = RFC3339Date(checked)
+	}
+	next, _ := ParseDBDate(f.NextCheck)
+	wf.NextCheck = WebDate(next)
+	wf.NextCheckRFC3339 = RFC3339Date(next)
+	return
+}
+
+// Whether an item's title gets past the feed's keyword filter
+func (f FeedSubscription) Wants(item FeedItem) (bool) {
+	if strings.TrimSpace(f.Keywords) == "" { return true }
+	title := strings.ToLower(item.Title)
+	for _, k := range strings.Split(f.Keywords, ",") {
+		k = strings.ToLower(strings.TrimSpace(k))
+		if k != "" && strings.Contains(title, k) { return true }
+	}
+	return false
+}
+
+// Minutes until the next poll: the usual interval, doubled for each failure
+// in a row, up to MaxBackoffHours
+func feedDelay(failures int) (int) {
+	c := Settings.Feeds
+	max := c.MaxBackoffHours * 60
+	delay := c.PollMinutes
+	for i := 0; i < failures && delay < max; i++ { delay *= 2 }
+	if failures > 0 && delay > max { delay = max }
+	return delay
+}
+
+// Latin-1 is common enough in old feeds to be worth reading; anything else
+// that isn't UTF-8 counts as a failure
+func feedCharsetReader(charset string, input io.Reader) (io.Reader, error) {
+	switch(strings.ToLower(charset)) {
+	case "utf-8", "us-ascii":
+		return input, nil
+	case "iso-8859-1", "latin1", "windows-1252":
+		raw, err := ioutil.ReadAll(input)
+		if err != nil { return nil, err }
+		runes := make([]rune, len(raw))
+		for i, b := range raw { runes[i] = rune(b) }
+		return strings.NewReader(string(runes)), nil
+	}
+	return nil, fmt.Errorf("unsupported charset %q", charset)
+}
+
+func ParseFeed(body []byte) (title string, items []FeedItem, err error) {
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '{' {
+		var feed struct {
+			Title string `json:"title"`
+			Items []struct {
+				ID json.RawMessage `json:"id"`
+				URL string `json:"url"`
+				Title string `json:"title"`
+			} `json:"items"`
+		}
+		if err = json.Unmarshal(trimmed, &feed); err != nil { return }
+		for _, i := range feed.Items {
+			id := strings.Trim(string(i.ID), `"`)
+			if id == "" { id = i.URL }
+			items = append(items, FeedItem{ ID: id, Title: i.Title, URL: i.URL })
+		}
+		return feed.Title, items, nil
+	}
+
+	var feed parsedXMLFeed
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	decoder.CharsetReader = feedCharsetReader
+	decoder.Strict = false
+	if err = decoder.Decode(&feed); err != nil { return }
+
+	switch(feed.XMLName.Local) {
+	case "feed":
+		for _, e := range feed.Entries {
+			var link string
+			for _, l := range e.Links {
+				if l.Rel == "" || l.Rel == "alternate" { link = l.Href; break }
+			}
+			id := e.ID
+			if id == "" { id = link }
+			items = append(items, FeedItem{ ID: id, Title: e.Title, URL: link })
+		}
+		return feed.Title, items, nil
+	case "rss", "RDF":
+		rss := append(feed.Channel.Items, feed.Items...)
+		for _, i := range rss {
+			id := i.GUID
+			if id == "" { id = i.Link }
+			items = append(items, FeedItem{
+				ID: id,
+				Title: i.Title,
+				URL: strings.TrimSpace(i.Link) })
+		}
+		return feed.Channel.Title, items, nil
+	}
+	return "", nil, ErrFeedFormat
+}
+
+// Fetches the feed (conditionally) and saves whatever's new; returns how
+// many bookmarks it added
+func (f FeedSubscription) Poll(db *sql.DB) (int, error) {
+	req, err := http.NewRequest("GET", f.URL, nil)
+	if err != nil { return 0, err }
+	req.Header.Set("User-Agent", "BookmarkWarrior feed poller (+" +
+		Settings.Web.Canon + ")")
+	if f.ETag != "" { req.Header.Set("If-None-Match", f.ETag) }
+	if f.LastModified != "" {
+		req.Header.Set("If-Modified-Since", f.LastModified) }
+
+	resp, err := FeedClient.Do(req)
+	if err != nil { return 0, err }
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return 0, f.Checked(db, f.Title, f.ETag, f.LastModified, 0,
+			feedDelay(0)) }
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("feed answered %s", resp.Status) }
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body,
+		int64(Settings.Feeds.MaxKiB) * 1024))
+	if err != nil { return 0, err }
+	title, items, err := ParseFeed(body)
+	if err != nil { return 0, err }
+	if title == "" { title = f.Title }
+
+	u := UserProfile{ Username: f.Username }
+	room, err := u.CanAddBookmark(db)
+	if err != nil { return 0, err }
+	added := 0
+	for _, item := range items {
+		if item.ID == "" || IsURL(item.URL) != nil { continue }
+		// Out of room: this and everything after it stay unseen, for
+		// whenever there's room again
+		if !room { break }
+		// Seen either way, so a first poll of a long feed doesn't come back
+		// for what was over MaxNewItems
+		isNew, err := f.MarkSeen(db, item.ID)
+		if err != nil { return added, err }
+		if !isNew || !f.Wants(item) || added >= Settings.Feeds.MaxNewItems {
+			continue }
+
+		have, err := u.HasURL(db, item.URL)
+		if err != nil { return added, err }
+		if have { continue }
+
+		b := Bookmark{
+			Username: f.Username,
+			Title: strings.TrimSpace(item.Title),
+			URL: item.URL,
+			Private: f.Private }
+		if b.Title == "" { b.Title = item.URL }
+		b.BId, err = b.AddWithID(db)
+		if err != nil { return added, err }
+		b.Unread = true
+		QueueWebhooks(db, f.Username, WebhookAdded, b)
+		added++
+
+		room, err = u.CanAddBookmark(db)
+		if err != nil { return added, err }
+	}
+
+	etag, lastModified := resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	if !room {
+		// Or the next poll would get a 304 and never see what we left
+		etag, lastModified = f.ETag, f.LastModified
+	}
+	err = f.Checked(db, title, etag, lastModified, added, feedDelay(0))
+	return added, err
+}
+
+// Poll, except a feed that trips us up only counts as that feed failing
+// rather than taking the whole server down with it
+func (f FeedSubscription) SafePoll(db *sql.DB) (added int, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("Polling feed %d (%s) panicked: %v", f.FeedID, f.URL, p)
+			err = fmt.Errorf("could not read the feed")
+		}
+	}()
+	return f.Poll(db)
+}
+
+// Polls every feed that's due, then waits a minute and does it again
+func PollFeedsForever() {
+	for {
+		time.Sleep(time.Minute)
+
+		db, err := DBConnect(&Settings)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		feeds, err := DueFeeds(db, Settings.Feeds.BatchSize)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		for _, f := range feeds {
+			if _, err := f.SafePoll(db); err != nil {
+				err = f.Failed(db, err.Error(), feedDelay(f.Failures + 1))
+				if err != nil { log.Println(err) }
+			}
+		}
+	}
+}
+
+// Feed subscriptions at /u/{USER}/settings/feeds
+func (ux *UserExperience) HandleUserFeeds(res *ServerRes, user UserProfile) {
+	w := res.Writer
+	r := res.Request
+	db := res.DB
+	uname := user.Username
+	page := "tmpl/user-feeds.html"
+
+	procErr, importErr := false, false
+	var imported int
+	var skipped []OPMLSkip
+	if r.Method == "POST" {
+		if err := r.ParseForm(); err != nil { panic(err) }
+
+		var err error
+		switch(r.FormValue("action")) {
+		case "import":
+			file, _, ferr := r.FormFile("opml")
+			if ferr != nil {
+				importErr = true
+				break
+			}
+			defer file.Close()
+			imported, skipped, err = user.ImportOPML(db, file)
+			if err == ErrBadOPML { importErr, err = true, nil }
+		case "add":
+			f := FeedSubscription{
+				Username: uname,
+				URL: strings.TrimSpace(r.FormValue("url")),
+				Keywords: strings.TrimSpace(r.FormValue("keywords")),
+				Private: r.FormValue("private") == "on" }
+			if IsURL(f.URL) != nil {
+				procErr = true
+				break
+			}
+			err = f.Add(db)
+		case "remove":
+			err = user.RemoveFeed(db, r.FormValue("feed"))
+		case "check":
+			err = user.CheckFeedNow(db, r.FormValue("feed"))
+		default:
+			HandleWebError(w, r, http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			HandleWebError(w, r, http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		if !procErr && !importErr && r.FormValue("action") != "import" {
+			http.Redirect(w, r, Settings.Web.Canon + "u/" + uname +
+				"/settings/feeds", http.StatusSeeOther)
+			return
+		}
+	}
+
+	feeds, err := user.FeedSubscriptions(db)
+	if err != nil {
+		HandleWebError(w, r, http.StatusServiceUnavailable)
+		log.Println(err)
+		return
+	}
+	var webfeeds []WebFeedSubscription
+	for _, f := range feeds {
+		webfeeds = append(webfeeds, f.AsWebEntity())
+	}
+
+	webuser := user.AsWebEntity()
+	webuser.ThisIsMe = true
+
+	err = Templates[page].Execute(w, UserFeedsPage{
+		Canon: Settings.Web.Canon + "u/" + uname,
+		User: webuser,
+		Feeds: webfeeds,
+		Error: procErr,
+		Imported: imported,
+		Skipped: skipped,
+		ImportError: importErr,
+		Title: user.DisplayName + " (" + uname + ") - Feeds",
+		UX: ux,
+		Settings: &Settings })
+	if err != nil {
+		HandleWebError(w, r, http.StatusInternalServerError)
+		log.Println(err)
+	}
+}
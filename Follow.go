@@ -0,0 +1,157 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+type UserFeedPage struct {
+	Canon string
+	Title string
+	User WebUserProfile
+	Bookmarks []WebBookmark
+	// Title of whatever was just saved from the feed
+	Saved string
+	Duplicate bool
+	OverQuota bool
+	UX *UserExperience
+	Settings *Config }
+
+// How far back the feed goes
+const FeedLength = 100
+
+// Follows or unfollows uname, from the button on their page
+func (ux *UserExperience) HandleUserFollow(res *ServerRes, uname string, follow bool) {
+	w := res.Writer
+	r := res.Request
+	db := res.DB
+
+	if r.Method != "POST" {
+		HandleWebError(w, r, http.StatusMethodNotAllowed)
+		return
+	}
+	if !ux.LoggedIn {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if !ux.Can(ScopeFull) || ux.Username == uname {
+		HandleWebError(w, r, http.StatusForbidden)
+		return
+	}
+
+	user, err := UserByName(db, uname)
+	if err != nil || !user.Active() || !user.VisibleTo(ux) {
+		HandleWebError(w, r, http.StatusNotFound)
+		return
+	}
+
+	me := UserProfile{ Username: ux.Username }
+	if follow {
+		err = me.Follow(db, uname)
+	} else { err = me.Unfollow(db, uname) }
+	if err != nil {
+		HandleWebError(w, r, http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	http.Redirect(w, r, Settings.Web.Canon + "u/" + uname,
+		http.StatusSeeOther)
+}
+
+// Public bookmarks from everyone the user follows, at /u/{USER}/feed
+func (ux *UserExperience) HandleUserFeed(res *ServerRes, uname string) {
+	w := res.Writer
+	r := res.Request
+	db := res.DB
+	page := "tmpl/user-feed.html"
+
+	if !ux.LoggedIn {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if !ux.IsOwner(uname) {
+		HandleWebError(w, r, http.StatusForbidden)
+		return
+	}
+	user, err := UserByName(db, uname)
+	if err != nil {
+		HandleWebError(w, r, http.StatusNotFound)
+		return
+	}
+
+	var saved string
+	duplicate, overQuota := false, false
+	if r.Method == "POST" {
+		if !ux.Can(ScopeFull) {
+			HandleWebError(w, r, http.StatusForbidden)
+			return
+		}
+		if err := r.ParseForm(); err != nil { panic(err) }
+
+		bID, err := strconv.Atoi(r.FormValue("bid"))
+		if err != nil {
+			HandleWebError(w, r, http.StatusBadRequest)
+			return
+		}
+		b, err := user.FeedBookmark(db, bID)
+		if err == sql.ErrNoRows {
+			HandleWebError(w, r, http.StatusNotFound)
+			return
+		}
+		var have, room bool
+		if err == nil { have, err = user.HasURL(db, b.URL) }
+		if err == nil && !have { room, err = user.CanAddBookmark(db) }
+		if err != nil {
+			HandleWebError(w, r, http.StatusServiceUnavailable)
+			log.Println(err)
+			return
+		}
+
+		switch {
+		case have: duplicate = true
+		case !room: overQuota = true
+		default:
+			copied := Bookmark{
+				Username: uname,
+				Title: b.Title,
+				URL: b.URL,
+				Via: b.Username }
+			copied.BId, err = copied.AddWithID(db)
+			if err != nil {
+				HandleWebError(w, r, http.StatusInternalServerError)
+				log.Println(err)
+				return
+			}
+			copied.Unread = true
+			QueueWebhooks(db, uname, WebhookAdded, copied)
+			saved = b.Title
+		}
+	}
+
+	marks, err := user.FollowingFeed(db, FeedLength)
+	if err != nil {
+		HandleWebError(w, r, http.StatusServiceUnavailable)
+		log.Println(err)
+		return
+	}
+
+	webuser := user.AsWebEntity()
+	webuser.ThisIsMe = true
+
+	err = Templates[page].Execute(w, UserFeedPage{
+		Canon: Settings.Web.Canon + "u/" + uname,
+		User: webuser,
+		Bookmarks: marks.AsWebEntities(),
+		Saved: saved,
+		Duplicate: duplicate,
+		OverQuota: overQuota,
+		Title: user.DisplayName + " (" + uname + ") - Feed",
+		UX: ux,
+		Settings: &Settings })
+	if err != nil {
+		HandleWebError(w, r, http.StatusInternalServerError)
+		log.Println(err)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+)
+
+type Invite struct {
+	Code string
+	CreatedBy string
+	CreatedOn string
+	Expires string
+	UsedBy string
+	UsedOn string
+	// Unused and not expired, as of the query
+	Usable bool
+}
+
+type WebInvite struct {
+	Code string
+	Link string
+	UsedBy string
+	Usable bool
+	Expires string
+	ExpiresRFC3339 string
+	CreatedOn string
+	CreatedOnRFC3339 string
+}
+
+type UserInvitesPage struct {
+	Canon string
+	Title string
+	User WebUserProfile
+	Invites []WebInvite
+	// How many more the user may make; -1 for no limit
+	Left int
+	Error bool
+	UX *UserExperience
+	Settings *Config }
+
+type AdminSignupsPage struct {
+	Pending []WebUserProfile
+	UX *UserExperience
+	Settings *Config }
+
+type SignupPendingPage struct {
+	Username string
+	UX *UserExperience
+	Settings *Config }
+
+const (
+	ActivationPaid = "paid"
+	ActivationInvite = "invite"
+	ActivationApproval = "approval"
+)
+
+const InviteCodeLength = 16
+
+var ErrInviteUsed = errors.New("invite is used up or expired")
+
+func NewInviteCode() (string) { return RandomCode(InviteCodeLength) }
+
+func InviteLink(code string) (string) {
+	return Settings.Web.Canon + "signup/new?invite=" + code
+}
+
+func (i *Invite) AsWebEntity() (wi WebInvite) {
+	created, _ := ParseDBDate(i.CreatedOn)
+
+	wi.Code = i.Code
+	wi.Link = InviteLink(i.Code)
+	wi.UsedBy = i.UsedBy
+	wi.Usable = i.Usable
+	if i.Expires != "" {
+		expires, _ := ParseDBDate(i.Expires)
+		wi.Expires = WebDate(expires)
+		wi.ExpiresRFC3339 = RFC3339Date(expires)
+	}
+	wi.CreatedOn = WebDate(created)
+	wi.CreatedOnRFC3339 = RFC3339Date(created)
+	return
+}
+
+// How many more invites the user may make; -1 for no limit
+func (u UserProfile) InvitesLeft(db *sql.DB) (int, error) {
+	if IsAdmin(u.Username) { return -1, nil }
+	n, err := u.InviteCount(db)
+	if err != nil { return 0, err }
+	if left := Settings.Activation.InvitesPerUser - n; left > 0 {
+		return left, nil }
+	return 0, nil
+}
+
+// Invite links at /u/{USER}/settings/invites
+func (ux *UserExperience) HandleUserInvites(res *ServerRes, user UserProfile) {
+	w := res.Writer
+	r := res.Request
+	db := res.DB
+	uname := user.Username
+	page := "tmpl/user-invites.html"
+
+	if Settings.Activation.Mode != ActivationInvite {
+		HandleWebError(w, r, http.StatusNotFound)
+		return
+	}
+
+	left, err := user.InvitesLeft(db)
+	if err != nil {
+		HandleWebError(w, r, http.StatusServiceUnavailable)
+		log.Println(err)
+		return
+	}
+
+	procErr := false
+	if r.Method == "POST" {
+		if left == 0 {
+			procErr = true
+		} else {
+			i := Invite{ Code: NewInviteCode(), CreatedBy: uname }
+			err := i.Add(db, Settings.Activation.InviteExpiryDays)
+			if err != nil {
+				HandleWebError(w, r, http.StatusInternalServerError)
+				log.Println(err)
+				return
+			}
+			log.Printf("User @%s made an invite", uname)
+			http.Redirect(w, r, Settings.Web.Canon + "u/" + uname +
+				"/settings/invites", http.StatusSeeOther)
+			return
+		}
+	}
+
+	invites, err := user.Invites(db)
+	if err != nil {
+		HandleWebError(w, r, http.StatusServiceUnavailable)
+		log.Println(err)
+		return
+	}
+	var webinvites []WebInvite
+	for _, i := range invites {
+		webinvites = append(webinvites, i.AsWebEntity())
+	}
+
+	webuser := user.AsWebEntity()
+	webuser.ThisIsMe = true
+
+	err = Templates[page].Execute(w, UserInvitesPage{
+		Canon: Settings.Web.Canon + "u/" + uname,
+		User: webuser,
+		Invites: webinvites,
+		Left: left,
+		Error: procErr,
+		Title: user.DisplayName + " (" + uname + ") - Invites",
+		UX: ux,
+		Settings: &Settings })
+	if err != nil {
+		HandleWebError(w, r, http.StatusInternalServerError)
+		log.Println(err)
+	}
+}
+
+// Signups waiting for approval, at /admin/signups
+func (ux *UserExperience) HandleAdminSignups(res *ServerRes) {
+	w := res.Writer
+	r := res.Request
+	db := res.DB
+	page := "tmpl/admin-signups.html"
+
+	if r.Method == "POST" {
+		if err := r.ParseForm(); err != nil { panic(err) }
+		uname := r.FormValue("username")
+
+		var err error
+		switch(r.FormValue("action")) {
+		case "approve":
+			err = ApproveUser(db, uname)
+		case "reject":
+			err = RejectUser(db, uname)
+		default:
+			HandleWebError(w, r, http.StatusBadRequest)
+			return
+		}
+		if err != nil && err != sql.ErrNoRows {
+			HandleWebError(w, r, http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		if err == nil {
+			log.Printf("Admin @%s %sd the signup for @%s",
+				ux.Username, r.FormValue("action"), uname)
+		}
+		http.Redirect(w, r, Settings.Web.Canon + "admin/signups",
+			http.StatusSeeOther)
+		return
+	}
+
+	users, err := PendingApprovals(db)
+	if err != nil {
+		HandleWebError(w, r, http.StatusServiceUnavailable)
+		log.Println(err)
+		return
+	}
+	var pending []WebUserProfile
+	for _, u := range users {
+		pending = append(pending, u.AsWebEntity())
+	}
+
+	err = Templates[page].Execute(w, AdminSignupsPage{
+		Pending: pending,
+		UX: ux,
+		Settings: &Settings })
+	if err != nil {
+		HandleWebError(w, r, http.StatusInternalServerError)
+		log.Println(err)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Failed password attempts are counted per username and per address; after
+// a few free tries each further attempt has to wait exponentially longer and
+// enough failures lock the key out entirely for a while
+type LoginLimiter struct {
+	mu sync.Mutex
+	attempts map[string]*loginAttempts
+}
+
+type loginAttempts struct {
+	Failures int
+	LastFailure time.Time
+	LockedUntil time.Time
+}
+
+var Limiter = &LoginLimiter{ attempts: map[string]*loginAttempts{} }
+
+var ErrThrottled = errors.New("Too many login attempts")
+
+// LetMeIn, but counting failures against the username and the client's
+// address
+func LetMeInFrom(db *sql.DB, r *http.Request, uname, pass string) (UserProfile, error) {
+	keys := LoginKeys(uname, r)
+	if Limiter.Wait(keys...) > 0 { return UserProfile{}, ErrThrottled }
+
+	u, err := LetMeIn(db, uname, pass)
+	if err == ErrPendingApproval || err == ErrInactive {
+		// Right password, the account just can't sign in; not a guess
+		return u, err
+	} else if err != nil {
+		Limiter.Failed(keys...)
+		return u, err
+	}
+	Limiter.Succeeded(keys[0])
+	return u, nil
+}
+
+// Same again for the second factor
+func (u UserProfile) VerifySecondFactorFrom(db *sql.DB, r *http.Request, code string) (error) {
+	keys := LoginKeys(u.Username, r)
+	if Limiter.Wait(keys...) > 0 { return ErrThrottled }
+
+	err := u.VerifySecondFactor(db, code)
+	if err != nil {
+		Limiter.Failed(keys...)
+		return err
+	}
+	Limiter.Succeeded(keys[0])
+	return nil
+}
+
+func LoginKeys(uname string, r *http.Request) ([]string) {
+	return []string{ "user:" + uname, "ip:" + RealIP(r) }
+}
+
+// Reset links are rationed per address and per client, apart from sign-in
+// attempts so asking for one doesn't slow down logging in
+func ResetKeys(email string, r *http.Request) ([]string) {
+	return []string{ "reset:" + strings.ToLower(email),
+		"reset-ip:" + RealIP(r) }
+}
+
+// How long until any of these keys may try again (zero means go ahead)
+func (l *LoginLimiter) Wait(keys ...string) (time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	var wait time.Duration
+	for _, k := range keys {
+		a, ok := l.attempts[k]
+		if !ok { continue }
+
+		if d := a.LockedUntil.Sub(now); d > wait { wait = d }
+		if d := a.LastFailure.Add(backoff(a.Failures)).Sub(now); d > wait {
+			wait = d }
+	}
+	return wait
+}
+
+func (l *LoginLimiter) Failed(keys ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	c := Settings.Login
+	now := time.Now()
+	for _, k := range keys {
+		a, ok := l.attempts[k]
+		if !ok {
+			a = &loginAttempts{}
+			l.attempts[k] = a
+		}
+		a.Failures++
+		a.LastFailure = now
+
+		if a.Failures == c.WarnAfter {
+			log.Printf("Suspicious: %d failed logins for %s", a.Failures, k)
+		}
+		if c.LockoutAfter > 0 && a.Failures % c.LockoutAfter == 0 {
+			a.LockedUntil = now.Add(
+				time.Duration(c.LockoutMinutes) * time.Minute)
+			log.Printf("Locking out %s for %d minutes after %d failures",
+				k, c.LockoutMinutes, a.Failures)
+		}
+	}
+}
+
+func (l *LoginLimiter) Succeeded(keys ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, k := range keys { delete(l.attempts, k) }
+}
+
+// Forget keys which have been quiet long enough to start from scratch
+func (l *LoginLimiter) Prune() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	forget := time.Duration(Settings.Login.ForgetMinutes) * time.Minute
+	now := time.Now()
+	for k, a := range l.attempts {
+		if now.After(a.LockedUntil) && now.Sub(a.LastFailure) > forget {
+			delete(l.attempts, k)
+		}
+	}
+}
+
+func (l *LoginLimiter) PruneForever() {
+	for {
+		time.Sleep(time.Minute)
+		l.Prune()
+	}
+}
+
+func backoff(failures int) (time.Duration) {
+	c := Settings.Login
+	over := failures - c.FreeAttempts
+	if over <= 0 { return 0 }
+
+	base := time.Duration(c.BaseDelaySeconds) * time.Second
+	max := time.Duration(c.MaxDelaySeconds) * time.Second
+	delay := base
+	for i := 1; i < over && delay < max; i++ { delay *= 2 }
+	if delay > max { delay = max }
+	return delay
+}
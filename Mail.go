@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// Talks to a relay over SMTP (with STARTTLS when the server offers it)
+type SMTPMailer struct {
+	Host string
+	Port int
+	Username string
+	Password string
+	From string
+}
+
+// Pipes the message into sendmail(8) or anything compatible
+type SendmailMailer struct {
+	Path string
+	From string
+}
+
+// For development; messages are appended to a file (or the log if no file
+// is given) instead of being delivered
+type FileMailer struct {
+	Path string
+	From string
+}
+
+var Mail Mailer
+
+// What a mailed token is allowed to do
+const (
+	MailTokenReset = "reset"
+	MailTokenVerify = "verify"
+)
+
+func NewMailer(c MailSettings) (Mailer, error) {
+	switch(c.Transport) {
+	case "smtp":
+		return &SMTPMailer{
+			Host: c.SMTPHost,
+			Port: c.SMTPPort,
+			Username: c.SMTPUsername,
+			Password: c.SMTPPassword,
+			From: c.From }, nil
+	case "sendmail":
+		path := c.SendmailPath
+		if path == "" { path = "/usr/sbin/sendmail" }
+		return &SendmailMailer{ Path: path, From: c.From }, nil
+	case "file", "":
+		return &FileMailer{ Path: c.FilePath, From: c.From }, nil
+	}
+	return nil, errors.New("Unknown mail transport: " + c.Transport)
+}
+
+// A confirmed address can only find one account
+var ErrEmailTaken = errors.New("e-mail address belongs to another account")
+
+func ValidEmail(addr string) (bool) {
+	a, err := mail.ParseAddress(addr)
+	return err == nil && a.Address == addr
+}
+
+func FormatMessage(from, to, subject, body string) ([]byte) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", to)
+	fmt.Fprintf(&b, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	return b.Bytes()
+}
+
+func (m *SMTPMailer) Send(to, subject, body string) (error) {
+	addr := m.Host + ":" + strconv.Itoa(m.Port)
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+	return smtp.SendMail(addr, auth, m.From, []string{to},
+		FormatMessage(m.From, to, subject, body))
+}
+
+func (m *SendmailMailer) Send(to, subject, body string) (error) {
+	cmd := exec.Command(m.Path, "-i", "-f", m.From, "--", to)
+	cmd.Stdin = bytes.NewReader(FormatMessage(m.From, to, subject, body))
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("sendmail: %s: %s", err, out)
+	}
+	return nil
+}
+
+func (m *FileMailer) Send(to, subject, body string) (error) {
+	msg := FormatMessage(m.From, to, subject, body)
+	if m.Path == "" {
+		log.Printf("Mail to %s:\n%s\n", to, msg)
+		return nil
+	}
+
+	f, err := os.OpenFile(m.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil { return err }
+	defer f.Close()
+	_, err = f.Write(append(msg, []byte("\r\n\r\n")...))
+	return err
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"html"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"strings"
+)
+
+// A user's secret address for saving bookmarks by e-mail
+type MailInAddress struct {
+	Username string
+	Token string
+	// Senders allowed to use it, comma-separated; with none, only the
+	// account's verified e-mail address may
+	AllowedSenders string
+}
+
+type UserMailInPage struct {
+	Canon string
+	Title string
+	User WebUserProfile
+	Address string
+	AllowedSenders []string
+	// Who's allowed when AllowedSenders is empty
+	Fallback string
+	Error bool
+	UX *UserExperience
+	Settings *Config }
+
+const MailInTokenLength = 20
+
+var (
+	ErrNoSuchMailbox = errors.New("no such save-by-email address")
+	ErrSenderNotAllowed = errors.New("sender is not on the allowlist")
+	ErrBadMessage = errors.New("not a readable e-mail message")
+)
+
+var (
+	textURL = regexp.MustCompile(`https?://[^\s<>"'()\[\]{}]+`)
+	htmlHref = regexp.MustCompile(`(?i)href\s*=\s*["']([^"']+)["']`)
+)
+
+func NewMailInToken() (string) {
+	return strings.ToLower(RandomCode(MailInTokenLength))
+}
+
+func (a MailInAddress) Address() (string) {
+	return Settings.MailIn.LocalPart + "+" + a.Token + "@" +
+		Settings.MailIn.Domain
+}
+
+// The token in one of our save-by-email addresses
+func MailInTokenFrom(rcpt string) (string, bool) {
+	addr, err := mail.ParseAddress(rcpt)
+	if err != nil { return "", false }
+	at := strings.LastIndex(addr.Address, "@")
+	if at < 0 ||
+		!strings.EqualFold(addr.Address[at + 1:], Settings.MailIn.Domain) {
+		return "", false
+	}
+	prefix := strings.ToLower(Settings.MailIn.LocalPart + "+")
+	local := strings.ToLower(addr.Address[:at])
+	if !strings.HasPrefix(local, prefix) { return "", false }
+	return local[len(prefix):], true
+}
+
+// Senders are addresses separated by commas or whitespace; returns the
+// normalized list or false if any entry is junk
+func ParseSenderList(list string) (string, bool) {
+	var ok []string
+	for _, f := range strings.FieldsFunc(list, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\n' || r == '\r' || r == '\t'
+	}) {
+		addr, err := mail.ParseAddress(f)
+		if err != nil { return "", false }
+		ok = append(ok, strings.ToLower(addr.Address))
+	}
+	return strings.Join(ok, ","), true
+}
+
+func (a MailInAddress) Allows(owner UserProfile, from string) (bool) {
+	from = strings.ToLower(from)
+	if a.AllowedSenders == "" {
+		return owner.EmailVerified && strings.EqualFold(owner.Email, from) }
+	for _, s := range strings.Split(a.AllowedSenders, ",") {
+		if s == from { return true }
+	}
+	return false
+}
+
+func decodePart(body io.Reader, encoding string) (io.Reader) {
+	switch(strings.ToLower(strings.TrimSpace(encoding))) {
+	case "quoted-printable":
+		return quotedprintable.NewReader(body)
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, body)
+	}
+	return body
+}
+
+// URLs from the plain-text and HTML parts of a message, in order and
+// without repeats
+func messageURLs(header mail.Header, body io.Reader, urls []string) ([]string, error) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil { mediaType = "text/plain" }
+	body = decodePart(body, header.Get("Content-Transfer-Encoding"))
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		parts := multipart.NewReader(body, params["boundary"])
+		for {
+			p, err := parts.NextPart()
+			if err == io.EOF { return urls, nil }
+			if err != nil { return urls, err }
+			urls, err = messageURLs(mail.Header(p.Header), p, urls)
+			if err != nil { return urls, err }
+		}
+	}
+
+	content, err := ioutil.ReadAll(io.LimitReader(body,
+		int64(Settings.MailIn.MaxKiB) * 1024))
+	if err != nil { return urls, err }
+	var found []string
+	switch(mediaType) {
+	case "text/plain":
+		found = textURL.FindAllString(string(content), -1)
+	case "text/html":
+		for _, m := range htmlHref.FindAllStringSubmatch(string(content), -1) {
+			found = append(found, html.UnescapeString(m[1]))
+		}
+	}
+	for _, u := range found {
+		u = strings.TrimRight(u, ".,;:!?")
+		if IsURL(u) != nil || strings.Contains(strings.ToLower(u),
+			"unsubscribe") { continue }
+		seen := false
+		for _, s := range urls { seen = seen || s == u }
+		if !seen { urls = append(urls, u) }
+	}
+	return urls, nil
+}
+
+// Saves the links in a piped-in message to the account its recipient belongs
+// to; rcpt and sender are the envelope's, and may be empty to go by the
+// message's own headers
+func SaveMail(db *sql.DB, r io.Reader, rcpt, sender string) (int, error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil { return 0, ErrBadMessage }
+
+	candidates := []string{ rcpt }
+	for _, h := range []string{ "Delivered-To", "X-Original-To", "To", "Cc" } {
+		addrs, _ := msg.Header.AddressList(h)
+		for _, a := range addrs { candidates = append(candidates, a.Address) }
+	}
+	var a MailInAddress
+	err = ErrNoSuchMailbox
+	for _, c := range candidates {
+		if token, ok := MailInTokenFrom(c); ok {
+			if a, err = MailInAddressByToken(db, token); err == nil { break }
+		}
+	}
+	if err == sql.ErrNoRows { err = ErrNoSuchMailbox }
+	if err != nil { return 0, err }
+
+	owner, err := UserByName(db, a.Username)
+	if err != nil { return 0, err }
+	from, err := mail.ParseAddress(msg.Header.Get("From"))
+	if err != nil || !owner.Active() || !a.Allows(owner, from.Address) {
+		return 0, ErrSenderNotAllowed }
+	// From: is whatever the sender typed; the envelope at least has to get
+	// past the MTA, so when we know it, it has to be allowed too
+	if sender == "" { sender = msg.Header.Get("Return-Path") }
+	if sender != "" {
+		envelope, err := mail.ParseAddress(sender)
+		if err != nil || !a.Allows(owner, envelope.Address) {
+			return 0, ErrSenderNotAllowed }
+	}
+
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil { subject = msg.Header.Get("Subject") }
+	subject = strings.TrimSpace(subject)
+
+	urls, err := messageURLs(msg.Header, msg.Body, nil)
+	if err != nil { return 0, err }
+	if len(urls) > Settings.MailIn.MaxLinks {
+		urls = urls[:Settings.MailIn.MaxLinks] }
+
+	added := 0
+	for _, u := range urls {
+		have, err := owner.HasURL(db, u)
+		if err != nil { return added, err }
+		if have { continue }
+		room, err := owner.CanAddBookmark(db)
+		if err != nil { return added, err }
+		if !room { break }
+
+		// Nothing gets fetched on the sender's say-so; the subject will do
+		b := Bookmark{ Username: owner.Username, URL: u, Title: subject }
+		if b.Title == "" { b.Title = u }
+		b.BId, err = b.AddWithID(db)
+		if err != nil { return added, err }
+		b.Unread = true
+		QueueWebhooks(db, owner.Username, WebhookAdded, b)
+		added++
+	}
+	log.Printf("Saved %d bookmarks by e-mail for @%s", added, owner.Username)
+	return added, nil
+}
+
+// The save-by-email address at /u/{USER}/settings/save-by-email
+func (ux *UserExperience) HandleUserMailIn(res *ServerRes, user UserProfile) {
+	w := res.Writer
+	r := res.Request
+	db := res.DB
+	uname := user.Username
+	page := "tmpl/user-mail-in.html"
+
+	if Settings.MailIn.Domain == "" {
+		HandleWebError(w, r, http.StatusNotFound)
+		return
+	}
+
+	a, err := user.MailInAddress(db)
+	if err != nil && err != sql.ErrNoRows {
+		HandleWebError(w, r, http.StatusServiceUnavailable)
+		log.Println(err)
+		return
+	}
+	hasAddress := err == nil
+
+	procErr := false
+	if r.Method == "POST" {
+		if err := r.ParseForm(); err != nil { panic(err) }
+
+		err = nil
+		switch(r.FormValue("action")) {
+		case "new":
+			a = MailInAddress{
+				Username: uname,
+				Token: NewMailInToken(),
+				AllowedSenders: a.AllowedSenders }
+			err = a.Save(db)
+		case "senders":
+			senders, ok := ParseSenderList(r.FormValue("senders"))
+			if !ok || !hasAddress {
+				procErr = true
+				break
+			}
+			a.AllowedSenders = senders
+			err = a.Save(db)
+		case "delete":
+			err = user.DeleteMailInAddress(db)
+		default:
+			HandleWebError(w, r, http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			HandleWebError(w, r, http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		if !procErr {
+			http.Redirect(w, r, Settings.Web.Canon + "u/" + uname +
+				"/settings/save-by-email", http.StatusSeeOther)
+			return
+		}
+	}
+
+	var address string
+	var senders []string
+	if hasAddress {
+		address = a.Address()
+		if a.AllowedSenders != "" {
+			senders = strings.Split(a.AllowedSenders, ",") }
+	}
+	var fallback string
+	if user.EmailVerified { fallback = user.Email }
+
+	webuser := user.AsWebEntity()
+	webuser.ThisIsMe = true
+
+	err = Templates[page].Execute(w, UserMailInPage{
+		Canon: Settings.Web.Canon + "u/" + uname,
+		User: webuser,
+		Address: address,
+		AllowedSenders: senders,
+		Fallback: fallback,
+		Error: procErr,
+		Title: user.DisplayName + " (" + uname + ") - Save by E-mail",
+		UX: ux,
+		Settings: &Settings })
+	if err != nil {
+		HandleWebError(w, r, http.StatusInternalServerError)
+		log.Println(err)
+	}
+}
+
+// For the -save-mail flag: the exit codes sendmail-style MTAs understand
+func SaveMailExitCode(err error) (int) {
+	switch {
+	case err == nil, err == ErrSenderNotAllowed:
+		// Nothing to bounce to someone who may not have sent it
+		return 0
+	case err == ErrNoSuchMailbox:
+		return 67 // EX_NOUSER
+	case err == ErrBadMessage:
+		return 65 // EX_DATAERR
+	}
+	return 75 // EX_TEMPFAIL
+}
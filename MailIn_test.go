@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+func TestMessageURLs(t *testing.T) {
+	Settings.MailIn.MaxKiB = 1024
+	raw := "From: me@example.com\r\n" +
+		"Content-Type: multipart/alternative; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Type: text/plain\r\n\r\n" +
+		"Read https://example.com/a. And http://[::1 too\r\n" +
+		"--b\r\nContent-Type: text/html\r\n\r\n" +
+		`<a href="http://[::1">broken</a> <a href="https://example.com/a">` +
+		`again</a> <a href="https://example.com/b?x=1&amp;y=2">b</a> ` +
+		`<a href="https://example.com/unsubscribe">bye</a>` + "\r\n" +
+		"--b--\r\n"
+	msg, err := mail.ReadMessage(strings.NewReader(raw))
+	if err != nil { t.Fatal(err) }
+
+	urls, err := messageURLs(msg.Header, msg.Body, nil)
+	if err != nil { t.Fatal(err) }
+	want := []string{ "https://example.com/a", "https://example.com/b?x=1&y=2" }
+	if strings.Join(urls, " ") != strings.Join(want, " ") {
+		t.Errorf("got %q, want %q", urls, want) }
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+type OAuthClient struct {
+	ClientID string
+	SecretHash string
+	Name string
+	RedirectURIs string
+	CreatedOn string
+}
+
+type OAuthCode struct {
+	ClientID string
+	Username string
+	RedirectURI string
+	Scope string
+	Challenge string
+}
+
+type OAuthGrant struct {
+	GrantID int
+	ClientID string
+	ClientName string
+	Username string
+	Scope string
+	CreatedOn string
+	LastUsed string
+}
+
+type WebOAuthClient struct {
+	ClientID string
+	Name string
+	Public bool
+	RedirectURIs []string
+	CreatedOn string
+	CreatedOnRFC3339 string
+}
+
+type WebOAuthGrant struct {
+	GrantID int
+	ClientName string
+	Scope string
+	ScopeDescription string
+	CreatedOn string
+	CreatedOnRFC3339 string
+	LastUsed string
+	LastUsedRFC3339 string
+}
+
+type OAuthAuthorizePage struct {
+	Client WebOAuthClient
+	Scope string
+	ScopeDescription string
+	CSRF string
+	UX *UserExperience
+	Settings *Config }
+
+type UserAppsPage struct {
+	Canon string
+	Title string
+	User WebUserProfile
+	Grants []WebOAuthGrant
+	UX *UserExperience
+	Settings *Config }
+
+type AdminOAuthClientsPage struct {
+	Clients []WebOAuthClient
+	Created *WebOAuthClient
+	Secret string
+	Error bool
+	UX *UserExperience
+	Settings *Config }
+
+// OAuth scopes and the API token scope each one turns into, narrowest first
+var OAuthScopes = map[string]string{
+	"bookmarks:read": ScopeRead,
+	"bookmarks:add": ScopeAdd,
+	"bookmarks:write": ScopeFull }
+
+var OAuthScopeOrder = []string{
+	"bookmarks:read", "bookmarks:add", "bookmarks:write" }
+
+var OAuthScopeDescriptions = map[string]string{
+	"bookmarks:read": "See your bookmarks",
+	"bookmarks:add": "See your bookmarks and add new ones",
+	"bookmarks:write": "See, add, change and remove your bookmarks" }
+
+// Tokens carry a single scope so asking for several gets the broadest
+func ParseOAuthScope(requested string) (string, bool) {
+	fields := strings.Fields(requested)
+	if len(fields) == 0 { return OAuthScopeOrder[0], true }
+
+	best := -1
+	for _, f := range fields {
+		found := false
+		for i, s := range OAuthScopeOrder {
+			if s != f { continue }
+			found = true
+			if i > best { best = i }
+		}
+		if !found { return "", false }
+	}
+	return OAuthScopeOrder[best], true
+}
+
+// Only S256; "plain" PKCE buys nothing over no PKCE at all
+func VerifyPKCE(challenge, verifier string) (bool) {
+	if len(verifier) < 43 || len(verifier) > 128 { return false }
+	hash := sha256.Sum256([]byte(verifier))
+	ours := b64url.EncodeToString(hash[:])
+	return subtle.ConstantTimeCompare([]byte(ours), []byte(challenge)) == 1
+}
+
+func (c *OAuthClient) RedirectURIList() ([]string) {
+	return strings.Fields(c.RedirectURIs)
+}
+
+// What a client may register: https, or plain http back to the same machine
+// for native apps, and never with a fragment
+func ValidRedirectURI(uri string) (bool) {
+	u, err := url.Parse(uri)
+	if err != nil || u.Host == "" || u.Fragment != "" ||
+		strings.Contains(uri, "#") { return false }
+	switch(u.Scheme) {
+	case "https":
+		return true
+	case "http":
+		host := u.Hostname()
+		if host == "localhost" { return true }
+		ip := net.ParseIP(host)
+		return ip != nil && ip.IsLoopback()
+	}
+	return false
+}
+
+// Exact match against what was registered; with just one registered the
+// client may leave it out
+func (c *OAuthClient) CheckRedirectURI(uri string) (string, bool) {
+	list := c.RedirectURIList()
+	if uri == "" && len(list) == 1 { return list[0], true }
+	for _, r := range list {
+		if r == uri { return uri, true }
+	}
+	return "", false
+}
+
+func (c *OAuthClient) Public() (bool) { return c.SecretHash == "" }
+
+func (c *OAuthClient) CheckSecret(secret string) (bool) {
+	if c.Public() { return true }
+	return subtle.ConstantTimeCompare(
+		[]byte(HashToken(secret)), []byte(c.SecretHash)) == 1
+}
+
+func (c *OAuthClient) AsWebEntity() (wc WebOAuthClient) {
+	t, _ := ParseDBDate(c.CreatedOn)
+
+	wc.ClientID = c.ClientID
+	wc.Name = c.Name
+	wc.Public = c.Public()
+	wc.RedirectURIs = c.RedirectURIList()
+	wc.CreatedOn = WebDate(t)
+	wc.CreatedOnRFC3339 = RFC3339Date(t)
+	return
+}
+
+func (g *OAuthGrant) AsWebEntity() (wg WebOAuthGrant) {
+	t, _ := ParseDBDate(g.CreatedOn)
+
+	wg.GrantID = g.GrantID
+	wg.ClientName = g.ClientName
+	wg.Scope = g.Scope
+	wg.ScopeDescription = OAuthScopeDescriptions[g.Scope]
+	wg.CreatedOn = WebDate(t)
+	wg.CreatedOnRFC3339 = RFC3339Date(t)
+	if g.LastUsed != "" {
+		u, _ := ParseDBDate(g.LastUsed)
+		wg.LastUsed = WebDate(u)
+		wg.LastUsedRFC3339 = RFC3339Date(u)
+	}
+	return
+}
+
+func OAuthRedirect(w http.ResponseWriter, r *http.Request, redirectURI string, params url.Values) {
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		HandleWebError(w, r, http.StatusBadRequest)
+		return
+	}
+	q := u.Query()
+	for k, v := range params { q[k] = v }
+	u.RawQuery = q.Encode()
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+func OAuthError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	WriteJSON(w, map[string]string{ "error": code })
+}
+
+// Consent screen at /oauth/authorize
+func (ux *UserExperience) HandleOAuthAuthorize(res *ServerRes) {
+	w := res.Writer
+	r := res.Request
+	db := res.DB
+	page := "tmpl/oauth-authorize.html"
+	q := r.URL.Query()
+
+	// Until the client and redirect are known good, errors stay here
+	client, err := OAuthClientByID(db, q.Get("client_id"))
+	if err != nil {
+		HandleWebError(w, r, http.StatusBadRequest)
+		return
+	}
+	redirectURI, ok := client.CheckRedirectURI(q.Get("redirect_uri"))
+	if !ok {
+		HandleWebError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	fail := func(code string) {
+		OAuthRedirect(w, r, redirectURI, url.Values{
+			"error": { code },
+			"state": { q.Get("state") } })
+	}
+	if q.Get("response_type") != "code" {
+		fail("unsupported_response_type")
+		return
+	}
+	scope, ok := ParseOAuthScope(q.Get("scope"))
+	if !ok {
+		fail("invalid_scope")
+		return
+	}
+	if q.Get("code_challenge") == "" ||
+		q.Get("code_challenge_method") != "S256" {
+		fail("invalid_request")
+		return
+	}
+
+	if !ux.Can(ScopeSession) {
+		http.Redirect(w, r, "/login?next=" + url.QueryEscape(r.URL.RequestURI()),
+			http.StatusSeeOther)
+		return
+	}
+
+	if r.Method == "POST" {
+		if err := r.ParseForm(); err != nil { panic(err) }
+		if r.PostFormValue("csrf") != SessionHandle(ux.SessID) {
+			HandleWebError(w, r, http.StatusForbidden)
+			return
+		}
+		if r.PostFormValue("approve") == "" {
+			fail("access_denied")
+			return
+		}
+
+		u, err := UserByName(db, ux.Username)
+		if err != nil { panic(err) }
+		code, err := u.NewOAuthCode(db, OAuthCode{
+			ClientID: client.ClientID,
+			RedirectURI: redirectURI,
+			Scope: scope,
+			Challenge: q.Get("code_challenge") })
+		if err != nil {
+			log.Println(err)
+			fail("server_error")
+			return
+		}
+
+		log.Printf("User @%s authorized %s (%s)",
+			u.Username, client.Name, scope)
+		OAuthRedirect(w, r, redirectURI, url.Values{
+			"code": { code },
+			"state": { q.Get("state") } })
+		return
+	}
+
+	err = Templates[page].Execute(w, OAuthAuthorizePage{
+		Client: client.AsWebEntity(),
+		Scope: scope,
+		ScopeDescription: OAuthScopeDescriptions[scope],
+		CSRF: SessionHandle(ux.SessID),
+		UX: ux,
+		Settings: &Settings })
+	if err != nil {
+		HandleWebError(w, r, http.StatusInternalServerError)
+		log.Println(err)
+	}
+}
+
+// Code and refresh token exchange at /oauth/token
+func HandleOAuthToken(res *ServerRes) {
+	w := res.Writer
+	r := res.Request
+	db := res.DB
+
+	if r.Method != "POST" {
+		OAuthError(w, http.StatusMethodNotAllowed, "invalid_request")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		OAuthError(w, http.StatusBadRequest, "invalid_request")
+		return
+	}
+
+	clientID, secret, basic := r.BasicAuth()
+	if !basic {
+		clientID = r.PostFormValue("client_id")
+		secret = r.PostFormValue("client_secret")
+	}
+	client, err := OAuthClientByID(db, clientID)
+	if err != nil || !client.CheckSecret(secret) {
+		OAuthError(w, http.StatusUnauthorized, "invalid_client")
+		return
+	}
+
+	var grant OAuthGrant
+	switch(r.PostFormValue("grant_type")) {
+	case "authorization_code":
+		c, err := TakeOAuthCode(db, r.PostFormValue("code"))
+		if err != nil || c.ClientID != client.ClientID ||
+			c.RedirectURI != r.PostFormValue("redirect_uri") ||
+			!VerifyPKCE(c.Challenge, r.PostFormValue("code_verifier")) {
+			OAuthError(w, http.StatusBadRequest, "invalid_grant")
+			return
+		}
+
+		u := UserProfile{ Username: c.Username }
+		grantID, err := u.GrantOAuth(db, client.ClientID, c.Scope)
+		if err == nil { grant, err = OAuthGrantByID(db, grantID) }
+		if err != nil {
+			log.Println(err)
+			OAuthError(w, http.StatusInternalServerError, "server_error")
+			return
+		}
+	case "refresh_token":
+		grantID, err := TakeOAuthRefreshToken(db,
+			r.PostFormValue("refresh_token"))
+		if err == nil { grant, err = OAuthGrantByID(db, grantID) }
+		if err != nil || grant.ClientID != client.ClientID {
+			OAuthError(w, http.StatusBadRequest, "invalid_grant")
+			return
+		}
+	default:
+		OAuthError(w, http.StatusBadRequest, "unsupported_grant_type")
+		return
+	}
+
+	access, refresh, err := grant.IssueTokens(db, client.Name)
+	if err != nil {
+		log.Println(err)
+		OAuthError(w, http.StatusInternalServerError, "server_error")
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	WriteJSON(w, map[string]interface{}{
+		"access_token": access,
+		"token_type": "Bearer",
+		"expires_in": Settings.OAuth.AccessTokenMinutes * 60,
+		"refresh_token": refresh,
+		"scope": grant.Scope })
+}
+
+// Apps the user has let in, at /u/{USER}/settings/apps
+func (ux *UserExperience) HandleUserApps(res *ServerRes, user UserProfile) {
+	w := res.Writer
+	r := res.Request
+	db := res.DB
+	uname := user.Username
+	page := "tmpl/user-apps.html"
+
+	if r.Method == "POST" {
+		if err := r.ParseForm(); err != nil { panic(err) }
+		id, _ := strconv.Atoi(r.FormValue("grantid"))
+		err := OAuthGrant{ GrantID: id, Username: uname }.Revoke(db)
+		if err != nil {
+			HandleWebError(w, r, http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		http.Redirect(w, r, Settings.Web.Canon + "u/" + uname +
+			"/settings/apps", http.StatusSeeOther)
+		return
+	}
+
+	grants, err := user.OAuthGrants(db)
+	if err != nil {
+		HandleWebError(w, r, http.StatusServiceUnavailable)
+		log.Println(err)
+		return
+	}
+	var webgrants []WebOAuthGrant
+	for _, g := range grants {
+		webgrants = append(webgrants, g.AsWebEntity())
+	}
+
+	webuser := user.AsWebEntity()
+	webuser.ThisIsMe = true
+
+	err = Templates[page].Execute(w, UserAppsPage{
+		Canon: Settings.Web.Canon + "u/" + uname,
+		User: webuser,
+		Grants: webgrants,
+		Title: user.DisplayName + " (" + uname + ") - Connected Apps",
+		UX: ux,
+		Settings: &Settings })
+	if err != nil {
+		HandleWebError(w, r, http.StatusInternalServerError)
+		log.Println(err)
+	}
+}
+
+// Client registration at /admin/oauth-clients
+func (ux *UserExperience) HandleAdminOAuthClients(res *ServerRes) {
+	w := res.Writer
+	r := res.Request
+	db := res.DB
+	page := "tmpl/admin-oauth-clients.html"
+
+	var created *WebOAuthClient
+	var secret string
+	procErr := false
+	if r.Method == "POST" {
+		if err := r.ParseForm(); err != nil { panic(err) }
+
+		switch(r.FormValue("action")) {
+		case "create":
+			name := strings.TrimSpace(r.FormValue("name"))
+			uris := strings.Fields(r.FormValue("redirect_uris"))
+			for _, u := range uris {
+				if !ValidRedirectURI(u) { procErr = true }
+			}
+			if name == "" || len(uris) == 0 { procErr = true }
+			if procErr { break }
+
+			c := OAuthClient{
+				ClientID: MailToken()[:24],
+				Name: name,
+				RedirectURIs: strings.Join(uris, "\n") }
+			if r.FormValue("confidential") != "" {
+				secret = MailToken()
+				c.SecretHash = HashToken(secret)
+			}
+			err := c.Add(db)
+			if err != nil {
+				HandleWebError(w, r, http.StatusInternalServerError)
+				log.Println(err)
+				return
+			}
+			log.Printf("Admin @%s registered OAuth client %s (%s)",
+				ux.Username, c.Name, c.ClientID)
+			wc := c.AsWebEntity()
+			created = &wc
+		case "delete":
+			c := OAuthClient{ ClientID: r.FormValue("clientid") }
+			err := c.Del(db)
+			if err != nil {
+				HandleWebError(w, r, http.StatusInternalServerError)
+				log.Println(err)
+				return
+			}
+			log.Printf("Admin @%s deleted OAuth client %s",
+				ux.Username, c.ClientID)
+			http.Redirect(w, r, Settings.Web.Canon + "admin/oauth-clients",
+				http.StatusSeeOther)
+			return
+		}
+	}
+
+	clients, err := OAuthClients(db)
+	if err != nil {
+		HandleWebError(w, r, http.StatusServiceUnavailable)
+		log.Println(err)
+		return
+	}
+	var webclients []WebOAuthClient
+	for _, c := range clients {
+		webclients = append(webclients, c.AsWebEntity())
+	}
+
+	err = Templates[page].Execute(w, AdminOAuthClientsPage{
+		Clients: webclients,
+		Created: created,
+		Secret: secret,
+		Error: procErr,
+		UX: ux,
+		Settings: &Settings })
+	if err != nil {
+		HandleWebError(w, r, http.StatusInternalServerError)
+		log.Println(err)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVerifyPKCE(t *testing.T) {
+	// RFC 7636 appendix B
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	challenge := "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+	if !VerifyPKCE(challenge, verifier) {
+		t.Error("rejected the RFC 7636 example") }
+
+	cases := []struct {
+		name string
+		challenge, verifier string
+	}{
+		{ "other verifier", challenge, strings.Repeat("a", 43) },
+		// "plain" would have the challenge be the verifier itself
+		{ "plain", verifier, verifier },
+		{ "padded challenge", challenge + "=", verifier },
+		{ "no challenge", "", verifier },
+		{ "no verifier", challenge, "" },
+		{ "verifier too short", challenge, verifier[:42] },
+		{ "verifier too long", challenge, strings.Repeat("a", 129) },
+	}
+	for _, c := range cases {
+		if VerifyPKCE(c.challenge, c.verifier) {
+			t.Errorf("%s: accepted", c.name) }
+	}
+}
+
+func TestValidRedirectURI(t *testing.T) {
+	cases := []struct {
+		uri string
+		ok bool
+	}{
+		{ "https://app.example/callback", true },
+		{ "http://localhost:8080/cb", true },
+		{ "http://127.0.0.1/cb", true },
+		{ "http://[::1]:9000/cb", true },
+		{ "http://app.example/callback", false },
+		{ "https://app.example/callback#frag", false },
+		{ "https://app.example/callback#", false },
+		{ "javascript:alert(1)", false },
+		{ "com.example.app:/cb", false },
+		{ "https:///cb", false },
+		{ "http://[::1", false },
+	}
+	for _, c := range cases {
+		if ValidRedirectURI(c.uri) != c.ok {
+			t.Errorf("ValidRedirectURI(%q) is %v", c.uri, !c.ok) }
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/xml"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type OPML struct {
+	XMLName xml.Name `xml:"opml"`
+	Version string `xml:"version,attr"`
+	Head OPMLHead `xml:"head"`
+	Outlines []OPMLOutline `xml:"body>outline"`
+}
+
+type OPMLHead struct {
+	Title string `xml:"title"`
+	DateCreated string `xml:"dateCreated,omitempty"`
+	OwnerName string `xml:"ownerName,omitempty"`
+}
+
+type OPMLOutline struct {
+	Text string `xml:"text,attr"`
+	Title string `xml:"title,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	XMLURL string `xml:"xmlUrl,attr,omitempty"`
+	HTMLURL string `xml:"htmlUrl,attr,omitempty"`
+	URL string `xml:"url,attr,omitempty"`
+	Created string `xml:"created,attr,omitempty"`
+	Outlines []OPMLOutline `xml:"outline"`
+}
+
+// An outline an import left out, and why
+type OPMLSkip struct {
+	Text string
+	URL string
+	Reason string
+}
+
+var ErrBadOPML = errors.New("not an OPML file")
+
+func NewOPML(title string, owner UserProfile) (OPML) {
+	return OPML{
+		Version: "2.0",
+		Head: OPMLHead{
+			Title: title,
+			DateCreated: time.Now().UTC().Format(time.RFC1123Z),
+			OwnerName: owner.DisplayName } }
+}
+
+func WriteOPML(w http.ResponseWriter, doc OPML, filename string) (error) {
+	w.Header().Set("Content-Type", "text/x-opml; charset=utf-8")
+	w.Header().Set("Content-Disposition",
+		`attachment; filename="` + filename + `"`)
+	w.Write([]byte(xml.Header))
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "\t")
+	return encoder.Encode(doc)
+}
+
+// Every feed in the document, however deep its folders go
+func (o OPMLOutline) Feeds() (feeds []OPMLOutline) {
+	if o.XMLURL != "" { feeds = append(feeds, o) }
+	for _, child := range o.Outlines {
+		feeds = append(feeds, child.Feeds()...)
+	}
+	return
+}
+
+func ParseOPML(r io.Reader) (feeds []OPMLOutline, err error) {
+	var doc OPML
+	decoder := xml.NewDecoder(r)
+	decoder.CharsetReader = feedCharsetReader
+	decoder.Strict = false
+	if err = decoder.Decode(&doc); err != nil { return }
+	for _, o := range doc.Outlines {
+		feeds = append(feeds, o.Feeds()...)
+	}
+	return
+}
+
+// Subscribes the user to every usable feed in an uploaded OPML file
+func (u UserProfile) ImportOPML(db *sql.DB, r io.Reader) (imported int, skipped []OPMLSkip, err error) {
+	feeds, err := ParseOPML(r)
+	if err != nil {
+		log.Println(err)
+		return 0, nil, ErrBadOPML
+	}
+
+	existing, err := u.FeedSubscriptions(db)
+	if err != nil { return }
+	have := map[string]bool{}
+	for _, f := range existing { have[f.URL] = true }
+
+	for _, o := range feeds {
+		url := strings.TrimSpace(o.XMLURL)
+		text := o.Title
+		if text == "" { text = o.Text }
+		// Same reasons as the add form gives, unparseable links included
+		if err := IsURL(url); err != nil {
+			skipped = append(skipped, OPMLSkip{ text, url, err.Error() })
+			continue
+		}
+		if have[url] {
+			skipped = append(skipped, OPMLSkip{ text, url,
+				"Already subscribed" })
+			continue
+		}
+		f := FeedSubscription{ Username: u.Username, URL: url }
+		if err = f.Add(db); err != nil { return }
+		have[url] = true
+		imported++
+	}
+	return
+}
+
+// Feed subscriptions as OPML, at /u/{USER}/settings/feeds.opml
+func (ux *UserExperience) HandleUserFeedsOPML(res *ServerRes, user UserProfile) {
+	w := res.Writer
+	r := res.Request
+	db := res.DB
+
+	feeds, err := user.FeedSubscriptions(db)
+	if err != nil {
+		HandleWebError(w, r, http.StatusServiceUnavailable)
+		log.Println(err)
+		return
+	}
+
+	doc := NewOPML(user.DisplayName + "'s feed subscriptions", user)
+	for _, f := range feeds {
+		text := f.Title
+		if text == "" { text = f.URL }
+		doc.Outlines = append(doc.Outlines, OPMLOutline{
+			Text: text,
+			Title: text,
+			Type: "rss",
+			XMLURL: f.URL })
+	}
+	if err := WriteOPML(w, doc, user.Username + "-feeds.opml"); err != nil {
+		log.Println(err)
+	}
+}
+
+// Bookmarks as an OPML outline, one folder for the reading list and one for
+// the archive, at /u/{USER}/settings/bookmarks.opml
+func (ux *UserExperience) HandleUserBookmarksOPML(res *ServerRes, user UserProfile) {
+	w := res.Writer
+	r := res.Request
+	db := res.DB
+
+	order := &BOrder{ Parameter: SortByAdded, Order: OrderDescending }
+	unarchived, err := user.UnarchivedBookmarks(db, order)
+	var archived Bookmarks
+	if err == nil { archived, err = user.ArchivedBookmarks(db, order) }
+	if err != nil {
+		HandleWebError(w, r, http.StatusServiceUnavailable)
+		log.Println(err)
+		return
+	}
+
+	folder := func(name string, marks Bookmarks) (OPMLOutline) {
+		o := OPMLOutline{ Text: name }
+		for _, b := range marks {
+			t, _ := ParseDBDate(b.AddedOn)
+			o.Outlines = append(o.Outlines, OPMLOutline{
+				Text: b.Title,
+				Type: "link",
+				URL: b.URL,
+				Created: t.UTC().Format(time.RFC1123Z) })
+		}
+		return o
+	}
+
+	doc := NewOPML(user.DisplayName + "'s bookmarks", user)
+	doc.Outlines = []OPMLOutline{
+		folder("Reading list", unarchived),
+		folder("Archive", archived) }
+	if err := WriteOPML(w, doc, user.Username + "-bookmarks.opml"); err != nil {
+		log.Println(err)
+	}
+}
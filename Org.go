@@ -0,0 +1,536 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// A shared reading list at /o/{ORG}; its members each keep their own
+// read / unread state
+type Org struct {
+	OrgName string
+	DisplayName string
+	CreatedOn string
+}
+
+type OrgMember struct {
+	OrgName string
+	OrgDisplayName string
+	Username string
+	DisplayName string
+	Role string
+	JoinedOn string
+}
+
+type WebOrg struct {
+	OrgName string
+	DisplayName string
+	Homepage string
+	CreatedOn string
+	CreatedOnRFC3339 string
+	// The viewer's
+	Role string
+	CanEdit bool
+	IsOwner bool
+	Bookmarks []WebBookmark
+}
+
+type WebOrgMember struct {
+	Username string
+	DisplayName string
+	Role string
+	JoinedOn string
+	JoinedOnRFC3339 string
+}
+
+type OrgError struct {
+	BadName bool
+	Taken bool
+	NoSuchUser bool
+	BadRole bool
+	LastOwner bool
+}
+
+type OrgPage struct {
+	Canon string
+	Title string
+	Org WebOrg
+	Archive bool
+	UX *UserExperience
+	Settings *Config }
+
+type OrgAddPage struct {
+	Canon string
+	Title string
+	Org WebOrg
+	Error *AddError
+	UX *UserExperience
+	Settings *Config }
+
+type OrgEditPage struct {
+	Canon string
+	Title string
+	Org WebOrg
+	Mark Bookmark
+	UX *UserExperience
+	Settings *Config }
+
+type OrgMembersPage struct {
+	Canon string
+	Title string
+	Org WebOrg
+	Members []WebOrgMember
+	Error *OrgError
+	UX *UserExperience
+	Settings *Config }
+
+type UserOrgsPage struct {
+	Canon string
+	Title string
+	User WebUserProfile
+	Orgs []WebOrg
+	Error *OrgError
+	UX *UserExperience
+	Settings *Config }
+
+const (
+	// Everything editors can do, plus managing members
+	OrgOwner = "owner"
+	// Add, edit, archive and remove the org's bookmarks
+	OrgEditor = "editor"
+	// Read them and keep track of what they've read
+	OrgViewer = "viewer"
+)
+
+var OrgRoles = []string{ OrgOwner, OrgEditor, OrgViewer }
+
+func ValidOrgRole(role string) (bool) {
+	for _, r := range OrgRoles {
+		if r == role { return true }
+	}
+	return false
+}
+
+func (m OrgMember) CanEdit() (bool) {
+	return m.Role == OrgOwner || m.Role == OrgEditor
+}
+
+func (o *Org) AsWebEntity(m OrgMember) (wo WebOrg) {
+	t, _ := ParseDBDate(o.CreatedOn)
+
+	wo.OrgName = o.OrgName
+	wo.DisplayName = o.DisplayName
+	wo.Homepage = Settings.Web.Canon + "o/" + o.OrgName
+	wo.CreatedOn = WebDate(t)
+	wo.CreatedOnRFC3339 = RFC3339Date(t)
+	wo.Role = m.Role
+	wo.CanEdit = m.CanEdit()
+	wo.IsOwner = m.Role == OrgOwner
+	return
+}
+
+func (m *OrgMember) AsWebEntity() (wm WebOrgMember) {
+	t, _ := ParseDBDate(m.JoinedOn)
+
+	wm.Username = m.Username
+	wm.DisplayName = m.DisplayName
+	wm.Role = m.Role
+	wm.JoinedOn = WebDate(t)
+	wm.JoinedOnRFC3339 = RFC3339Date(t)
+	return
+}
+
+// Everything under /o/{ORG}; only members can see any of it
+func (ux *UserExperience) HandleOrgReq(res *ServerRes, orgname string, args []string) {
+	w := res.Writer
+	r := res.Request
+	db := res.DB
+
+	if !ux.LoggedIn {
+		http.Redirect(w, r, "/login?next=" + url.QueryEscape(r.URL.Path),
+			http.StatusSeeOther)
+		return
+	}
+
+	org, err := OrgByName(db, orgname)
+	var member OrgMember
+	if err == nil { member, err = org.Member(db, ux.Username) }
+	if err != nil || !ux.Can(ScopeRead) {
+		HandleWebError(w, r, http.StatusNotFound)
+		return
+	}
+
+	switch(len(args)) {
+	case 0:
+		ux.HandleOrgBookmarks(res, org, member, false)
+	case 1:
+		switch(args[0]) {
+		case "archive": ux.HandleOrgBookmarks(res, org, member, true)
+		case "add": ux.HandleOrgAdd(res, org, member)
+		case "members": ux.HandleOrgMembers(res, org, member)
+		default: HandleWebError(w, r, http.StatusNotFound)
+		}
+	case 2:
+		if args[0] == "out" {
+			bID, err := strconv.Atoi(args[1])
+			if err != nil {
+				HandleWebError(w, r, http.StatusBadRequest)
+				return
+			}
+			ux.HandleOrgOut(res, org, bID)
+			return
+		}
+		bID, err := strconv.Atoi(args[0])
+		if err != nil {
+			HandleWebError(w, r, http.StatusBadRequest)
+			return
+		}
+		ux.HandleOrgBMarkAction(res, org, member, bID, args[1])
+	default:
+		HandleWebError(w, r, http.StatusNotFound)
+	}
+}
+
+func (ux *UserExperience) HandleOrgBookmarks(res *ServerRes, org Org, member OrgMember, archived bool) {
+	w := res.Writer
+	r := res.Request
+	page := "tmpl/org.html"
+
+	var order *BOrder
+	param, ok := r.URL.Query()["order"]
+	if ok && len(param[0]) > 0 { order = QueryAsOrder(param[0]) }
+	if order == nil { order = &BOrder{
+		Parameter: SortByAdded,
+		Order: OrderDescending } }
+
+	marks, err := org.Bookmarks(res.DB, ux.Username, archived, order)
+	if err != nil {
+		HandleWebError(w, r, http.StatusServiceUnavailable)
+		log.Println(err)
+		return
+	}
+
+	weborg := org.AsWebEntity(member)
+	weborg.Bookmarks = marks.AsWebEntities()
+	title := org.DisplayName + " - Bookmarks"
+	if archived { title = org.DisplayName + " - Archived Bookmarks" }
+
+	err = Templates[page].Execute(w, OrgPage{
+		Canon: weborg.Homepage,
+		Title: title,
+		Org: weborg,
+		Archive: archived,
+		UX: ux,
+		Settings: &Settings })
+	if err != nil {
+		HandleWebError(w, r, http.StatusInternalServerError)
+		log.Println(err)
+	}
+}
+
+func (ux *UserExperience) HandleOrgAdd(res *ServerRes, org Org, member OrgMember) {
+	w := res.Writer
+	r := res.Request
+	page := "tmpl/org-add.html"
+
+	if !member.CanEdit() {
+		HandleWebError(w, r, http.StatusForbidden)
+		return
+	}
+
+	var procErr AddError
+	if r.Method == "POST" {
+		if !ux.Can(ScopeAdd) {
+			HandleWebError(w, r, http.StatusForbidden)
+			return
+		}
+		if err := r.ParseForm(); err != nil { panic(err) }
+		name := r.FormValue("name")
+		url := r.FormValue("url")
+
+		if uErr := IsURL(url); uErr != nil {
+			if uErr.(*URLError).BadScheme {
+				procErr = AddError{ URLBadScheme: true }
+			} else if uErr.(*URLError).NoHost {
+				procErr = AddError{ URLNoHost: true }
+			} else {
+				procErr = AddError{ URLOther: true }
+			}
+		} else {
+			b := Bookmark{
+				OrgName: org.OrgName,
+				Username: ux.Username,
+				Title: name,
+				URL: url }
+			if err := b.AddToOrg(res.DB); err != nil {
+				HandleWebError(w, r, http.StatusInternalServerError)
+				log.Println(err)
+				return
+			}
+			http.Redirect(w, r, "/o/" + org.OrgName, http.StatusSeeOther)
+			return
+		}
+	}
+
+	weborg := org.AsWebEntity(member)
+	err := Templates[page].Execute(w, OrgAddPage{
+		Canon: weborg.Homepage,
+		Title: org.DisplayName + " - Add Bookmark",
+		Org: weborg,
+		Error: &procErr,
+		UX: ux,
+		Settings: &Settings })
+	if err != nil {
+		HandleWebError(w, r, http.StatusInternalServerError)
+		log.Println(err)
+	}
+}
+
+func (ux *UserExperience) HandleOrgOut(res *ServerRes, org Org, bID int) {
+	mark, err := org.BookmarkByID(res.DB, ux.Username, bID)
+	if err != nil {
+		HandleWebError(res.Writer, res.Request, http.StatusNotFound)
+		return
+	}
+	if ux.Can(ScopeFull) { mark.OrgMarkRead(res.DB, ux.Username) }
+	http.Redirect(res.Writer, res.Request, mark.URL, http.StatusSeeOther)
+}
+
+// Anyone in the org keeps their own read state; the rest takes an editor
+func (ux *UserExperience) HandleOrgBMarkAction(res *ServerRes, org Org, member OrgMember, bID int, action string) {
+	w := res.Writer
+	r := res.Request
+	db := res.DB
+
+	if !ux.Can(ScopeFull) {
+		HandleWebError(w, r, http.StatusForbidden)
+		return
+	}
+	mark, err := org.BookmarkByID(db, ux.Username, bID)
+	if err != nil {
+		HandleWebError(w, r, http.StatusNotFound)
+		return
+	}
+	if action != "read" && action != "unread" && !member.CanEdit() {
+		HandleWebError(w, r, http.StatusForbidden)
+		return
+	}
+
+	back := "/o/" + org.OrgName
+	switch(action) {
+		case "read":
+			err = mark.OrgMarkRead(db, ux.Username)
+		case "unread":
+			err = mark.OrgMarkUnread(db, ux.Username)
+		case "edit":
+			ux.HandleOrgEdit(res, org, member, mark)
+			return
+		case "unarchive":
+			err = mark.OrgSetArchived(db, false)
+			back += "/archive"
+		case "archive":
+			err = mark.OrgSetArchived(db, true)
+		case "remove":
+			err = mark.OrgDel(db)
+		default:
+			HandleWebError(w, r, http.StatusMethodNotAllowed)
+			return
+	}
+	if err != nil {
+		HandleWebError(w, r, http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
+
+func (ux *UserExperience) HandleOrgEdit(res *ServerRes, org Org, member OrgMember, mark Bookmark) {
+	w := res.Writer
+	r := res.Request
+	page := "tmpl/org-edit.html"
+
+	if r.Method == "POST" {
+		if err := r.ParseForm(); err != nil { panic(err) }
+		mark.Title = r.FormValue("name")
+		mark.URL = r.FormValue("url")
+		if IsURL(mark.URL) != nil {
+			HandleWebError(w, r, http.StatusBadRequest)
+			return
+		}
+		if err := mark.OrgEdit(res.DB); err != nil {
+			HandleWebError(w, r, http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		http.Redirect(w, r, "/o/" + org.OrgName, http.StatusSeeOther)
+		return
+	}
+
+	weborg := org.AsWebEntity(member)
+	err := Templates[page].Execute(w, OrgEditPage{
+		Canon: weborg.Homepage,
+		Title: org.DisplayName + " - Edit Bookmark",
+		Org: weborg,
+		Mark: mark,
+		UX: ux,
+		Settings: &Settings })
+	if err != nil {
+		HandleWebError(w, r, http.StatusInternalServerError)
+		log.Println(err)
+	}
+}
+
+// Who's in the org, at /o/{ORG}/members; owners can change it
+func (ux *UserExperience) HandleOrgMembers(res *ServerRes, org Org, member OrgMember) {
+	w := res.Writer
+	r := res.Request
+	db := res.DB
+	page := "tmpl/org-members.html"
+
+	var procErr *OrgError
+	if r.Method == "POST" {
+		if err := r.ParseForm(); err != nil { panic(err) }
+		uname := strings.ToLower(r.FormValue("username"))
+		role := r.FormValue("role")
+		leaving := r.FormValue("action") == "remove" && uname == ux.Username
+
+		if !ux.Can(ScopeSession) || (member.Role != OrgOwner && !leaving) {
+			HandleWebError(w, r, http.StatusForbidden)
+			return
+		}
+
+		procErr = ux.ChangeOrgMember(db, org, uname, role,
+			r.FormValue("action"))
+		if procErr == nil {
+			next := "/o/" + org.OrgName + "/members"
+			if leaving { next = "/u/" + ux.Username + "/settings/orgs" }
+			http.Redirect(w, r, next, http.StatusSeeOther)
+			return
+		}
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+
+	members, err := org.Members(db)
+	if err != nil {
+		HandleWebError(w, r, http.StatusServiceUnavailable)
+		log.Println(err)
+		return
+	}
+	var webmembers []WebOrgMember
+	for _, m := range members {
+		webmembers = append(webmembers, m.AsWebEntity())
+	}
+
+	weborg := org.AsWebEntity(member)
+	err = Templates[page].Execute(w, OrgMembersPage{
+		Canon: weborg.Homepage,
+		Title: org.DisplayName + " - Members",
+		Org: weborg,
+		Members: webmembers,
+		Error: procErr,
+		UX: ux,
+		Settings: &Settings })
+	if err != nil {
+		HandleWebError(w, r, http.StatusInternalServerError)
+		log.Println(err)
+	}
+}
+
+// Adds, re-roles or removes a member; an org always keeps one owner
+func (ux *UserExperience) ChangeOrgMember(db *sql.DB, org Org, uname, role, action string) (*OrgError) {
+	if action != "remove" && !ValidOrgRole(role) {
+		return &OrgError{ BadRole: true } }
+
+	if action != "remove" {
+		u, err := UserByName(db, uname)
+		if err != nil || !u.Active() { return &OrgError{ NoSuchUser: true } }
+	}
+
+	// Demoting or removing an owner mustn't leave the org without one
+	current, err := org.Member(db, uname)
+	if err == nil && current.Role == OrgOwner &&
+		(action == "remove" || role != OrgOwner) {
+		owners, err := org.OwnerCount(db)
+		if err != nil || owners <= 1 { return &OrgError{ LastOwner: true } }
+	}
+
+	if action == "remove" {
+		err = org.RemoveMember(db, uname)
+	} else {
+		err = org.SetMember(db, uname, role)
+	}
+	if err != nil {
+		log.Println(err)
+		return &OrgError{ NoSuchUser: true }
+	}
+	if action == "remove" { role = "removed" }
+	log.Printf("@%s set @%s in org %s to %s", ux.Username, uname,
+		org.OrgName, role)
+	return nil
+}
+
+// The user's orgs, and a form to start one, at /u/{USER}/settings/orgs
+func (ux *UserExperience) HandleUserOrgs(res *ServerRes, user UserProfile) {
+	w := res.Writer
+	r := res.Request
+	db := res.DB
+	uname := user.Username
+	page := "tmpl/user-orgs.html"
+
+	var procErr *OrgError
+	if r.Method == "POST" {
+		if err := r.ParseForm(); err != nil { panic(err) }
+		org := Org{
+			OrgName: strings.ToLower(r.FormValue("orgname")),
+			DisplayName: r.FormValue("displayname") }
+		if org.DisplayName == "" { org.DisplayName = org.OrgName }
+
+		if !ValidUsername(org.OrgName) ||
+			!ValidDisplayName(org.DisplayName) {
+			procErr = &OrgError{ BadName: true }
+		} else if _, err := OrgByName(db, org.OrgName); err == nil {
+			procErr = &OrgError{ Taken: true }
+		} else if err := org.Add(db, uname); err != nil {
+			HandleWebError(w, r, http.StatusInternalServerError)
+			log.Println(err)
+			return
+		} else {
+			log.Printf("User @%s started org %s", uname, org.OrgName)
+			http.Redirect(w, r, "/o/" + org.OrgName, http.StatusSeeOther)
+			return
+		}
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+
+	memberships, err := user.Orgs(db)
+	if err != nil {
+		HandleWebError(w, r, http.StatusServiceUnavailable)
+		log.Println(err)
+		return
+	}
+	var orgs []WebOrg
+	for _, m := range memberships {
+		o := Org{ OrgName: m.OrgName, DisplayName: m.OrgDisplayName }
+		orgs = append(orgs, o.AsWebEntity(m))
+	}
+
+	webuser := user.AsWebEntity()
+	webuser.ThisIsMe = true
+
+	err = Templates[page].Execute(w, UserOrgsPage{
+		Canon: Settings.Web.Canon + "u/" + uname,
+		User: webuser,
+		Orgs: orgs,
+		Error: procErr,
+		Title: user.DisplayName + " (" + uname + ") - Organizations",
+		UX: ux,
+		Settings: &Settings })
+	if err != nil {
+		HandleWebError(w, r, http.StatusInternalServerError)
+		log.Println(err)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Shadows are self-describing so old ones keep working as settings change:
+//
+//	$2a$10$...                          bcrypt (what every account started with)
+//	$argon2id$v=19$m=65536,t=3,p=2$S$H  Argon2id, PHC string format
+//	$pepper$<either of the above>       hashed over HMAC(pepper, password)
+//
+// LetMeIn re-hashes any shadow that doesn't match the current settings
+
+const (
+	HashBcrypt = "bcrypt"
+	HashArgon2id = "argon2id"
+
+	pepperPrefix = "$pepper$"
+	argon2Prefix = "$argon2id$"
+)
+
+var ErrShadow = errors.New("Unrecognized shadow")
+
+type argon2Params struct {
+	Memory uint32
+	Time uint32
+	Threads uint8
+}
+
+func DoShadow(password string) (string, error) {
+	c := Settings.Password
+	prefix := ""
+	if c.Pepper != "" {
+		password = pepper(password)
+		prefix = pepperPrefix
+	}
+
+	if c.Algorithm == HashArgon2id {
+		shadow, err := argon2Shadow(password, currentArgon2())
+		if err != nil { return "", err }
+		return prefix + shadow, nil
+	}
+
+	hash, err := bcrypt.GenerateFromPassword(
+		[]byte(password),
+		bcryptCost())
+	if err != nil { return "", err }
+	return prefix + string(hash), nil
+}
+
+// Caught at startup rather than when somebody's shadow comes out empty
+func (c PasswordSettings) Validate() (error) {
+	switch(c.Algorithm) {
+	case "", HashBcrypt, HashArgon2id:
+	default:
+		return fmt.Errorf("[Password] Algorithm must be %q or %q, not %q",
+			HashBcrypt, HashArgon2id, c.Algorithm)
+	}
+	if c.BcryptCost != 0 &&
+		(c.BcryptCost < bcrypt.MinCost || c.BcryptCost > bcrypt.MaxCost) {
+		return fmt.Errorf("[Password] BcryptCost must be between %d and %d",
+			bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	return nil
+}
+
+func CompareShadow(shadow, password string) (error) {
+	if strings.HasPrefix(shadow, pepperPrefix) {
+		shadow = strings.TrimPrefix(shadow, pepperPrefix)
+		password = pepper(password)
+	}
+
+	if strings.HasPrefix(shadow, argon2Prefix) {
+		p, salt, hash, err := parseArgon2(shadow)
+		if err != nil { return err }
+		other := argon2.IDKey([]byte(password), salt,
+			p.Time, p.Memory, p.Threads, uint32(len(hash)))
+		if subtle.ConstantTimeCompare(hash, other) != 1 {
+			return errors.New("Password mismatch")
+		}
+		return nil
+	}
+
+	return bcrypt.CompareHashAndPassword([]byte(shadow), []byte(password))
+}
+
+// Whether this shadow was made with anything other than today's settings
+func ShadowOutdated(shadow string) (bool) {
+	c := Settings.Password
+	peppered := strings.HasPrefix(shadow, pepperPrefix)
+	if peppered != (c.Pepper != "") { return true }
+	shadow = strings.TrimPrefix(shadow, pepperPrefix)
+
+	if strings.HasPrefix(shadow, argon2Prefix) {
+		if c.Algorithm != HashArgon2id { return true }
+		p, _, _, err := parseArgon2(shadow)
+		return err != nil || p != currentArgon2()
+	}
+
+	if c.Algorithm == HashArgon2id { return true }
+	cost, err := bcrypt.Cost([]byte(shadow))
+	return err != nil || cost != bcryptCost()
+}
+
+// Short name for reporting: bcrypt-10, argon2id, pepper+argon2id...
+func ShadowScheme(shadow string) (string) {
+	prefix := ""
+	if strings.HasPrefix(shadow, pepperPrefix) {
+		prefix = "pepper+"
+		shadow = strings.TrimPrefix(shadow, pepperPrefix)
+	}
+
+	if strings.HasPrefix(shadow, argon2Prefix) {
+		p, _, _, err := parseArgon2(shadow)
+		if err != nil { return "unknown" }
+		return fmt.Sprintf("%sargon2id(m=%d,t=%d,p=%d)",
+			prefix, p.Memory, p.Time, p.Threads)
+	}
+	cost, err := bcrypt.Cost([]byte(shadow))
+	if err != nil { return "unknown" }
+	return fmt.Sprintf("%sbcrypt(%d)", prefix, cost)
+}
+
+var dummyShadow string
+var dummyShadowOnce sync.Once
+
+// Shadow to compare against when there is no such user
+func DummyShadow() (string) {
+	dummyShadowOnce.Do(func() {
+		var err error
+		dummyShadow, err = DoShadow("correct horse battery staple")
+		if err != nil { log.Println(err) }
+	})
+	return dummyShadow
+}
+
+func pepper(password string) (string) {
+	mac := hmac.New(sha256.New, []byte(Settings.Password.Pepper))
+	mac.Write([]byte(password))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func bcryptCost() (int) {
+	cost := Settings.Password.BcryptCost
+	if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		return bcrypt.DefaultCost }
+	return cost
+}
+
+func currentArgon2() (argon2Params) {
+	c := Settings.Password
+	p := argon2Params{
+		Memory: c.Argon2MemoryKiB,
+		Time: c.Argon2Time,
+		Threads: c.Argon2Threads }
+	if p.Memory == 0 { p.Memory = 64 * 1024 }
+	if p.Time == 0 { p.Time = 3 }
+	if p.Threads == 0 { p.Threads = 2 }
+	return p
+}
+
+func argon2Shadow(password string, p argon2Params) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil { return "", err }
+	hash := argon2.IDKey([]byte(password), salt,
+		p.Time, p.Memory, p.Threads, 32)
+
+	b64 := base64.RawStdEncoding
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2Prefix, argon2.Version, p.Memory, p.Time, p.Threads,
+		b64.EncodeToString(salt), b64.EncodeToString(hash)), nil
+}
+
+func parseArgon2(shadow string) (p argon2Params, salt, hash []byte, err error) {
+	parts := strings.Split(strings.TrimPrefix(shadow, argon2Prefix), "$")
+	if len(parts) != 4 { return p, nil, nil, ErrShadow }
+
+	var version int
+	_, err = fmt.Sscanf(parts[0], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return p, nil, nil, ErrShadow }
+	_, err = fmt.Sscanf(parts[1], "m=%d,t=%d,p=%d",
+		&p.Memory, &p.Time, &p.Threads)
+	if err != nil { return p, nil, nil, ErrShadow }
+
+	b64 := base64.RawStdEncoding
+	salt, err = b64.DecodeString(parts[2])
+	if err != nil { return p, nil, nil, ErrShadow }
+	hash, err = b64.DecodeString(parts[3])
+	if err != nil { return p, nil, nil, ErrShadow }
+	return p, salt, hash, nil
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"bytes"
+	"net/http"
+	"net/url"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type PayPalProvider struct {
+	Settings PayPalSettings
+	Client http.Client
+}
+
+type PayPalOrder struct {
+	ID string `json:"id"`
+	PurchaseUnits []PayPalPurchaseUnit `json:"purchase_units"`
+	Status string `json:"status"`
+}
+
+type PayPalAuth struct {
+	AccessToken string `json:"access_token"`
+}
+
+type PayPalPurchaseUnit struct {
+	Amount PayPalAmount `json:"amount"`
+	Payee PayPalPayee `json:"payee"`
+	Payments PayPalPayments `json:"payments"`
+}
+
+type PayPalPayee struct {
+	MerchantID string `json:"merchant_id"`
+}
+
+type PayPalPayments struct {
+	Captures []PayPalCapture `json:"captures"`
+}
+
+type PayPalCapture struct {
+	ID string `json:"id"`
+	Status string `json:"status"`
+}
+
+type PayPalAmount struct {
+	CurrencyCode string `json:"currency_code"`
+	Value string `json:"value"`
+}
+
+func NewPayPalProvider(c PayPalSettings) (*PayPalProvider) {
+	return &PayPalProvider{
+		Settings: c,
+		Client: http.Client{ Timeout: 30 * time.Second } }
+}
+
+func (p *PayPalProvider) Name() (string) { return "paypal" }
+
+func (p *PayPalProvider) CreateOrder(amount float64, currency string) (string, error) {
+	accessToken, err := p.OAuthToken()
+	if err != nil { return "", err }
+
+	body, err := json.Marshal(map[string]interface{}{
+		"intent": "CAPTURE",
+		"purchase_units": []map[string]interface{}{ {
+			"amount": map[string]string{
+				"currency_code": currency,
+				"value": strconv.FormatFloat(amount, 'f', 2, 64) } } } })
+	if err != nil { return "", err }
+
+	headers := map[string]string{
+		"Accept": "application/json",
+		"Content-Type": "application/json",
+		"Authorization": "Bearer " + accessToken }
+
+	var order PayPalOrder
+	endpoint := strings.TrimSuffix(p.Settings.OrderAPI, "/")
+	res, err := p.Post(endpoint, headers, bytes.NewBuffer(body))
+	if err != nil { return "", err }
+	if err := json.Unmarshal(res, &order); err != nil { return "", err }
+	if order.ID == "" { return "", errors.New("paypal: no order ID returned") }
+	return order.ID, nil
+}
+
+func (p *PayPalProvider) VerifyOrder(orderID string, amount float64, currency string) (bool, error) {
+	order, err := p.Order(orderID)
+	if err != nil { return false, err }
+	return IsAdequatePayment(order, amount, currency,
+		p.Settings.MerchantID), nil
+}
+
+// Refunds every capture on the order in full
+func (p *PayPalProvider) Refund(orderID string) (error) {
+	order, err := p.Order(orderID)
+	if err != nil { return err }
+	accessToken, err := p.OAuthToken()
+	if err != nil { return err }
+
+	headers := map[string]string{
+		"Accept": "application/json",
+		"Content-Type": "application/json",
+		"Authorization": "Bearer " + accessToken }
+
+	refunded := false
+	for _, unit := range order.PurchaseUnits {
+		for _, capture := range unit.Payments.Captures {
+			endpoint := p.Settings.CaptureAPI + url.PathEscape(capture.ID) +
+				"/refund"
+			_, err := p.Post(endpoint, headers, bytes.NewBufferString("{}"))
+			if err != nil { return err }
+			refunded = true
+		}
+	}
+	if !refunded { return errors.New("paypal: order has no captures to refund") }
+	return nil
+}
+
+func (p *PayPalProvider) Order(orderID string) (order PayPalOrder, err error) {
+	accessToken, err := p.OAuthToken()
+	if err != nil { return }
+
+	endpoint := p.Settings.OrderAPI + url.PathEscape(orderID)
+	headers := map[string]string{
+		"Accept": "application/json",
+		"Authorization": "Bearer " + accessToken }
+
+	res, err := p.Get(endpoint, headers, nil)
+	if err != nil { return }
+	err = json.Unmarshal(res, &order)
+	return
+}
+
+func (p *PayPalProvider) OAuthToken() (string, error) {
+	rBody := bytes.NewBuffer([]byte("grant_type=client_credentials"))
+	endpoint := p.Settings.OAuthAPI
+	headers := map[string]string{
+		"Accept": "application/json",
+		"Authorization": "Basic " + p.BasicAuth() }
+
+	var auth PayPalAuth
+	res, err := p.Post(endpoint, headers, rBody)
+	if err != nil { return "", err }
+	if err := json.Unmarshal(res, &auth); err != nil { return "", err }
+	if auth.AccessToken == "" {
+		return "", errors.New("paypal: no access token returned") }
+	return auth.AccessToken, nil
+}
+
+// Captured in full, to us, in the right currency and for the exact amount
+func IsAdequatePayment(order PayPalOrder, ought float64, currency, merchant string) (bool) {
+	if order.Status != "COMPLETED" || len(order.PurchaseUnits) == 0 {
+		return false }
+
+	var total int
+	for _, unit := range order.PurchaseUnits {
+		if unit.Amount.CurrencyCode != currency { return false }
+		if unit.Payee.MerchantID != merchant { return false }
+		if len(unit.Payments.Captures) == 0 { return false }
+		for _, capture := range unit.Payments.Captures {
+			if capture.Status != "COMPLETED" { return false }
+		}
+
+		val, err := strconv.ParseFloat(unit.Amount.Value, 64)
+		if err != nil { return false }
+		total += Cents(val)
+	}
+	return total == Cents(ought)
+}
+
+func (p *PayPalProvider) Get(endpoint string,
+	headers map[string]string,
+	body io.Reader) ([]byte, error) {
+	return p.Do(http.MethodGet,
+		endpoint,
+		headers,
+		body)
+}
+
+func (p *PayPalProvider) Post(endpoint string,
+	headers map[string]string,
+	body io.Reader) ([]byte, error) {
+	return p.Do(http.MethodPost,
+		endpoint,
+		headers,
+		body)
+}
+
+func (p *PayPalProvider) Do(method string,
+	endpoint string,
+	headers map[string]string,
+	body io.Reader) ([]byte, error) {
+
+	if body == nil { body = http.NoBody }
+	req, err := http.NewRequest(method, endpoint, body)
+	if err != nil { return nil, err }
+	for key, val := range headers {
+		req.Header.Set(key, val)
+	}
+
+	resp, err := p.Client.Do(req)
+	if err != nil { return nil, err }
+	defer resp.Body.Close()
+
+	resBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil { return nil, err }
+	if resp.StatusCode >= 400 {
+		return nil, fmt.Errorf("paypal: %s %s: %s", method, endpoint,
+			resp.Status)
+	}
+	return resBody, nil
+}
+
+func (p *PayPalProvider) BasicAuth() (string) {
+	auth := []byte(strings.Join([]string{
+		p.Settings.Client,
+		p.Settings.Secret}, ":"))
+
+	return string(base64.StdEncoding.EncodeToString(auth))
+}
@@ -1,132 +1,217 @@
 package main
 
 import (
-	"encoding/base64"
-	"io"
-	"io/ioutil"
-	"bytes"
-	"net/http"
-	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
 	"strconv"
-	"strings"
+	"sync"
+	"time"
 )
 
-type PayPalOrder struct {
-	ID string `json:"id"`
-	PurchaseUnits []PayPalPurchaseUnit `json:"purchase_units"`
-	Status string `json:status`
+// Whatever takes the money for account activation
+type PaymentProvider interface {
+	Name() string
+	// Sets up an order for the customer to pay and returns its ID
+	CreateOrder(amount float64, currency string) (string, error)
+	// Whether the order was paid, to us, in exactly this amount and currency
+	VerifyOrder(orderID string, amount float64, currency string) (bool, error)
+	Refund(orderID string) error
 }
 
-type PayPalAuth struct {
-	AccessToken string `json:"access_token"`
+// Providers whose customers pay on a page of their own, and come back to
+// /signup/pay afterwards, rather than through a button on ours
+type RedirectingProvider interface {
+	PaymentProvider
+	CheckoutURL(orderID string) (string, error)
 }
 
-type PayPalPurchaseUnit struct {
-	Amount PayPalAmount `json:amount`
+// For development; nothing leaves the machine and every order it creates
+// counts as paid. Order IDs carry the amount and currency so verification
+// still works after a restart, and editing one (e.g. to a lower amount or
+// to "MOCK-DECLINED") is how to try out a failed payment
+type MockPaymentProvider struct {
+	mu sync.Mutex
+	next int
+	refunded map[string]bool
 }
 
-type PayPalAmount struct {
-	CurrencyCode string `json:"currency_code"`
-	Value string `json:value`
+// A signup that has passed validation and is waiting to be paid for;
+// the browser only ever holds the opaque token it was filed under
+type PendingSignup struct {
+	TokenHash string
+	Username string
+	DisplayName string
+	Shadow string
+	// Only set when it took something off Amount
+	Promo string
+	// What the customer was quoted, and so what they pay
+	Amount float64
+	Currency string
 }
 
-func VerifyPayment(orderID string) (bool, error) {
-	client := http.Client{}
-
-	accessToken := PayPalOAuthToken(client)
-
-	endpoint := Settings.PayPal.OrderAPI + orderID
-	headers := map[string]string{
-		"Accept": "application/json",
-		"Authorization": "Bearer " + accessToken }
-
-	var order PayPalOrder
-	res, err := PayPalGet(client, endpoint, headers, nil)
-	if err != nil { panic(err) }
-	json.Unmarshal(res, &order)
-
-	if IsAdequatePayment(order) {
-		return true, nil
-	} else { return false, nil }
+// One account's activation, paid or otherwise
+type Payment struct {
+	PaymentID int
+	Provider string
+	OrderID string
+	Username string
+	Amount float64
+	Currency string
+	Promo string
+	Status string
+	CreatedOn string
+	RefundedOn string
+	RefundedBy string
 }
 
-func PayPalOAuthToken(client http.Client) (string) {
-	rBody := bytes.NewBuffer([]byte("grant_type=client_credentials"))
-	endpoint := Settings.PayPal.OAuthAPI
-	headers := map[string]string{
-		"Accept": "application/json",
-		"Authorization": "Basic " + PayPalBasicAuth() }
-
-	var auth PayPalAuth
-	res, err := PayPalPost(client, endpoint, headers, rBody)
-	if err != nil { panic(err) }
-	json.Unmarshal(res, &auth)
-	accessToken := auth.AccessToken
-	return accessToken
+type WebPayment struct {
+	PaymentID int
+	Provider string
+	OrderID string
+	Username string
+	Amount string
+	Currency string
+	Promo string
+	Status string
+	Refundable bool
+	CreatedOn string
+	CreatedOnRFC3339 string
+	RefundedOn string
+	RefundedOnRFC3339 string
 }
 
-func IsAdequatePayment(order PayPalOrder) (bool) {
-	var ought = Settings.PayPal.OneTimeCost
+const (
+	PaymentPaid = "paid"
+	PaymentRefunded = "refunded"
+)
+
+// Stands in for a provider on signups that cost nothing
+const FreeProvider = "free"
+
+var PaymentProviderNames = map[string]string{
+	"paypal": "PayPal",
+	"stripe": "Stripe",
+	"mock": "Mock",
+	FreeProvider: "Promo code" }
+
+// How long a customer has to finish paying
+const PendingSignupLifetime = time.Hour
+
+var ErrPaymentRedeemed = errors.New("payment has already been redeemed")
+
+// Enabled providers by name; Settings.Payments.Providers has them in the
+// order they're offered
+var Payments = map[string]PaymentProvider{}
+
+func NewPaymentProviders(c PaymentSettings) (map[string]PaymentProvider, error) {
+	providers := map[string]PaymentProvider{}
+	for _, name := range c.Providers {
+		switch(name) {
+		case "paypal":
+			if Settings.PayPal.MerchantID == "" {
+				return nil, errors.New("paypal needs a MerchantID") }
+			providers[name] = NewPayPalProvider(Settings.PayPal)
+		case "stripe":
+			providers[name] = NewStripeProvider(Settings.Stripe)
+		case "mock":
+			providers[name] = &MockPaymentProvider{
+				refunded: map[string]bool{} }
+		default:
+			return nil, fmt.Errorf("unknown payment provider %q", name)
+		}
+	}
+	if len(providers) == 0 && Settings.Activation.Mode == ActivationPaid {
+		return nil, errors.New("no payment providers configured") }
+	return providers, nil
+}
 
-	var total float64
-	for _, unit := range order.PurchaseUnits {
-		val, _ := strconv.ParseFloat(unit.Amount.Value, 64)
-		total += val
+// What paying for this signup with the order would look like; signups a
+// promo code made free are recorded against the signup token instead.
+// Only this decides a signup is free, never the provider it's handed
+func (p PendingSignup) Payment(provider, orderID string) (Payment) {
+	if provider == FreeProvider { provider = "" }
+	pay := Payment{
+		Provider: provider,
+		OrderID: orderID,
+		Username: p.Username,
+		Amount: p.Amount,
+		Currency: p.Currency,
+		Promo: p.Promo }
+	if pay.Amount <= 0 {
+		pay.Provider = FreeProvider
+		pay.OrderID = p.TokenHash
+		pay.Amount = 0
 	}
-	return total >= ought
+	return pay
 }
 
-func PayPalGet(client http.Client,
-	endpoint string,
-	headers map[string]string,
-	body io.Reader) ([]byte, error) {
-	return DoPayPalRequest(client,
-		http.MethodGet,
-		endpoint,
-		headers,
-		body)
+// Whether the provider agrees the order was paid as recorded
+func (pay Payment) Verify() (bool, error) {
+	if pay.Provider == FreeProvider { return true, nil }
+	provider, ok := Payments[pay.Provider]
+	if !ok || pay.OrderID == "" { return false, nil }
+	return provider.VerifyOrder(pay.OrderID, pay.Amount, pay.Currency)
 }
 
-func PayPalPost(client http.Client,
-	endpoint string,
-	headers map[string]string,
-	body io.Reader) ([]byte, error) {
-	return DoPayPalRequest(client,
-		http.MethodPost,
-		endpoint,
-		headers,
-		body)
+func (pay Payment) Refundable() (bool) {
+	_, ok := Payments[pay.Provider]
+	return ok && pay.Status == PaymentPaid
 }
 
-func DoPayPalRequest(client http.Client,
-	method string,
-	endpoint string,
-	headers map[string]string,
-	body io.Reader) ([]byte, error) {
-
-	if body == nil { body = http.NoBody }
-	req, err := http.NewRequest(method, endpoint, body)
-	if err != nil { panic(err) }
-	for key, val := range headers {
-		req.Header.Set(key, val)
+func (pay *Payment) AsWebEntity() (wp WebPayment) {
+	created, _ := ParseDBDate(pay.CreatedOn)
+
+	wp.PaymentID = pay.PaymentID
+	wp.Provider = PaymentProviderNames[pay.Provider]
+	if wp.Provider == "" { wp.Provider = pay.Provider }
+	wp.OrderID = pay.OrderID
+	if pay.Provider == FreeProvider { wp.OrderID = "" }
+	wp.Username = pay.Username
+	wp.Amount = strconv.FormatFloat(pay.Amount, 'f', 2, 64)
+	wp.Currency = pay.Currency
+	wp.Promo = pay.Promo
+	wp.Status = pay.Status
+	wp.Refundable = pay.Refundable()
+	wp.CreatedOn = WebDate(created)
+	wp.CreatedOnRFC3339 = RFC3339Date(created)
+	if pay.RefundedOn != "" {
+		refunded, _ := ParseDBDate(pay.RefundedOn)
+		wp.RefundedOn = WebDate(refunded)
+		wp.RefundedOnRFC3339 = RFC3339Date(refunded)
 	}
+	return
+}
 
-	resp, err := client.Do(req)
-	if err != nil { panic(err) }
-	defer resp.Body.Close()
-
-	// json.NewDecoder(resp.Body).Decode(&r)
+func (m *MockPaymentProvider) Name() (string) { return "mock" }
 
-	resBody, err := ioutil.ReadAll(resp.Body)
-	return resBody, err
+func (m *MockPaymentProvider) CreateOrder(amount float64, currency string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.next++
+	return fmt.Sprintf("MOCK-%s-%d-%d", currency, Cents(amount), m.next), nil
 }
 
+func (m *MockPaymentProvider) VerifyOrder(orderID string, amount float64, currency string) (bool, error) {
+	var paidCurrency string
+	var cents, n int
+	_, err := fmt.Sscanf(orderID, "MOCK-%3s-%d-%d", &paidCurrency, &cents, &n)
+	if err != nil { return false, nil }
 
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.refunded[orderID] { return false, nil }
+	return paidCurrency == currency && cents == Cents(amount), nil
+}
 
-func PayPalBasicAuth() (string) {
-	auth := []byte(strings.Join([]string{
-		Settings.PayPal.Client,
-		Settings.PayPal.Secret}, ":"))
+func (m *MockPaymentProvider) Refund(orderID string) (error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.refunded[orderID] { return errors.New("mock: order already refunded") }
+	m.refunded[orderID] = true
+	return nil
+}
 
-	return string(base64.StdEncoding.EncodeToString(auth))
+func Cents(amount float64) (int) {
+	return int(math.Round(amount * 100))
 }
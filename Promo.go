@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type Promo struct {
+	Code string
+	Kind string
+	Discount float64
+	MaxRedemptions int
+	Redemptions int
+	Disabled bool
+	Batch string
+	Expires string
+	CreatedOn string
+	// Enabled, not expired and not used up, as of the query
+	Usable bool
+
+	// Taken from the payments made with it
+	Paid int
+	Revenue float64
+	Refunded int
+}
+
+type WebPromo struct {
+	Code string
+	Discount string
+	MaxRedemptions int
+	Redemptions int
+	Disabled bool
+	Usable bool
+	Batch string
+	Expires string
+	ExpiresRFC3339 string
+	CreatedOn string
+	CreatedOnRFC3339 string
+	Paid int
+	Revenue string
+	Refunded int
+}
+
+type AdminPromosPage struct {
+	Promos []WebPromo
+	Created []string
+	Error bool
+	UX *UserExperience
+	Settings *Config }
+
+const (
+	PromoFixed = "fixed"
+	PromoPercent = "percent"
+)
+
+// Left out: letters and digits that are easily mistaken for each other
+const PromoAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+const PromoCodeLength = 10
+const MaxPromoBatch = 1000
+
+func NewPromoCode() (string) { return RandomCode(PromoCodeLength) }
+
+// Made of PromoAlphabet, so it's easy to read out and type back in
+func RandomCode(length int) (string) {
+	code := make([]byte, length)
+	max := big.NewInt(int64(len(PromoAlphabet)))
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil { panic(err) }
+		code[i] = PromoAlphabet[n.Int64()]
+	}
+	return string(code)
+}
+
+// How much comes off the given price
+func (p Promo) Off(price float64) (float64) {
+	off := p.Discount
+	if p.Kind == PromoPercent { off = price * p.Discount / 100 }
+	if off > price { off = price }
+	return off
+}
+
+func (p *Promo) AsWebEntity() (wp WebPromo) {
+	created, _ := ParseDBDate(p.CreatedOn)
+
+	wp.Code = p.Code
+	if p.Kind == PromoPercent {
+		wp.Discount = strconv.FormatFloat(p.Discount, 'f', -1, 64) + "%"
+	} else {
+		wp.Discount = Settings.Payments.DomesticCurrencySigil +
+			strconv.FormatFloat(p.Discount, 'f', 2, 64)
+	}
+	wp.MaxRedemptions = p.MaxRedemptions
+	wp.Redemptions = p.Redemptions
+	wp.Disabled = p.Disabled
+	wp.Usable = p.Usable
+	wp.Batch = p.Batch
+	if p.Expires != "" {
+		expires, _ := ParseDBDate(p.Expires)
+		wp.Expires = WebDate(expires)
+		wp.ExpiresRFC3339 = RFC3339Date(expires)
+	}
+	wp.CreatedOn = WebDate(created)
+	wp.CreatedOnRFC3339 = RFC3339Date(created)
+	wp.Paid = p.Paid
+	wp.Revenue = strconv.FormatFloat(p.Revenue, 'f', 2, 64)
+	wp.Refunded = p.Refunded
+	return
+}
+
+// Promo codes at /admin/promos
+func (ux *UserExperience) HandleAdminPromos(res *ServerRes) {
+	w := res.Writer
+	r := res.Request
+	db := res.DB
+	page := "tmpl/admin-promos.html"
+
+	var created []string
+	procErr := false
+	if r.Method == "POST" {
+		if err := r.ParseForm(); err != nil { panic(err) }
+
+		switch(r.FormValue("action")) {
+		case "create":
+			created, procErr = CreatePromosFromForm(db, r)
+			if !procErr {
+				log.Printf("Admin @%s created %d promo code(s)",
+					ux.Username, len(created))
+			}
+		case "disable", "enable":
+			p := Promo{ Code: r.FormValue("code") }
+			err := p.SetDisabled(db, r.FormValue("action") == "disable")
+			if err != nil {
+				HandleWebError(w, r, http.StatusInternalServerError)
+				log.Println(err)
+				return
+			}
+			log.Printf("Admin @%s %sd promo code %s",
+				ux.Username, r.FormValue("action"), p.Code)
+			http.Redirect(w, r, Settings.Web.Canon + "admin/promos",
+				http.StatusSeeOther)
+			return
+		}
+	}
+
+	promos, err := Promos(db)
+	if err != nil {
+		HandleWebError(w, r, http.StatusServiceUnavailable)
+		log.Println(err)
+		return
+	}
+	var webpromos []WebPromo
+	for _, p := range promos {
+		webpromos = append(webpromos, p.AsWebEntity())
+	}
+
+	err = Templates[page].Execute(w, AdminPromosPage{
+		Promos: webpromos,
+		Created: created,
+		Error: procErr,
+		UX: ux,
+		Settings: &Settings })
+	if err != nil {
+		HandleWebError(w, r, http.StatusInternalServerError)
+		log.Println(err)
+	}
+}
+
+// One named code, or a batch of generated single-use ones
+func CreatePromosFromForm(db *sql.DB, r *http.Request) ([]string, bool) {
+	p := Promo{
+		Kind: r.FormValue("kind"),
+		Batch: strings.TrimSpace(r.FormValue("batch")) }
+	var err error
+	p.Discount, err = strconv.ParseFloat(r.FormValue("discount"), 64)
+	if err != nil || p.Discount <= 0 { return nil, true }
+	if p.Kind != PromoFixed && p.Kind != PromoPercent { return nil, true }
+	if p.Kind == PromoPercent && p.Discount > 100 { return nil, true }
+	p.MaxRedemptions, _ = strconv.Atoi(r.FormValue("max"))
+	if p.MaxRedemptions < 0 { return nil, true }
+	days, _ := strconv.Atoi(r.FormValue("expires"))
+
+	count, _ := strconv.Atoi(r.FormValue("count"))
+	code := strings.ToUpper(strings.TrimSpace(r.FormValue("code")))
+	var codes []string
+	switch {
+	case code != "":
+		codes = []string{ code }
+	case count > 0 && count <= MaxPromoBatch:
+		// Generated codes are for handing out one each
+		p.MaxRedemptions = 1
+		for i := 0; i < count; i++ { codes = append(codes, NewPromoCode()) }
+	default:
+		return nil, true
+	}
+
+	for _, c := range codes {
+		p.Code = c
+		if err := p.Add(db, days); err != nil {
+			log.Println(err)
+			return codes[:0], true
+		}
+	}
+	return codes, false
+}
+
+func PrintPromoReport(db *sql.DB) {
+	promos, err := Promos(db)
+	if err != nil { log.Fatal(err) }
+
+	fmt.Printf("%-16s %-12s %-9s %-10s %5s %10s %8s %s\n", "CODE", "BATCH",
+		"DISCOUNT", "USED", "PAID", "REVENUE", "REFUNDS", "STATE")
+	for _, p := range promos {
+		wp := p.AsWebEntity()
+		used := strconv.Itoa(p.Redemptions)
+		if p.MaxRedemptions > 0 { used += "/" + strconv.Itoa(p.MaxRedemptions) }
+		state := "usable"
+		if p.Disabled {
+			state = "disabled"
+		} else if !p.Usable { state = "used up / expired" }
+		fmt.Printf("%-16s %-12s %-9s %-10s %5d %10s %8d %s\n", p.Code,
+			p.Batch, wp.Discount, used, p.Paid, wp.Revenue, p.Refunded, state)
+	}
+}
@@ -10,7 +10,12 @@ import (
 	"fmt"
 	"strings"
 	"database/sql"
-	_ "golang.org/x/crypto/bcrypt"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"sort"
+	"github.com/skip2/go-qrcode"
 )
 
 var Settings Config
@@ -47,6 +52,10 @@ type UserAddPage struct {
 
 type LoginPage struct {
 	Error *LoginError
+	Next string
+	// Second factors the account has, for /login/2fa
+	TOTP bool
+	Passkeys bool
 	Settings *Config
 	UX *UserExperience }
 
@@ -54,6 +63,9 @@ type UserPage struct {
 	Canon string
 	Settings *Config
 	User WebUserProfile
+	// Whether the visitor can follow this user, and already does
+	CanFollow bool
+	Followed bool
 	UX *UserExperience
 	Title string }
 
@@ -73,9 +85,49 @@ type UserSettingsPage struct {
 	Error *SignupError
 	Title string
 	User WebUserProfile
+	Sessions []WebActiveSession
+	TwoFactor *TwoFactorSettings
+	Passkeys []WebPasskey
+	Email *EmailSettings
 	UX *UserExperience
 	Settings *Config }
 
+type EmailSettings struct {
+	Address string
+	Verified bool
+	Sent bool }
+
+type UserTokensPage struct {
+	Canon string
+	Error *TokenError
+	Title string
+	User WebUserProfile
+	Tokens []WebAPIToken
+	Scopes []string
+	Created string
+	UX *UserExperience
+	Settings *Config }
+
+type TokenError struct {
+	BadName bool
+	BadScope bool
+	BadIPs bool }
+
+type ResetPage struct {
+	Token string
+	Sent bool
+	Error *SignupError
+	UX *UserExperience
+	Settings *Config }
+
+type TwoFactorSettings struct {
+	Enabled bool
+	Pending bool
+	Secret string
+	QRCode template.URL
+	RecoveryCodes []string
+	CodesLeft int }
+
 type SignupError struct {
 	Mismatch bool
 	Taken bool
@@ -83,19 +135,29 @@ type SignupError struct {
 	BadDispName bool
 	ShortPassword bool
 	BadPassword bool
+	BadCode bool
+	BadEmail bool
+	BadToken bool
+	BadInvite bool
+	Throttled bool
 	AlreadyLoggedIn bool }
 
 type AddError struct {
 	URLNoHost bool
 	URLBadScheme bool
 	URLOther bool
+	OverQuota bool
 }
 
 type LoginError struct {
 	DBError bool
-	CredsError bool }
+	CredsError bool
+	Throttled bool
+	Inactive bool
+	Pending bool }
 
 type SignupNewPage struct {
+	Invite string
 	Settings *Config
 	UX *UserExperience
 	Error *SignupError}
@@ -103,25 +165,42 @@ type SignupNewPage struct {
 type SignupCreatePage struct {
 	Username string
 	DisplayName string
-	Password string
-	Promo string
+	Token string
 	Cost float64
+	Providers []string
+	Orders map[string]string
 	UX *UserExperience
 	Settings *Config }
 
 type SignupFreePage struct {
 	Username string
 	DisplayName string
-	Password string
-	Promo string
+	Token string
 	UX *UserExperience
 	Settings *Config }
 
 type SignupReceiptPage struct {
+	Payment *WebPayment
 	UX *UserExperience
 	Settings *Config
 }
 
+type UserReceiptsPage struct {
+	Canon string
+	Title string
+	User WebUserProfile
+	Payments []WebPayment
+	UX *UserExperience
+	Settings *Config }
+
+type AdminPaymentsPage struct {
+	Payments []WebPayment
+	Search string
+	Refunded *WebPayment
+	Error bool
+	UX *UserExperience
+	Settings *Config }
+
 type ServerRes struct {
 	DB *sql.DB
 	Writer http.ResponseWriter
@@ -183,8 +262,8 @@ func (ux *UserExperience) HandleUserReq(res *ServerRes, uname string) {
 	page := "tmpl/user.html"
 
 	user, err := UserByName(db, uname)
-	if err != nil {
-		// User not found...
+	if err != nil || !user.VisibleTo(ux) {
+		// User not found (or not for our eyes)...
 		HandleWebError(w, r, http.StatusNotFound)
 		log.Println(err)
 		return }
@@ -203,16 +282,26 @@ func (ux *UserExperience) HandleUserReq(res *ServerRes, uname string) {
 		log.Println(err)
 		return
 	}
+	if !ux.IsOwner(uname) { marks = marks.Public() }
 
 	webuser:= user.AsWebEntity()
 	webuser.Bookmarks = marks.AsWebEntities()
 	webuser.ThisIsMe = ux.Username == uname
 
+	canFollow := ux.Can(ScopeFull) && !webuser.ThisIsMe
+	followed := false
+	if canFollow {
+		followed, err = UserProfile{ Username: ux.Username }.IsFollowing(db, uname)
+		if err != nil { log.Println(err) }
+	}
+
 	tmpl := Templates[page]
 	err = tmpl.Execute(w, UserPage{
 		Settings: &Settings,
 		Canon: Settings.Web.Canon + "u/" + uname,
 		User: webuser,
+		CanFollow: canFollow,
+		Followed: followed,
 		UX: ux,
 		Title: user.DisplayName + " (" + uname + ") - Bookmarks" })
 
@@ -240,11 +329,77 @@ func (ux *UserExperience) HandleUserSettings(res *ServerRes, uname, option strin
 		return
 	}
 
-	if ux.Username != uname {
+	if ux.Username != uname || !ux.Can(ScopeSession) {
 		HandleWebError(res.Writer, res.Request, http.StatusForbidden)
 		log.Println(err)
 		return }
 
+	if option == "two-factor" {
+		ux.HandleUserTwoFactor(res, user)
+		return
+	}
+
+	if option == "passkeys" {
+		ux.HandleUserPasskeys(res, user)
+		return
+	}
+
+	if option == "email" {
+		ux.HandleUserEmail(res, user)
+		return
+	}
+
+	if option == "tokens" {
+		ux.HandleUserTokens(res, user)
+		return
+	}
+
+	if option == "apps" {
+		ux.HandleUserApps(res, user)
+		return
+	}
+
+	if option == "receipts" {
+		ux.HandleUserReceipts(res, user)
+		return
+	}
+	if option == "plan" {
+		ux.HandleUserPlan(res, user)
+		return
+	}
+	if option == "invites" {
+		ux.HandleUserInvites(res, user)
+		return
+	}
+	if option == "orgs" {
+		ux.HandleUserOrgs(res, user)
+		return
+	}
+	if option == "shares" {
+		ux.HandleUserShares(res, user)
+		return
+	}
+	if option == "feeds" {
+		ux.HandleUserFeeds(res, user)
+		return
+	}
+	if option == "feeds.opml" {
+		ux.HandleUserFeedsOPML(res, user)
+		return
+	}
+	if option == "bookmarks.opml" {
+		ux.HandleUserBookmarksOPML(res, user)
+		return
+	}
+	if option == "save-by-email" {
+		ux.HandleUserMailIn(res, user)
+		return
+	}
+	if option == "webhooks" {
+		ux.HandleUserWebhooks(res, user)
+		return
+	}
+
 	var procErr *SignupError
 	if (res.Request.Method == "POST") {
 		if err := res.Request.ParseForm(); err != nil {
@@ -261,8 +416,12 @@ func (ux *UserExperience) HandleUserSettings(res *ServerRes, uname, option strin
 			if derez == "" {
 				return // TODO: P-R-G
 			}
-			u, err := LetMeIn(res.DB, uname, password)
-			if err != nil {
+			u, err := LetMeInFrom(res.DB, res.Request, uname, password)
+			if err == ErrThrottled {
+				HandleWebError(res.Writer, res.Request,
+					http.StatusTooManyRequests)
+				return
+			} else if err != nil {
 				return // TODO: P-R-G
 			}
 
@@ -281,6 +440,26 @@ func (ux *UserExperience) HandleUserSettings(res *ServerRes, uname, option strin
 			http.Redirect(res.Writer, res.Request,
 				Settings.Web.Canon, http.StatusSeeOther)
 			return
+		case "privacy":
+			visibility := res.Request.FormValue("visibility")
+			if !ValidVisibility(visibility) {
+				HandleWebError(res.Writer, res.Request,
+					http.StatusBadRequest)
+				return
+			}
+			err = user.SetVisibility(res.DB, visibility)
+			if err != nil {
+				log.Println(err)
+				HandleWebError(res.Writer, res.Request,
+					http.StatusInternalServerError)
+				return
+			}
+			log.Printf("User %s (@%s) made their page %s",
+				user.DisplayName, uname, visibility)
+			http.Redirect(res.Writer, res.Request,
+				Settings.Web.Canon + "u/" + uname + "/settings/privacy",
+				http.StatusSeeOther)
+			return
 		case "change-name":
 			newname := res.Request.FormValue("newname")
 
@@ -325,12 +504,17 @@ func (ux *UserExperience) HandleUserSettings(res *ServerRes, uname, option strin
 				break
 			}
 
-			u, err := LetMeIn(res.DB, uname, currpassword)
-			if err != nil {
+			u, err := LetMeInFrom(res.DB, res.Request, uname, currpassword)
+			if err == ErrThrottled {
+				res.Writer.WriteHeader(http.StatusTooManyRequests)
+				procErr = &SignupError{ Throttled: true }
+				break
+			} else if err != nil {
 				procErr = &SignupError{ BadPassword: true }
 				break
 			}
 
+			// Changing the password signs out every session...
 			err = u.NewPassword(res.DB, newpassword)
 			if err != nil {
 				log.Println(err)
@@ -339,10 +523,45 @@ func (ux *UserExperience) HandleUserSettings(res *ServerRes, uname, option strin
 				return
 			}
 
+			// ...except for the one which asked for the change
+			ThisSession(res.Request).Associate(res.DB, uname, res.Request)
+
 			log.Printf("User %s (@%s) changed their password!",
 				u.DisplayName, uname)
 			http.Redirect(res.Writer, res.Request,
 				Settings.Web.Canon + "/u/" + uname, http.StatusSeeOther)
+		case "sessions":
+			revoke := res.Request.FormValue("revoke")
+			everywhere := res.Request.FormValue("revoke-others")
+
+			if everywhere != "" {
+				err = user.DeleteOtherSessions(res.DB, ux.SessID)
+				if err != nil {
+					log.Println(err)
+					HandleWebError(res.Writer, res.Request,
+						http.StatusInternalServerError)
+					return
+				}
+				log.Printf("User %s (@%s) signed out everywhere else",
+					user.DisplayName, uname)
+			} else if revoke != "" {
+				sessions, err := user.Sessions(res.DB)
+				if err != nil {
+					log.Println(err)
+					HandleWebError(res.Writer, res.Request,
+						http.StatusInternalServerError)
+					return
+				}
+				for _, s := range sessions {
+					if SessionHandle(s.SessID) != revoke { continue }
+					WebSession{ SessID: s.SessID }.Disassociate(res.DB)
+				}
+			}
+
+			http.Redirect(res.Writer, res.Request,
+				Settings.Web.Canon + "u/" + uname + "/settings/sessions",
+				http.StatusSeeOther)
+			return
 		}
 	}
 
@@ -354,8 +573,29 @@ func (ux *UserExperience) HandleUserSettings(res *ServerRes, uname, option strin
 		page = "tmpl/user-change-password.html"
 	case "derez":
 		page = "tmpl/user-derez.html"
+	case "sessions":
+		page = "tmpl/user-sessions.html"
+	case "privacy":
+		page = "tmpl/user-privacy.html"
 	case "":
 		page = "tmpl/user-settings.html"
+	default:
+		HandleWebError(res.Writer, res.Request, http.StatusNotFound)
+		return
+	}
+
+	var websessions []WebActiveSession
+	if option == "sessions" {
+		sessions, err := user.Sessions(res.DB)
+		if err != nil {
+			HandleWebError(res.Writer, res.Request,
+				http.StatusServiceUnavailable)
+			log.Println(err)
+			return
+		}
+		for _, s := range sessions {
+			websessions = append(websessions, s.AsWebEntity(ux.SessID))
+		}
 	}
 
 	tmpl := Templates[page]
@@ -366,6 +606,7 @@ func (ux *UserExperience) HandleUserSettings(res *ServerRes, uname, option strin
 		Canon: Settings.Web.Canon + "u/" + uname,
 		Error: procErr,
 		User: webuser,
+		Sessions: websessions,
 		Title: user.DisplayName + " (" + uname + ") - Settings",
 		UX: ux,
 		Settings: &Settings })
@@ -395,9 +636,14 @@ func (ux *UserExperience) HandleUserAdd(res *ServerRes, uname string) {
 		return }
 
 	if (res.Request.Method == "POST") {
+		if !ux.Can(ScopeAdd) {
+			HandleWebError(res.Writer, res.Request, http.StatusForbidden)
+			return
+		}
 		if err := res.Request.ParseForm(); err != nil { panic(err) }
 		name := res.Request.FormValue("name")
 		url := res.Request.FormValue("url")
+		private := res.Request.FormValue("private") != ""
 
 		if uErr := IsURL(url); uErr != nil {
 			if uErr.(*URLError).BadScheme {
@@ -407,18 +653,28 @@ func (ux *UserExperience) HandleUserAdd(res *ServerRes, uname string) {
 			} else {
 				procErr = AddError{ URLOther: true }
 			}
+		} else if room, err := user.CanAddBookmark(res.DB); err != nil {
+			HandleWebError(res.Writer, res.Request,
+				http.StatusServiceUnavailable)
+			log.Println(err)
+			return
+		} else if !room {
+			procErr = AddError{ OverQuota: true }
 		} else {
 			b := Bookmark{
 				Username: uname,
 				Title: name,
-				URL: url }
-			err = b.Add(res.DB)
+				URL: url,
+				Private: private }
+			b.BId, err = b.AddWithID(res.DB)
 				if err != nil {
 					HandleWebError(res.Writer, res.Request,
 						http.StatusInternalServerError)
 					log.Println(err)
 					return
 				}
+			b.Unread = true
+			QueueWebhooks(res.DB, uname, WebhookAdded, b)
 			http.Redirect(res.Writer, res.Request, "/u/" + uname, http.StatusSeeOther)
 			return
 		}
@@ -445,8 +701,8 @@ func (ux *UserExperience) HandleUserAdd(res *ServerRes, uname string) {
 func (ux *UserExperience) HandleUserViewArchive(res *ServerRes, uname string) {
 	page := "tmpl/user-archive.html"
 	user, err := UserByName(res.DB, uname)
-	if err != nil {
-		// User not found...
+	if err != nil || !user.VisibleTo(ux) {
+		// User not found (or not for our eyes)...
 		HandleWebError(res.Writer, res.Request,
 			http.StatusNotFound)
 		return }
@@ -466,6 +722,7 @@ func (ux *UserExperience) HandleUserViewArchive(res *ServerRes, uname string) {
 		log.Println(err)
 		return
 	}
+	if !ux.IsOwner(uname) { marks = marks.Public() }
 
 	webuser:= user.AsWebEntity()
 	webuser.Bookmarks = marks.AsWebEntities()
@@ -494,14 +751,24 @@ func (ux *UserExperience) HandleOut(res *ServerRes, bID int) {
 		return
 	}
 
-	if ux.Username == mark.Username {
+	// Others only follow links they could have seen on the owner's page
+	if !ux.IsOwner(mark.Username) {
+		owner, err := UserByName(res.DB, mark.Username)
+		if err != nil || mark.Private || !owner.VisibleTo(ux) {
+			HandleWebError(res.Writer, res.Request,
+				http.StatusNotFound)
+			return
+		}
+	}
+
+	if ux.Username == mark.Username && ux.Can(ScopeFull) {
 		mark.MarkRead(res.DB)
 	}
 	http.Redirect(res.Writer, res.Request, mark.URL, http.StatusSeeOther)
 }
 
 func (ux *UserExperience) HandleBMarkAction(res *ServerRes, uname string, bID int, action string) {
-	if ux.Username != uname {
+	if ux.Username != uname || !ux.Can(ScopeFull) {
 		HandleWebError(res.Writer, res.Request, http.StatusForbidden)
 		return
 	}
@@ -517,25 +784,32 @@ func (ux *UserExperience) HandleBMarkAction(res *ServerRes, uname string, bID in
 		return
 	}
 
+	var event string
 	switch(action) {
 		case "read":
 			mark.MarkRead(res.DB)
+			mark.Unread, event = false, WebhookRead
 		case "unread":
 			mark.MarkUnread(res.DB)
+			mark.Unread, event = true, WebhookUnread
 		case "edit":
 			ux.HandleUserEdit(res, mark)
 			return
 		case "unarchive":
 			mark.Unarchive(res.DB)
+			mark.Archived, event = false, WebhookUnarchived
 		case "archive":
 			mark.Archive(res.DB)
+			mark.Archived, event = true, WebhookArchived
 		case "remove":
 			mark.Del(res.DB)
+			event = WebhookRemoved
 		default:
 			HandleWebError(res.Writer, res.Request,
 				http.StatusMethodNotAllowed)
 			return
 	}
+	QueueWebhooks(res.DB, uname, event, mark)
 	http.Redirect(res.Writer, res.Request, "/u/" + uname, http.StatusSeeOther)
 }
 
@@ -562,6 +836,7 @@ func (ux *UserExperience) HandleUserEdit(res *ServerRes, mark Bookmark) {
 
 		mark.Title = name
 		mark.URL = url
+		mark.Private = res.Request.FormValue("private") != ""
 		err = mark.Edit(res.DB)
 
 		if err != nil {
@@ -569,6 +844,7 @@ func (ux *UserExperience) HandleUserEdit(res *ServerRes, mark Bookmark) {
 				http.StatusInternalServerError)
 			return
 		}
+		QueueWebhooks(res.DB, uname, WebhookEdited, mark)
 		http.Redirect(res.Writer, res.Request, "/u/" + uname, http.StatusSeeOther)
 		return
 	}
@@ -596,28 +872,63 @@ func (ux *UserExperience) HandleLogin(res *ServerRes, e *LoginError) {
 	page := "tmpl/login.html"
 	tmpl := Templates[page]
 
+	next := SafeNext(r)
+
 	// Handle login attempts
 	if e == nil && r.Method == "POST" {
 		if err := r.ParseForm(); err != nil { panic(err) }
 		username := strings.ToLower(r.FormValue("username"))
 		password := r.FormValue("password")
 
-		u, err := LetMeIn(db, username, password)
-		if err != nil {
+		u, err := LetMeInFrom(db, r, username, password)
+		if err == ErrThrottled {
+			w.WriteHeader(http.StatusTooManyRequests)
+			ux.HandleLogin(res, &LoginError{Throttled: true})
+			return
+		} else if err == ErrPendingApproval {
+			w.WriteHeader(http.StatusForbidden)
+			ux.HandleLogin(res, &LoginError{Pending: true})
+			return
+		} else if err == ErrInactive {
+			w.WriteHeader(http.StatusForbidden)
+			ux.HandleLogin(res, &LoginError{Inactive: true})
+			return
+		} else if err != nil {
 			w.WriteHeader(http.StatusUnauthorized)
 			ux.HandleLogin(res, &LoginError{CredsError: true})
 			return
 		}
 
+		keys, err := u.Passkeys(db)
+		if err != nil {
+			HandleWebError(w, r, http.StatusServiceUnavailable)
+			log.Println(err)
+			return
+		}
+
 		ws := ThisSession(r)
-		ws.Associate(db, u.Username)
+		if u.TOTPEnabled || len(keys) > 0 {
+			// Password was fine but there's one more step
+			err = ws.Challenge(db, u.Username)
+			if err != nil {
+				HandleWebError(w, r, http.StatusInternalServerError)
+				log.Println(err)
+				return
+			}
+			http.Redirect(w, r, "/login/2fa?next=" + url.QueryEscape(next),
+				http.StatusSeeOther)
+			return
+		}
+		ws.Associate(db, u.Username, r)
 
-		http.Redirect(res.Writer, res.Request, "/u/" + username, http.StatusSeeOther)
+		if next == "" { next = "/u/" + username }
+		http.Redirect(res.Writer, res.Request, next, http.StatusSeeOther)
 		return
 	}
 
 	err := tmpl.Execute(w, LoginPage{
 		Error: e,
+		Next: next,
 		UX: ux,
 		Settings: &Settings })
 	if err != nil {
@@ -625,99 +936,858 @@ func (ux *UserExperience) HandleLogin(res *ServerRes, e *LoginError) {
 	}
 }
 
-func HandleStatic(res *ServerRes) {
+// 2nd login step for accounts with TOTP enabled or passkeys registered
+func (ux *UserExperience) HandleLoginTOTP(res *ServerRes, e *LoginError) {
 	w := res.Writer
 	r := res.Request
-	filename := "static/" + strings.TrimPrefix(
-		r.URL.Path, "/static/")
-	stat, err := os.Stat(filename)
+	db := res.DB
+	page := "tmpl/login-2fa.html"
+	tmpl := Templates[page]
+
+	ws := ThisSession(r)
+	username, err := ws.Challenged(db)
 	if err != nil {
-		HandleWebError(w, r, http.StatusNotFound)
+		// Never entered a password (or took too long)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
 
-	file, err := os.Open(filename)
+	u, err := UserByName(db, username)
+	var keys []Passkey
+	if err == nil { keys, err = u.Passkeys(db) }
 	if err != nil {
-		HandleWebError(w, r, http.StatusNotFound)
+		HandleWebError(w, r, http.StatusServiceUnavailable)
+		log.Println(err)
 		return
 	}
 
-	modifiedTime := stat.ModTime()
-	http.ServeContent(w, r, filename, modifiedTime, file)
-}
+	if e == nil && r.Method == "POST" {
+		if err := r.ParseForm(); err != nil { panic(err) }
+		code := r.FormValue("code")
 
-func (ux *UserExperience) HandleInfo(res *ServerRes, which string) {
-	var page string
-	switch(which) {
-	case "about":
-		page = "tmpl/about.html"
-	case "privacy":
-		page = "tmpl/privacy.html"
-	case "mission":
-		page = "tmpl/mission.html"
-	case "technology":
-		page = "tmpl/technology.html"
+		err := u.VerifySecondFactorFrom(db, r, code)
+		if err == ErrThrottled {
+			w.WriteHeader(http.StatusTooManyRequests)
+			ux.HandleLoginTOTP(res, &LoginError{Throttled: true})
+			return
+		} else if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			ux.HandleLoginTOTP(res, &LoginError{CredsError: true})
+			return
+		}
+
+		ws.ClearChallenge(db)
+		ws.Associate(db, u.Username, r)
+
+		next := SafeNext(r)
+		if next == "" { next = "/u/" + u.Username }
+		http.Redirect(w, r, next, http.StatusSeeOther)
+		return
 	}
-	Templates[page].Execute(res.Writer, InfoPage{
+
+	err = tmpl.Execute(w, LoginPage{
+		Error: e,
+		Next: SafeNext(r),
+		TOTP: u.TOTPEnabled,
+		Passkeys: len(keys) > 0,
 		UX: ux,
 		Settings: &Settings })
+	if err != nil {
+		HandleWebError(w, r, http.StatusInternalServerError)
+	}
 }
 
-// 1st step in acc creation...
-func (ux *UserExperience) HandleSignupNew(res *ServerRes, e *SignupError) {
+// TOTP enrollment and removal at /u/{USER}/settings/two-factor
+func (ux *UserExperience) HandleUserTwoFactor(res *ServerRes, user UserProfile) {
 	w := res.Writer
 	r := res.Request
-	page := "tmpl/signup-new.html"
+	db := res.DB
+	uname := user.Username
+	page := "tmpl/user-two-factor.html"
+	here := Settings.Web.Canon + "u/" + uname + "/settings/two-factor"
+
+	var procErr *SignupError
+	var codes []string
+	if r.Method == "POST" {
+		if err := r.ParseForm(); err != nil { panic(err) }
+		action := r.FormValue("action")
+		code := r.FormValue("code")
+		password := r.FormValue("password")
+
+		var err error
+		switch(action) {
+		case "begin":
+			if user.TOTPEnabled { break }
+			err = user.SetTOTPSecret(db, NewTOTPSecret())
+			if err != nil { break }
+			http.Redirect(w, r, here, http.StatusSeeOther)
+			return
+		case "verify":
+			if user.TOTPEnabled || user.TOTPSecret == "" { break }
+			step, ok := CheckTOTP(user.TOTPSecret, code, 0)
+			if !ok {
+				procErr = &SignupError{ BadCode: true }
+				break
+			}
+			err = user.EnableTOTP(db, step)
+			if err != nil { break }
+			codes, err = user.NewRecoveryCodes(db)
+			if err != nil { break }
+
+			log.Printf("User %s (@%s) enabled two-factor auth",
+				user.DisplayName, uname)
+		case "recovery-codes":
+			if !user.TOTPEnabled { break }
+			if e := user.VerifySecondFactorFrom(db, r, code); e != nil {
+				procErr = &SignupError{ BadCode: e != ErrThrottled,
+					Throttled: e == ErrThrottled }
+				break
+			}
+			codes, err = user.NewRecoveryCodes(db)
+		case "disable":
+			// Both factors again before we take one away
+			if _, e := LetMeInFrom(db, r, uname, password); e != nil {
+				procErr = &SignupError{ BadPassword: e != ErrThrottled,
+					Throttled: e == ErrThrottled }
+				break
+			}
+			if e := user.VerifySecondFactorFrom(db, r, code); e != nil {
+				procErr = &SignupError{ BadCode: e != ErrThrottled,
+					Throttled: e == ErrThrottled }
+				break
+			}
+			err = user.DisableTOTP(db)
+			if err != nil { break }
+
+			log.Printf("User %s (@%s) disabled two-factor auth",
+				user.DisplayName, uname)
+			http.Redirect(w, r, here, http.StatusSeeOther)
+			return
+		}
+		if err != nil {
+			HandleWebError(w, r, http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		// Pick up whatever we just changed
+		user, _ = UserByName(db, uname)
+	}
+
+	settings := &TwoFactorSettings{
+		Enabled: user.TOTPEnabled,
+		Pending: !user.TOTPEnabled && user.TOTPSecret != "",
+		RecoveryCodes: codes }
+	if settings.Pending {
+		settings.Secret = user.TOTPSecret
+		png, err := qrcode.Encode(TOTPURI(user.TOTPSecret, uname),
+			qrcode.Medium, 256)
+		if err == nil {
+			settings.QRCode = template.URL("data:image/png;base64," +
+				base64.StdEncoding.EncodeToString(png))
+		}
+	}
+	if settings.Enabled {
+		settings.CodesLeft, _ = user.RecoveryCodesLeft(db)
+	}
 
 	tmpl := Templates[page]
-	err := tmpl.Execute(w, SignupNewPage{
+	webuser := user.AsWebEntity()
+	webuser.ThisIsMe = true
+
+	err := tmpl.Execute(w, UserSettingsPage{
+		Canon: Settings.Web.Canon + "u/" + uname,
+		Error: procErr,
+		User: webuser,
+		TwoFactor: settings,
+		Title: user.DisplayName + " (" + uname + ") - Two-Factor Auth",
 		UX: ux,
-		Error: e,
 		Settings: &Settings })
 	if err != nil {
 		HandleWebError(w, r, http.StatusInternalServerError)
+		log.Println(err)
 	}
 }
 
-// 2nd step in acc creation...
-func (ux *UserExperience) HandleSignupCreate(res *ServerRes) {
+// Name / delete passkeys at /u/{USER}/settings/passkeys (registering happens
+// over /webauthn from the same page)
+func (ux *UserExperience) HandleUserPasskeys(res *ServerRes, user UserProfile) {
 	w := res.Writer
 	r := res.Request
 	db := res.DB
+	uname := user.Username
+	page := "tmpl/user-passkeys.html"
+	here := Settings.Web.Canon + "u/" + uname + "/settings/passkeys"
 
-	// Parse form submission
-	if (r.Method != "POST") {
-		http.Redirect(w, r, "/signup/new", http.StatusFound)
+	if r.Method == "POST" {
+		if err := r.ParseForm(); err != nil { panic(err) }
+		p := Passkey{
+			CredID: r.FormValue("credid"),
+			Username: uname }
+
+		var err error
+		switch(r.FormValue("action")) {
+		case "rename":
+			name := strings.TrimSpace(r.FormValue("name"))
+			if name == "" || !ValidDisplayName(name) { break }
+			err = p.Rename(db, name)
+		case "delete":
+			err = p.Del(db)
+			log.Printf("User %s (@%s) deleted a passkey",
+				user.DisplayName, uname)
+		}
+		if err != nil {
+			HandleWebError(w, r, http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		http.Redirect(w, r, here, http.StatusSeeOther)
 		return
 	}
-	if err := r.ParseForm(); err != nil { panic(err) }
-
-	username := strings.ToLower(r.FormValue("username"))
-	displayname := r.FormValue("displayname")
-	password := r.FormValue("password")
-	confirmpassword := r.FormValue("confirmpassword")
-	promo := r.FormValue("promo")
 
-	if displayname == "" { displayname = username }
-
-	if !ValidPassword(password) {
-		w.WriteHeader(http.StatusUnprocessableEntity)
-		ux.HandleSignupNew(res, &SignupError{ShortPassword: true})
+	keys, err := user.Passkeys(db)
+	if err != nil {
+		HandleWebError(w, r, http.StatusServiceUnavailable)
+		log.Println(err)
 		return
 	}
-
-	if !ValidUsername(username) {
-		w.WriteHeader(http.StatusUnprocessableEntity)
-		ux.HandleSignupNew(res, &SignupError{BadUName: true})
-		return
+	var webkeys []WebPasskey
+	for _, p := range keys {
+		webkeys = append(webkeys, p.AsWebEntity())
 	}
 
-	existing, err := UserByName(db, username)
-	if err == nil && existing.Username == username {
-		w.WriteHeader(http.StatusConflict)
-		ux.HandleSignupNew(res, &SignupError{Taken: true})
-		return
-	}
+	tmpl := Templates[page]
+	webuser := user.AsWebEntity()
+	webuser.ThisIsMe = true
+
+	err = tmpl.Execute(w, UserSettingsPage{
+		Canon: Settings.Web.Canon + "u/" + uname,
+		User: webuser,
+		Passkeys: webkeys,
+		Title: user.DisplayName + " (" + uname + ") - Passkeys",
+		UX: ux,
+		Settings: &Settings })
+	if err != nil {
+		HandleWebError(w, r, http.StatusInternalServerError)
+		log.Println(err)
+	}
+}
+
+// Named, scoped API tokens at /u/{USER}/settings/tokens
+func (ux *UserExperience) HandleUserTokens(res *ServerRes, user UserProfile) {
+	w := res.Writer
+	r := res.Request
+	db := res.DB
+	uname := user.Username
+	page := "tmpl/user-tokens.html"
+	here := Settings.Web.Canon + "u/" + uname + "/settings/tokens"
+
+	var procErr *TokenError
+	var created string
+	if r.Method == "POST" {
+		if err := r.ParseForm(); err != nil { panic(err) }
+
+		switch(r.FormValue("action")) {
+		case "create":
+			name := strings.TrimSpace(r.FormValue("name"))
+			scope := r.FormValue("scope")
+			days, _ := strconv.Atoi(r.FormValue("expires"))
+			ips, okIPs := ParseAllowedIPs(r.FormValue("ips"))
+
+			if name == "" || !ValidDisplayName(name) {
+				procErr = &TokenError{ BadName: true }
+			} else if !ValidScope(scope) {
+				procErr = &TokenError{ BadScope: true }
+			} else if !okIPs {
+				procErr = &TokenError{ BadIPs: true }
+			} else {
+				token, err := user.AddAPIToken(db, APIToken{
+					Name: name,
+					Scope: scope,
+					AllowedIPs: ips }, days)
+				if err != nil {
+					HandleWebError(w, r, http.StatusInternalServerError)
+					log.Println(err)
+					return
+				}
+				log.Printf("User @%s created %s API token \"%s\"",
+					uname, scope, name)
+				created = token
+			}
+		case "revoke":
+			id, _ := strconv.Atoi(r.FormValue("tokenid"))
+			err := APIToken{ TokenID: id, Username: uname }.Revoke(db)
+			if err != nil {
+				HandleWebError(w, r, http.StatusInternalServerError)
+				log.Println(err)
+				return
+			}
+			http.Redirect(w, r, here, http.StatusSeeOther)
+			return
+		}
+	}
+
+	tokens, err := user.APITokens(db)
+	if err != nil {
+		HandleWebError(w, r, http.StatusServiceUnavailable)
+		log.Println(err)
+		return
+	}
+	var webtokens []WebAPIToken
+	for _, t := range tokens {
+		webtokens = append(webtokens, t.AsWebEntity())
+	}
+
+	webuser := user.AsWebEntity()
+	webuser.ThisIsMe = true
+
+	err = Templates[page].Execute(w, UserTokensPage{
+		Canon: Settings.Web.Canon + "u/" + uname,
+		Error: procErr,
+		User: webuser,
+		Tokens: webtokens,
+		Scopes: APIScopes,
+		Created: created,
+		Title: user.DisplayName + " (" + uname + ") - API Tokens",
+		UX: ux,
+		Settings: &Settings })
+	if err != nil {
+		HandleWebError(w, r, http.StatusInternalServerError)
+		log.Println(err)
+	}
+}
+
+// Add / change the address used for password resets at
+// /u/{USER}/settings/email
+func (ux *UserExperience) HandleUserEmail(res *ServerRes, user UserProfile) {
+	w := res.Writer
+	r := res.Request
+	db := res.DB
+	uname := user.Username
+	page := "tmpl/user-email.html"
+
+	var procErr *SignupError
+	sent := false
+	if r.Method == "POST" {
+		if err := r.ParseForm(); err != nil { panic(err) }
+		email := strings.TrimSpace(r.FormValue("email"))
+
+		// Whoever controls this address can reset the password, so a
+		// session alone isn't enough to change it
+		_, e := LetMeInFrom(db, r, uname, r.FormValue("password"))
+		if e != nil {
+			procErr = &SignupError{ BadPassword: e != ErrThrottled,
+				Throttled: e == ErrThrottled }
+		} else if !ValidEmail(email) {
+			procErr = &SignupError{ BadEmail: true }
+		} else if err := user.SetEmail(db, email); err == ErrEmailTaken {
+			procErr = &SignupError{ Taken: true }
+		} else {
+			if err == nil { err = user.SendVerification(db, email) }
+			if err != nil {
+				HandleWebError(w, r, http.StatusInternalServerError)
+				log.Println(err)
+				return
+			}
+			if user.EmailVerified && !strings.EqualFold(user.Email, email) {
+				if err := user.SendEmailChanged(user.Email); err != nil {
+					log.Println(err) }
+			}
+			user.Email, user.EmailVerified = email, false
+			sent = true
+		}
+	}
+
+	tmpl := Templates[page]
+	webuser := user.AsWebEntity()
+	webuser.ThisIsMe = true
+
+	err := tmpl.Execute(w, UserSettingsPage{
+		Canon: Settings.Web.Canon + "u/" + uname,
+		Error: procErr,
+		User: webuser,
+		Email: &EmailSettings{
+			Address: user.Email,
+			Verified: user.EmailVerified,
+			Sent: sent },
+		Title: user.DisplayName + " (" + uname + ") - E-mail",
+		UX: ux,
+		Settings: &Settings })
+	if err != nil {
+		HandleWebError(w, r, http.StatusInternalServerError)
+		log.Println(err)
+	}
+}
+
+func (u UserProfile) SendVerification(db *sql.DB, email string) (error) {
+	token, err := u.NewMailToken(db, MailTokenVerify, email)
+	if err != nil { return err }
+
+	return Mail.Send(email, "Confirm your e-mail address",
+		"Hi " + u.DisplayName + ",\n\n" +
+		"Follow this link to confirm this address for your " +
+		"BookmarkWarrior account (@" + u.Username + "):\n\n" +
+		Settings.Web.Canon + "verify-email/" + token + "\n\n" +
+		"If you didn't ask for this you can ignore this message.\n")
+}
+
+// Heads-up to the address that's being replaced, in case it wasn't the owner
+func (u UserProfile) SendEmailChanged(old string) (error) {
+	return Mail.Send(old, "Your e-mail address was changed",
+		"Hi " + u.DisplayName + ",\n\n" +
+		"Someone signed in to your BookmarkWarrior account (@" +
+		u.Username + ") asked to stop using this address for it. " +
+		"Password reset links will go to the new address once it's " +
+		"confirmed.\n\n" +
+		"If that wasn't you, sign in and change your password and " +
+		"e-mail address right away:\n\n" +
+		Settings.Web.Canon + "login\n")
+}
+
+// Link from the verification e-mail at /verify-email/{TOKEN}
+func (ux *UserExperience) HandleVerifyEmail(res *ServerRes, token string) {
+	w := res.Writer
+	r := res.Request
+	db := res.DB
+
+	uname, email, err := MailTokenOwner(db, token, MailTokenVerify)
+	if err != nil {
+		HandleWebError(w, r, http.StatusNotFound)
+		return
+	}
+	if ok, err := ConsumeMailToken(db, token); err != nil || !ok {
+		HandleWebError(w, r, http.StatusNotFound)
+		return
+	}
+
+	err = UserProfile{ Username: uname }.VerifyEmail(db, email)
+	if err == ErrEmailTaken {
+		HandleWebError(w, r, http.StatusConflict)
+		log.Printf("@%s can't confirm an address another account has",
+			uname)
+		return
+	} else if err != nil {
+		HandleWebError(w, r, http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	log.Printf("User @%s verified their e-mail address", uname)
+
+	if ux.Username == uname {
+		http.Redirect(w, r, Settings.Web.Canon + "u/" + uname +
+			"/settings/email", http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, Settings.Web.Canon + "login", http.StatusSeeOther)
+}
+
+// Ask for a reset link at /reset; the same answer is given whether or not
+// the account exists
+func (ux *UserExperience) HandleResetRequest(res *ServerRes) {
+	w := res.Writer
+	r := res.Request
+	db := res.DB
+	page := "tmpl/reset-request.html"
+
+	var procErr *SignupError
+	sent := false
+	if r.Method == "POST" {
+		if err := r.ParseForm(); err != nil { panic(err) }
+		who := strings.TrimSpace(r.FormValue("who"))
+
+		var u UserProfile
+		var err error
+		if strings.Contains(who, "@") {
+			u, err = UserByEmail(db, who)
+		} else {
+			u, err = UserByName(db, strings.ToLower(who))
+			if err == nil && !u.EmailVerified {
+				err = errors.New("No verified e-mail address") }
+		}
+
+		// Every request counts, found or not, so this gives nothing away
+		// and nobody can fill an inbox (or our sending quota) with links
+		to := who
+		if err == nil { to = u.Email }
+		keys := ResetKeys(to, r)
+		if Limiter.Wait(keys...) > 0 {
+			procErr = &SignupError{ Throttled: true }
+		} else {
+			Limiter.Failed(keys...)
+			if err == nil {
+				err = u.SendReset(db)
+				if err != nil { log.Println(err) }
+			}
+			sent = true
+		}
+	}
+
+	err := Templates[page].Execute(w, ResetPage{
+		Sent: sent,
+		Error: procErr,
+		UX: ux,
+		Settings: &Settings })
+	if err != nil {
+		HandleWebError(w, r, http.StatusInternalServerError)
+	}
+}
+
+func (u UserProfile) SendReset(db *sql.DB) (error) {
+	token, err := u.NewMailToken(db, MailTokenReset, u.Email)
+	if err != nil { return err }
+
+	log.Printf("Sending password reset for @%s", u.Username)
+	return Mail.Send(u.Email, "Reset your password",
+		"Hi " + u.DisplayName + ",\n\n" +
+		"Somebody (hopefully you) asked to reset the password for " +
+		"your BookmarkWarrior account (@" + u.Username + "); follow " +
+		"this link to choose a new one:\n\n" +
+		Settings.Web.Canon + "reset/" + token + "\n\n" +
+		"The link works once and expires in " +
+		strconv.Itoa(Settings.Mail.TokenExpiryMinutes) + " minutes. " +
+		"If you didn't ask for this you can ignore this message.\n")
+}
+
+// Choose a new password at /reset/{TOKEN}
+func (ux *UserExperience) HandleResetPassword(res *ServerRes, token string) {
+	w := res.Writer
+	r := res.Request
+	db := res.DB
+	page := "tmpl/reset-password.html"
+
+	var procErr *SignupError
+	uname, _, err := MailTokenOwner(db, token, MailTokenReset)
+	if err != nil {
+		procErr = &SignupError{ BadToken: true }
+	} else if r.Method == "POST" {
+		if err := r.ParseForm(); err != nil { panic(err) }
+		newpassword := r.FormValue("newpassword")
+		confirmpassword := r.FormValue("confirmpassword")
+
+		if newpassword != confirmpassword {
+			procErr = &SignupError{ Mismatch: true }
+		} else if !ValidPassword(newpassword) {
+			procErr = &SignupError{ ShortPassword: true }
+		} else if ok, err := ConsumeMailToken(db, token); err != nil || !ok {
+			procErr = &SignupError{ BadToken: true }
+		} else {
+			u, err := UserByName(db, uname)
+			if err == nil { err = u.NewPassword(db, newpassword) }
+			if err == nil { err = u.DeleteMailTokens(db, MailTokenReset) }
+			if err != nil {
+				HandleWebError(w, r, http.StatusInternalServerError)
+				log.Println(err)
+				return
+			}
+
+			log.Printf("User %s (@%s) reset their password",
+				u.DisplayName, uname)
+			http.Redirect(w, r, Settings.Web.Canon + "login",
+				http.StatusSeeOther)
+			return
+		}
+	}
+
+	if procErr != nil && procErr.BadToken {
+		w.WriteHeader(http.StatusNotFound)
+	}
+	err = Templates[page].Execute(w, ResetPage{
+		Token: token,
+		Error: procErr,
+		UX: ux,
+		Settings: &Settings })
+	if err != nil {
+		HandleWebError(w, r, http.StatusInternalServerError)
+	}
+}
+
+// JSON half of passkey registration and sign-in at
+// /webauthn/{register,login}/{begin,finish}
+func (ux *UserExperience) HandleWebAuthn(res *ServerRes, ceremony, step string) {
+	w := res.Writer
+	r := res.Request
+	db := res.DB
+	ws := ThisSession(r)
+
+	if r.Method != "POST" {
+		HandleWebError(w, r, http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch(ceremony + "/" + step) {
+	case "register/begin":
+		if !ux.Can(ScopeSession) {
+			HandleWebError(w, r, http.StatusForbidden)
+			return
+		}
+		u, err := UserByName(db, ux.Username)
+		if err != nil { panic(err) }
+		keys, err := u.Passkeys(db)
+		if err != nil {
+			HandleWebError(w, r, http.StatusServiceUnavailable)
+			log.Println(err)
+			return
+		}
+
+		challenge := NewWebAuthnChallenge()
+		err = ws.SetWebAuthnChallenge(db, challenge, u.Username)
+		if err != nil {
+			HandleWebError(w, r, http.StatusServiceUnavailable)
+			log.Println(err)
+			return
+		}
+		WriteJSON(w, WebAuthnCreationOptions(u, challenge, keys))
+	case "register/finish":
+		if !ux.Can(ScopeSession) {
+			HandleWebError(w, r, http.StatusForbidden)
+			return
+		}
+		var cred WebAuthnCredential
+		if json.NewDecoder(r.Body).Decode(&cred) != nil {
+			HandleWebError(w, r, http.StatusBadRequest)
+			return
+		}
+
+		challenge, uname, err := ws.TakeWebAuthnChallenge(db)
+		if err != nil || uname != ux.Username {
+			HandleWebError(w, r, http.StatusForbidden)
+			return
+		}
+
+		clientData, err := b64url.DecodeString(cred.Response.ClientDataJSON)
+		if err == nil {
+			err = VerifyClientData(clientData, "webauthn.create", challenge) }
+		var attestation []byte
+		if err == nil {
+			attestation, err = b64url.DecodeString(
+				cred.Response.AttestationObject) }
+		var ad AuthenticatorData
+		if err == nil { ad, err = ParseAttestationObject(attestation) }
+		if err != nil {
+			HandleWebError(w, r, http.StatusBadRequest)
+			log.Println(err)
+			return
+		}
+
+		name := strings.TrimSpace(cred.Name)
+		if name == "" || !ValidDisplayName(name) { name = "Passkey" }
+		p := Passkey{
+			CredID: b64url.EncodeToString(ad.CredID),
+			Username: uname,
+			Name: name,
+			PublicKey: ad.PublicKey,
+			SignCount: ad.SignCount }
+		err = p.Add(db)
+		if err != nil {
+			HandleWebError(w, r, http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		log.Printf("User @%s registered passkey \"%s\"", uname, name)
+		WriteJSON(w, map[string]bool{ "ok": true })
+	case "login/begin":
+		// Halfway through a password login this is a second factor and
+		// only that user's keys will do
+		uname, _ := ws.Challenged(db)
+		var keys []Passkey
+		if uname != "" {
+			u, err := UserByName(db, uname)
+			if err == nil { keys, err = u.Passkeys(db) }
+			if err != nil {
+				HandleWebError(w, r, http.StatusServiceUnavailable)
+				log.Println(err)
+				return
+			}
+		}
+
+		challenge := NewWebAuthnChallenge()
+		err := ws.SetWebAuthnChallenge(db, challenge, uname)
+		if err != nil {
+			HandleWebError(w, r, http.StatusServiceUnavailable)
+			log.Println(err)
+			return
+		}
+		WriteJSON(w, WebAuthnRequestOptions(challenge, keys, uname == ""))
+	case "login/finish":
+		var cred WebAuthnCredential
+		if json.NewDecoder(r.Body).Decode(&cred) != nil {
+			HandleWebError(w, r, http.StatusBadRequest)
+			return
+		}
+
+		challenge, uname, err := ws.TakeWebAuthnChallenge(db)
+		if err != nil {
+			HandleWebError(w, r, http.StatusForbidden)
+			return
+		}
+
+		p, err := PasskeyByID(db, cred.ID)
+		if err != nil || (uname != "" && p.Username != uname) {
+			HandleWebError(w, r, http.StatusForbidden)
+			return
+		}
+
+		clientData, err := b64url.DecodeString(cred.Response.ClientDataJSON)
+		var authData, sig []byte
+		if err == nil {
+			authData, err = b64url.DecodeString(
+				cred.Response.AuthenticatorData) }
+		if err == nil {
+			sig, err = b64url.DecodeString(cred.Response.Signature) }
+		var ad AuthenticatorData
+		if err == nil { ad, err = p.VerifyLogin(authData, clientData, sig,
+			challenge, uname == "") }
+		if err != nil {
+			HandleWebError(w, r, http.StatusForbidden)
+			log.Println(err)
+			return
+		}
+
+		if p.CheckSignCount(ad.SignCount) != nil {
+			log.Printf("Passkey %s for @%s went backwards (%d -> %d)!",
+				p.CredID, p.Username, p.SignCount, ad.SignCount)
+			HandleWebError(w, r, http.StatusForbidden)
+			return
+		}
+		u, err := UserByName(db, p.Username)
+		if err != nil || !u.Active() {
+			HandleWebError(w, r, http.StatusForbidden)
+			return
+		}
+		p.Used(db, ad.SignCount)
+
+		ws.ClearChallenge(db)
+		ws.Associate(db, p.Username, r)
+
+		WriteJSON(w, map[string]string{
+			"redirect": Settings.Web.Canon + "u/" + p.Username })
+	default:
+		HandleWebError(w, r, http.StatusNotFound)
+	}
+}
+
+// Site administration at /admin/{SECTION}
+func (ux *UserExperience) HandleAdmin(res *ServerRes, section string) {
+	if !ux.LoggedIn {
+		http.Redirect(res.Writer, res.Request,
+			"/login?next=" + url.QueryEscape(res.Request.URL.Path),
+			http.StatusSeeOther)
+		return
+	}
+	if !ux.Can(ScopeSession) || !IsAdmin(ux.Username) {
+		HandleWebError(res.Writer, res.Request, http.StatusForbidden)
+		return
+	}
+
+	switch(section) {
+	case "oauth-clients":
+		ux.HandleAdminOAuthClients(res)
+	case "payments":
+		ux.HandleAdminPayments(res)
+	case "promos":
+		ux.HandleAdminPromos(res)
+	case "signups":
+		ux.HandleAdminSignups(res)
+	default:
+		HandleWebError(res.Writer, res.Request, http.StatusNotFound)
+	}
+}
+
+func HandleStatic(res *ServerRes) {
+	w := res.Writer
+	r := res.Request
+	filename := "static/" + strings.TrimPrefix(
+		r.URL.Path, "/static/")
+	stat, err := os.Stat(filename)
+	if err != nil {
+		HandleWebError(w, r, http.StatusNotFound)
+		return
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		HandleWebError(w, r, http.StatusNotFound)
+		return
+	}
+
+	modifiedTime := stat.ModTime()
+	http.ServeContent(w, r, filename, modifiedTime, file)
+}
+
+func (ux *UserExperience) HandleInfo(res *ServerRes, which string) {
+	var page string
+	switch(which) {
+	case "about":
+		page = "tmpl/about.html"
+	case "privacy":
+		page = "tmpl/privacy.html"
+	case "mission":
+		page = "tmpl/mission.html"
+	case "technology":
+		page = "tmpl/technology.html"
+	}
+	Templates[page].Execute(res.Writer, InfoPage{
+		UX: ux,
+		Settings: &Settings })
+}
+
+// 1st step in acc creation...
+func (ux *UserExperience) HandleSignupNew(res *ServerRes, e *SignupError) {
+	w := res.Writer
+	r := res.Request
+	page := "tmpl/signup-new.html"
+
+	tmpl := Templates[page]
+	err := tmpl.Execute(w, SignupNewPage{
+		Invite: r.FormValue("invite"),
+		UX: ux,
+		Error: e,
+		Settings: &Settings })
+	if err != nil {
+		HandleWebError(w, r, http.StatusInternalServerError)
+	}
+}
+
+// 2nd step in acc creation...
+func (ux *UserExperience) HandleSignupCreate(res *ServerRes) {
+	w := res.Writer
+	r := res.Request
+	db := res.DB
+
+	// Parse form submission
+	if (r.Method != "POST") {
+		http.Redirect(w, r, "/signup/new", http.StatusFound)
+		return
+	}
+	if err := r.ParseForm(); err != nil { panic(err) }
+
+	username := strings.ToLower(r.FormValue("username"))
+	displayname := r.FormValue("displayname")
+	password := r.FormValue("password")
+	confirmpassword := r.FormValue("confirmpassword")
+	promo := r.FormValue("promo")
+
+	if displayname == "" { displayname = username }
+
+	if !ValidPassword(password) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		ux.HandleSignupNew(res, &SignupError{ShortPassword: true})
+		return
+	}
+
+	if !ValidUsername(username) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		ux.HandleSignupNew(res, &SignupError{BadUName: true})
+		return
+	}
+
+	existing, err := UserByName(db, username)
+	if err == nil && existing.Username == username {
+		w.WriteHeader(http.StatusConflict)
+		ux.HandleSignupNew(res, &SignupError{Taken: true})
+		return
+	}
 
 	if confirmpassword != password {
 		w.WriteHeader(http.StatusUnprocessableEntity)
@@ -725,87 +1795,254 @@ func (ux *UserExperience) HandleSignupCreate(res *ServerRes) {
 		return
 	}
 
-	// Promotional discount
-	cost := Settings.PayPal.OneTimeCost
-	if promo != "" {
-		discount, _ := PromoDiscount(db, promo)
-		cost -= discount
+	shadow, err := DoShadow(password)
+	if err != nil {
+		HandleWebError(w, r, http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if Settings.Activation.Mode != ActivationPaid {
+		ux.HandleSignupUnpaid(res, PendingSignup{
+			Username: username,
+			DisplayName: displayname,
+			Shadow: shadow }, r.FormValue("invite"))
+		return
+	}
+
+	// Keep the details (but not the password itself) on our side until
+	// the account is paid for
+	pending := PendingSignup{
+		Username: username,
+		DisplayName: displayname,
+		Shadow: shadow,
+		Promo: promo }
+	token, err := pending.Add(db)
+	if err != nil {
+		HandleWebError(w, r, http.StatusInternalServerError)
+		log.Println(err)
+		return
 	}
 
+	// Promotional discount, already taken off
+	cost := pending.Amount
+
 	if cost <= 0 {
 		page := "tmpl/signup-free.html"
 		tmpl := Templates[page]
 		err = tmpl.Execute(w, SignupFreePage{
 			Username: username,
 			DisplayName: displayname,
-			Password: password,
-			Promo: promo,
+			Token: token,
 			UX: ux,
 			Settings: &Settings })
 		if err != nil {
 			HandleWebError(w, r, http.StatusInternalServerError)
 		}
 	} else {
+		// Orders paid for on our page are set up now; the rest wait for
+		// the customer to pick them in HandleSignupCheckout
+		orders := map[string]string{}
+		for name, provider := range Payments {
+			if _, ok := provider.(RedirectingProvider); ok { continue }
+			orderID, err := provider.CreateOrder(cost, pending.Currency)
+			if err == nil { err = pending.AddOrder(db, name, orderID) }
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			orders[name] = orderID
+		}
+
 		page := "tmpl/signup-create.html"
 		tmpl := Templates[page]
 		err = tmpl.Execute(w, SignupCreatePage{
 			Username: username,
 			DisplayName: displayname,
-			Password: password,
+			Token: token,
 			Cost: cost,
-			Promo: promo,
+			Providers: Settings.Payments.Providers,
+			Orders: orders,
+			UX: ux,
+			Settings: &Settings })
+		if err != nil {
+			HandleWebError(w, r, http.StatusInternalServerError)
+		}
+	}
+}
+
+// Accounts made without paying: with an invite, or held for an admin
+func (ux *UserExperience) HandleSignupUnpaid(res *ServerRes, p PendingSignup, invite string) {
+	w := res.Writer
+	r := res.Request
+	db := res.DB
+
+	status := AccountActive
+	if Settings.Activation.Mode == ActivationApproval {
+		status = AccountPending
+		invite = ""
+	} else if invite == "" {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		ux.HandleSignupNew(res, &SignupError{BadInvite: true})
+		return
+	}
+
+	u, err := p.Create(db, status, invite)
+	if err == ErrInviteUsed {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		ux.HandleSignupNew(res, &SignupError{BadInvite: true})
+		return
+	}
+	if err != nil {
+		HandleWebError(w, r, http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if status == AccountPending {
+		log.Printf("User %s (%s) is waiting for approval\n",
+			u.DisplayName, u.Username)
+		page := "tmpl/signup-pending.html"
+		err = Templates[page].Execute(w, SignupPendingPage{
+			Username: u.Username,
 			UX: ux,
 			Settings: &Settings })
 		if err != nil {
 			HandleWebError(w, r, http.StatusInternalServerError)
 		}
+		return
+	}
+
+	log.Printf("Created user %s (%s) with invite %s\n",
+		u.DisplayName, u.Username, invite)
+	ThisSession(r).Associate(db, u.Username, r)
+	http.Redirect(w, r, "/u/" + u.Username, http.StatusFound)
+}
+
+// Sends the customer off to pay with a provider that hosts its own checkout
+func (ux *UserExperience) HandleSignupCheckout(res *ServerRes) {
+	w := res.Writer
+	r := res.Request
+	db := res.DB
+
+	if (r.Method != "POST" || Settings.Activation.Mode != ActivationPaid) {
+		http.Redirect(w, r, "/signup/new", http.StatusFound)
+		return
+	}
+	if err := r.ParseForm(); err != nil { panic(err) }
+
+	provider, ok := Payments[r.FormValue("provider")].(RedirectingProvider)
+	if !ok {
+		HandleWebError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	pending, err := PendingSignupByToken(db, r.FormValue("signup"))
+	if err != nil {
+		http.Redirect(w, r, "/signup/new", http.StatusFound)
+		return
+	}
+	if ux.SignupTaken(res, pending) { return }
+
+	orderID, err := provider.CreateOrder(pending.Amount, pending.Currency)
+	if err == nil {
+		err = pending.AddOrder(db, provider.Name(), orderID)
+	}
+	if err == nil {
+		var checkout string
+		checkout, err = provider.CheckoutURL(orderID)
+		if err == nil {
+			http.Redirect(w, r, checkout, http.StatusSeeOther)
+			return
+		}
 	}
+	HandleWebError(w, r, http.StatusBadGateway)
+	log.Println(err)
 }
 
 // 3rd step in acc creation...
 func (ux *UserExperience) HandleSignupPay(res *ServerRes) {
-	var err error
 	w := res.Writer
 	r := res.Request
 	db := res.DB
 
-	// Parse form submission
-	if (r.Method != "POST") {
-		HandleWebError(w, r, http.StatusBadRequest)
+	// Nothing to pay for unless accounts are bought
+	if Settings.Activation.Mode != ActivationPaid {
+		http.Redirect(w, r, "/signup/new", http.StatusFound)
 		return
 	}
-	if err := r.ParseForm(); err != nil { panic(err) }
 
-	username := r.FormValue("username")
-	displayname := r.FormValue("displayname")
-	password := r.FormValue("password")
-	promo := r.FormValue("promo")
+	if err := r.ParseForm(); err != nil { panic(err) }
+	provider := r.FormValue("provider")
 	orderID := r.FormValue("orderid")
 
-	// Promotional discount
-	cost := Settings.PayPal.OneTimeCost
-	if promo != "" {
-		discount, _ := PromoDiscount(db, promo)
-		cost -= discount
+	var pending PendingSignup
+	var err error
+	switch(r.Method) {
+	case "POST":
+		// Parse form submission
+		pending, err = PendingSignupByToken(db, r.FormValue("signup"))
+		if err != nil {
+			http.Redirect(w, r, "/signup/new", http.StatusFound)
+			return
+		}
+	case "GET":
+		// Back from a provider's checkout page
+		pending, err = PendingSignupByOrder(db, provider, orderID)
+		if err != nil {
+			// ...or the webhook got here first and made the account
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+	default:
+		HandleWebError(w, r, http.StatusBadRequest)
+		return
 	}
+	if ux.SignupTaken(res, pending) { return }
 
-	if displayname == "" { displayname = username }
-
-	paid := false
-	if cost > 0 {
-		// Poll PayPal for payment verification
-		paid, err = VerifyPayment(orderID)
-		if err != nil { panic(err) }
-	} else { paid = true }
+	// Ask the provider whether it was paid for
+	pay := pending.Payment(provider, orderID)
+	if _, ok := Payments[pay.Provider]; !ok && pay.Provider != FreeProvider {
+		HandleWebError(w, r, http.StatusBadRequest)
+		return
+	}
+	// Only an order made for this very signup can pay for it
+	if pay.Provider != FreeProvider {
+		bound, err := pending.HasOrder(db, pay.Provider, pay.OrderID)
+		if err != nil {
+			HandleWebError(w, r, http.StatusServiceUnavailable)
+			log.Println(err)
+			return
+		}
+		if !bound {
+			HandleWebError(w, r, http.StatusBadRequest)
+			log.Printf("Refused %s order %s not made for @%s's signup\n",
+				provider, orderID, pending.Username)
+			return
+		}
+	}
+	paid, err := pay.Verify()
+	if err != nil {
+		HandleWebError(w, r, http.StatusBadGateway)
+		log.Println(err)
+		return
+	}
 
 	if paid {
 		// Actually create account in DB
 		// ...
-		newUser := UserProfile{
-			Username: username,
-			DisplayName: displayname, }
-
-		u, err := newUser.Create(db, password)
+		u, err := pending.Finish(db, pay)
+		if err == sql.ErrNoRows {
+			// Finished already (a refresh, or the webhook got here first)
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+		if err == ErrPaymentRedeemed {
+			HandleWebError(w, r, http.StatusConflict)
+			log.Printf("Refused replayed %s order %s\n",
+				provider, orderID)
+			return
+		}
 		if err != nil {
 			HandleWebError(w, r, http.StatusInternalServerError)
 			log.Println(err)
@@ -816,16 +2053,27 @@ func (ux *UserExperience) HandleSignupPay(res *ServerRes) {
 		log.Printf("Created user %s (%s)\n", u.DisplayName, u.Username)
 
 		// Log us in immediately after acc. creation
-		ThisSession(r).Associate(db, u.Username)
+		ThisSession(r).Associate(db, u.Username, r)
 
 		// ...P-R-G and to show receipt (minimize refresh errors)
 		http.Redirect(w, r, "/signup/receipt", http.StatusFound);
 		return
 	}
 	// Confirmation was received but was not paid (for whatever reason...)
-	// (e.g. insufficient funds, transaction denied, etc. etc.)
-	// ...
-	// ...
+	// (e.g. insufficient funds, transaction denied, wrong amount, etc.)
+	HandleWebError(w, r, http.StatusPaymentRequired)
+	log.Printf("Unverified %s order %s for @%s\n",
+		provider, orderID, pending.Username)
+}
+
+// Someone may have got the username since the signup was started
+func (ux *UserExperience) SignupTaken(res *ServerRes, p PendingSignup) (bool) {
+	existing, err := UserByName(res.DB, p.Username)
+	if err != nil || existing.Username != p.Username { return false }
+
+	res.Writer.WriteHeader(http.StatusConflict)
+	ux.HandleSignupNew(res, &SignupError{Taken: true})
+	return true
 }
 
 // 4th step in acc creation...
@@ -834,12 +2082,130 @@ func (ux *UserExperience) HandleSignupReceipt(res *ServerRes) {
 	r := res.Request
 	page := "tmpl/signup-receipt.html"
 
+	if !ux.LoggedIn {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	// Just made, so the newest payment is this signup's
+	var receipt *WebPayment
+	payments, err := UserProfile{ Username: ux.Username }.Payments(res.DB)
+	if err != nil { log.Println(err) }
+	if len(payments) > 0 {
+		wp := payments[0].AsWebEntity()
+		receipt = &wp
+	}
+
 	tmpl := Templates[page]
-	err := tmpl.Execute(w, SignupReceiptPage{
+	err = tmpl.Execute(w, SignupReceiptPage{
+		Payment: receipt,
+		UX: ux,
+		Settings: &Settings })
+	if err != nil {
+		HandleWebError(w, r, http.StatusInternalServerError)
+	}
+}
+
+// What the user paid for their account, at /u/{USER}/settings/receipts
+func (ux *UserExperience) HandleUserReceipts(res *ServerRes, user UserProfile) {
+	w := res.Writer
+	r := res.Request
+	uname := user.Username
+	page := "tmpl/user-receipts.html"
+
+	payments, err := user.Payments(res.DB)
+	if err != nil {
+		HandleWebError(w, r, http.StatusServiceUnavailable)
+		log.Println(err)
+		return
+	}
+	var webpayments []WebPayment
+	for _, p := range payments {
+		webpayments = append(webpayments, p.AsWebEntity())
+	}
+
+	webuser := user.AsWebEntity()
+	webuser.ThisIsMe = true
+
+	err = Templates[page].Execute(w, UserReceiptsPage{
+		Canon: Settings.Web.Canon + "u/" + uname,
+		User: webuser,
+		Payments: webpayments,
+		Title: user.DisplayName + " (" + uname + ") - Receipts",
+		UX: ux,
+		Settings: &Settings })
+	if err != nil {
+		HandleWebError(w, r, http.StatusInternalServerError)
+		log.Println(err)
+	}
+}
+
+// Payments and refunds at /admin/payments
+func (ux *UserExperience) HandleAdminPayments(res *ServerRes) {
+	w := res.Writer
+	r := res.Request
+	db := res.DB
+	page := "tmpl/admin-payments.html"
+
+	var refunded *WebPayment
+	procErr := false
+	if r.Method == "POST" {
+		if err := r.ParseForm(); err != nil { panic(err) }
+		id, _ := strconv.Atoi(r.FormValue("paymentid"))
+		pay, err := PaymentByID(db, id)
+		if err != nil || !pay.Refundable() {
+			HandleWebError(w, r, http.StatusBadRequest)
+			return
+		}
+
+		err = Payments[pay.Provider].Refund(pay.OrderID)
+		if err != nil {
+			log.Printf("Refund of %s order %s failed: %s",
+				pay.Provider, pay.OrderID, err)
+			procErr = true
+		} else {
+			err = pay.MarkRefunded(db, ux.Username)
+			if err != nil {
+				// The money's gone back either way so make some noise
+				log.Printf("Refunded %s order %s but couldn't record it: %s",
+					pay.Provider, pay.OrderID, err)
+				procErr = true
+			} else {
+				log.Printf("Admin @%s refunded %s order %s for @%s",
+					ux.Username, pay.Provider, pay.OrderID, pay.Username)
+				pay, _ = PaymentByID(db, id)
+				wp := pay.AsWebEntity()
+				refunded = &wp
+			}
+		}
+	}
+
+	search := strings.ToLower(strings.TrimSpace(r.FormValue("user")))
+	var payments []Payment
+	var err error
+	if search != "" {
+		payments, err = UserProfile{ Username: search }.Payments(db)
+	} else { payments, err = RecentPayments(db, 100) }
+	if err != nil {
+		HandleWebError(w, r, http.StatusServiceUnavailable)
+		log.Println(err)
+		return
+	}
+	var webpayments []WebPayment
+	for _, p := range payments {
+		webpayments = append(webpayments, p.AsWebEntity())
+	}
+
+	err = Templates[page].Execute(w, AdminPaymentsPage{
+		Payments: webpayments,
+		Search: search,
+		Refunded: refunded,
+		Error: procErr,
 		UX: ux,
 		Settings: &Settings })
 	if err != nil {
 		HandleWebError(w, r, http.StatusInternalServerError)
+		log.Println(err)
 	}
 }
 
@@ -874,7 +2240,15 @@ func HandleReq(w http.ResponseWriter, r *http.Request) {
 		"mission": true,
 		"technology": true,
 		"short-title": true,
+		"webauthn": true,
+		"reset": true,
+		"webhooks": true,
+		"oauth": true,
+		"admin": true,
+		"verify-email": true,
 		"out": true,
+		"o": true,
+		"s": true,
 		"u": true }
 
 	parts := strings.Split(
@@ -898,6 +2272,12 @@ func HandleReq(w http.ResponseWriter, r *http.Request) {
 		Writer: w,
 		Request: r}
 
+	if ux.OverAPIRate(db, r) {
+		w.Header().Set("Retry-After", "3600")
+		HandleWebError(w, r, http.StatusTooManyRequests)
+		return
+	}
+
 	// Top-level index page should redirect to a search bar
 	if dispatcher == "" {
 		ux.HandleWebIndex(res)
@@ -933,6 +2313,8 @@ func HandleReq(w http.ResponseWriter, r *http.Request) {
 				ux.HandleSignupNew(res, nil)
 			case "create":
 				ux.HandleSignupCreate(res)
+			case "checkout":
+				ux.HandleSignupCheckout(res)
 			case "pay":
 				ux.HandleSignupPay(res)
 			case "receipt":
@@ -942,9 +2324,63 @@ func HandleReq(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 	case "login":
-		ux.HandleLogin(res, nil)
+		switch(len(args)) {
+		case 0:
+			ux.HandleLogin(res, nil)
+		case 1:
+			if args[0] != "2fa" {
+				HandleWebError(w, r, http.StatusNotFound)
+				return
+			}
+			ux.HandleLoginTOTP(res, nil)
+		default:
+			HandleWebError(w, r, http.StatusNotFound)
+		}
 	case "short-title":
 		ux.HandleShortTitle(res)
+	case "oauth":
+		if len(args) != 1 {
+			HandleWebError(w, r, http.StatusNotFound)
+			return
+		}
+		switch(args[0]) {
+		case "authorize": ux.HandleOAuthAuthorize(res)
+		case "token": HandleOAuthToken(res)
+		default: HandleWebError(w, r, http.StatusNotFound)
+		}
+	case "webhooks":
+		if len(args) != 1 || args[0] != "stripe" {
+			HandleWebError(w, r, http.StatusNotFound)
+			return
+		}
+		HandleStripeWebhook(res)
+	case "admin":
+		if len(args) != 1 {
+			HandleWebError(w, r, http.StatusNotFound)
+			return
+		}
+		ux.HandleAdmin(res, args[0])
+	case "reset":
+		switch(len(args)) {
+		case 0:
+			ux.HandleResetRequest(res)
+		case 1:
+			ux.HandleResetPassword(res, args[0])
+		default:
+			HandleWebError(w, r, http.StatusNotFound)
+		}
+	case "verify-email":
+		if len(args) != 1 {
+			HandleWebError(w, r, http.StatusNotFound)
+			return
+		}
+		ux.HandleVerifyEmail(res, args[0])
+	case "webauthn":
+		if len(args) != 2 {
+			HandleWebError(w, r, http.StatusNotFound)
+			return
+		}
+		ux.HandleWebAuthn(res, args[0], args[1])
 	case "logout":
 		ux.HandleLogout(res)
 	case "out":
@@ -964,6 +2400,9 @@ func HandleReq(w http.ResponseWriter, r *http.Request) {
 				// User settings at /u/{USER}/settings/{OPTION}
 				option := args[2]
 				ux.HandleUserSettings(res, uname, option)
+			} else if args[1] == "archive" {
+				// Archive feeds at /u/{USER}/archive/{FORMAT}
+				ux.HandleUserFeedFile(res, uname, true, args[2])
 			} else {
 				// Edit bookmark /u/{USER}/{ID}/{ACTION}
 				bID, err := strconv.Atoi(args[1])
@@ -983,6 +2422,11 @@ func HandleReq(w http.ResponseWriter, r *http.Request) {
 			case "add": ux.HandleUserAdd(res, uname)
 			case "archive": ux.HandleUserViewArchive(res, uname)
 			case "settings": ux.HandleUserSettings(res, uname, "")
+			case "feed": ux.HandleUserFeed(res, uname)
+			case "follow": ux.HandleUserFollow(res, uname, true)
+			case "unfollow": ux.HandleUserFollow(res, uname, false)
+			case "feed.atom", "feed.rss", "feed.json":
+				ux.HandleUserFeedFile(res, uname, false, action)
 			default: HandleWebError(w, r, http.StatusNotFound)
 			}
 		case 1:
@@ -992,6 +2436,20 @@ func HandleReq(w http.ResponseWriter, r *http.Request) {
 		default:
 			HandleWebError(w, r, http.StatusBadRequest)
 		}
+	case "o":
+		// Org bookmarks at /o/{ORG}/...
+		if len(args) == 0 || len(args) > 3 {
+			HandleWebError(w, r, http.StatusNotFound)
+			return
+		}
+		ux.HandleOrgReq(res, args[0], args[1:])
+	case "s":
+		// Share links at /s/{TOKEN} and their feeds at /s/{TOKEN}/{FORMAT}
+		switch(len(args)) {
+		case 1: ux.HandleShare(res, args[0], "")
+		case 2: ux.HandleShare(res, args[0], args[1])
+		default: HandleWebError(w, r, http.StatusNotFound)
+		}
 	case "static":
 		HandleStatic(res)
 	case "about": fallthrough
@@ -1008,11 +2466,64 @@ func HandleReq(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
+	hashReport := flag.Bool("hash-report", false,
+		"Report which password hashes are in use and exit")
+	promoReport := flag.Bool("promo-report", false,
+		"Report how each promo code has been used and exit")
+	saveMail := flag.Bool("save-mail", false,
+		"Save the links in an e-mail piped to stdin and exit")
+	rcpt := flag.String("rcpt", "",
+		"Envelope recipient for -save-mail, if the MTA knows it")
+	sender := flag.String("sender", "",
+		"Envelope sender for -save-mail, if the MTA knows it")
+	flag.Parse()
+
 	err := ReadDefaultConfig(&Settings)
 	if err != nil { panic(err) }
 
+	if *hashReport {
+		db, err := DBConnect(&Settings)
+		if err != nil { log.Fatal(err) }
+		PrintShadowReport(db)
+		return
+	}
+
+	if *promoReport {
+		db, err := DBConnect(&Settings)
+		if err != nil { log.Fatal(err) }
+		PrintPromoReport(db)
+		return
+	}
+
+	if *saveMail {
+		db, err := DBConnect(&Settings)
+		if err == nil { _, err = SaveMail(db, os.Stdin, *rcpt, *sender) }
+		if err != nil { log.Println(err) }
+		os.Exit(SaveMailExitCode(err))
+	}
+
 	InitTemplates()
 
+	Mail, err = NewMailer(Settings.Mail)
+	if err != nil { panic(err) }
+
+	switch(Settings.Activation.Mode) {
+	case "":
+		Settings.Activation.Mode = ActivationPaid
+	case ActivationPaid, ActivationInvite, ActivationApproval:
+	default:
+		log.Fatalf("unknown activation mode %q", Settings.Activation.Mode)
+	}
+
+	Payments, err = NewPaymentProviders(Settings.Payments)
+	if err != nil { panic(err) }
+
+	InitShareSecret()
+
+	go Limiter.PruneForever()
+	go PollFeedsForever()
+	go DeliverWebhooksForever()
+
 	log.Println("Starting server...")
 
 	http.HandleFunc("/", HandleReq)
@@ -1036,6 +2547,14 @@ func HandleWebError(w http.ResponseWriter, r *http.Request, status int) {
 		fmt.Fprint(w, "Custom 403")
 	case http.StatusMethodNotAllowed:
 		fmt.Fprint(w, "Custom 405")
+	case http.StatusTooManyRequests:
+		fmt.Fprint(w, "Custom 429")
+	case http.StatusBadGateway:
+		fmt.Fprint(w, "Custom 502")
+	case http.StatusConflict:
+		fmt.Fprint(w, "Custom 409")
+	case http.StatusPaymentRequired:
+		fmt.Fprint(w, "Custom 402")
 	}
 }
 
@@ -1051,4 +2570,38 @@ func AppendQuery(u *url.URL, key, value string, clobber bool) (*url.URL) {
 	return ret
 }
 
+func PrintShadowReport(db *sql.DB) {
+	schemes, outdated, err := ShadowReport(db)
+	if err != nil { log.Fatal(err) }
+
+	var names []string
+	total := 0
+	for name, n := range schemes {
+		names = append(names, name)
+		total += n
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Printf("%-40s %d\n", name, schemes[name])
+	}
+	fmt.Printf("\n%d of %d accounts will be re-hashed at their next login\n",
+		outdated, total)
+}
+
+// Where to go after logging in; only paths on this site are allowed
+func SafeNext(r *http.Request) (string) {
+	next := r.FormValue("next")
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") ||
+		strings.HasPrefix(next, "/\\") {
+		return ""
+	}
+	return next
+}
+
+func WriteJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
 func StarStarStar(times int) (string) { return strings.Repeat("*", times) }
@@ -5,7 +5,9 @@ import (
 	"net/http"
 	"strings"
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"time"
 )
 
@@ -13,12 +15,30 @@ type UserExperience struct {
 	SessID string
 	Username string
 	LoggedIn bool
+	Scope string
 	Theme string }
 
 type Session struct {
 	SessID string
 	Username string
-	Expires string }
+	Expires string
+	UserAgent string
+	IP string
+	CreatedOn string
+	LastSeen string }
+
+// What the sessions page is allowed to see; the real SessID is the cookie
+// itself so only a handle derived from it is ever shown
+type WebActiveSession struct {
+	Handle string
+	Device string
+	UserAgent string
+	IP string
+	CreatedOn string
+	CreatedOnRFC3339 string
+	LastSeen string
+	LastSeenRFC3339 string
+	ThisDevice bool }
 
 type WebSession struct {
 	SessID string }
@@ -35,6 +55,13 @@ func (UX *UserExperience) LoadSession(s Session) {
 	UX.SessID = s.SessID
 	UX.Username = s.Username
 	UX.LoggedIn = true
+	UX.Scope = ScopeSession
+}
+
+func (UX *UserExperience) LoadToken(t APIToken) {
+	UX.Username = t.Username
+	UX.LoggedIn = true
+	UX.Scope = t.Scope
 }
 
 func (UX *UserExperience) LoadGeneric(ws WebSession) {
@@ -44,13 +71,79 @@ func (UX *UserExperience) LoadGeneric(ws WebSession) {
 
 func LoadUX(db *sql.DB, r *http.Request) (*UserExperience) {
 	UX := &UserExperience{}
+
+	// Scripts authenticate with an API token instead of a cookie
+	if bearer := BearerToken(r); bearer != "" {
+		t, err := APITokenByToken(db, bearer)
+		if err == nil && t.AllowsIP(ClientIP(r)) {
+			UX.LoadToken(t)
+			t.Used(db)
+		}
+		return UX
+	}
+
 	ws := ThisSession(r)
 	s, err := ws.Associated(db)
 	if err != nil { UX.LoadGeneric(ws)
-	} else { UX.LoadSession(s) }
+	} else {
+		UX.LoadSession(s)
+		s.Touch(db, r)
+	}
 	return UX
 }
 
+func (s *Session) AsWebEntity(current string) (ws WebActiveSession) {
+	created, _ := ParseDBDate(s.CreatedOn)
+	seen, _ := ParseDBDate(s.LastSeen)
+
+	ws.Handle = SessionHandle(s.SessID)
+	ws.Device = DeviceName(s.UserAgent)
+	ws.UserAgent = s.UserAgent
+	ws.IP = s.IP
+	ws.CreatedOn = WebDate(created)
+	ws.CreatedOnRFC3339 = RFC3339Date(created)
+	ws.LastSeen = WebDate(seen)
+	ws.LastSeenRFC3339 = RFC3339Date(seen)
+	ws.ThisDevice = s.SessID == current
+	return
+}
+
+func SessionHandle(sessid string) (string) {
+	hash := sha256.Sum256([]byte(sessid))
+	return hex.EncodeToString(hash[:])[:16]
+}
+
+// Good-enough guess at the browser and OS from a user agent string
+func DeviceName(ua string) (string) {
+	browsers := []struct{ Token, Name string }{
+		{ "Edg/", "Edge" },
+		{ "OPR/", "Opera" },
+		{ "Firefox/", "Firefox" },
+		{ "Chrome/", "Chrome" },
+		{ "Safari/", "Safari" },
+		{ "curl/", "curl" } }
+	systems := []struct{ Token, Name string }{
+		{ "Android", "Android" },
+		{ "iPhone", "iPhone" },
+		{ "iPad", "iPad" },
+		{ "Windows", "Windows" },
+		{ "Mac OS X", "macOS" },
+		{ "CrOS", "ChromeOS" },
+		{ "Linux", "Linux" },
+		{ "BSD", "BSD" } }
+
+	browser, system := "Unknown browser", ""
+	for _, b := range browsers {
+		if strings.Contains(ua, b.Token) { browser = b.Name; break }
+	}
+	for _, s := range systems {
+		if strings.Contains(ua, s.Token) { system = s.Name; break }
+	}
+
+	if system == "" { return browser }
+	return browser + " on " + system
+}
+
 func InitWebSession(w http.ResponseWriter, r *http.Request) {
 	now := time.Now()
 	afterHours := time.Duration(24 * Settings.Web.SessionExpiryDays)
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// A read-only window onto some of a user's bookmarks at /s/{TOKEN}, for
+// anyone who has the link
+type ShareLink struct {
+	ShareID string
+	Username string
+	Name string
+	Kind string
+	Expires string
+	CreatedOn string
+	// How many bookmarks were picked, for ShareSelection
+	Count int
+	// Not expired, as of the query
+	Live bool
+}
+
+type WebShareLink struct {
+	ShareID string
+	Name string
+	Kind string
+	Link string
+	Count int
+	Live bool
+	Expires string
+	ExpiresRFC3339 string
+	CreatedOn string
+	CreatedOnRFC3339 string
+}
+
+type SharePage struct {
+	Name string
+	Owner WebUserProfile
+	Link string
+	Bookmarks []WebBookmark
+	UX *UserExperience
+	Settings *Config }
+
+type UserSharesPage struct {
+	Canon string
+	Title string
+	User WebUserProfile
+	Shares []WebShareLink
+	// Everything that can go into a selection
+	Bookmarks []WebBookmark
+	Created string
+	Error bool
+	UX *UserExperience
+	Settings *Config }
+
+const (
+	// Bookmarks picked one by one
+	ShareSelection = "selection"
+	// Whatever is on the owner's reading list at the time
+	ShareReadingList = "list"
+	ShareArchive = "archive"
+)
+
+var ShareKindNames = map[string]string{
+	ShareSelection: "Selected bookmarks",
+	ShareReadingList: "Reading list",
+	ShareArchive: "Archive" }
+
+// Signs share links; from Settings.Web.ShareSecret, or made up at startup
+var ShareSecret []byte
+
+func InitShareSecret() {
+	if Settings.Web.ShareSecret != "" {
+		ShareSecret = []byte(Settings.Web.ShareSecret)
+		return
+	}
+	log.Println("No ShareSecret set; share links will stop working on restart")
+	ShareSecret = make([]byte, 32)
+	rand.Read(ShareSecret)
+}
+
+func NewShareID() (string) {
+	bytes := make([]byte, 12)
+	rand.Read(bytes)
+	return hex.EncodeToString(bytes)
+}
+
+// Covers the expiry too, so it can't be stretched without a new link
+func (s ShareLink) Signature() (string) {
+	mac := hmac.New(sha256.New, ShareSecret)
+	mac.Write([]byte(s.ShareID + "." + s.Expires))
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+func (s ShareLink) Token() (string) { return s.ShareID + "." + s.Signature() }
+
+func (s ShareLink) Link() (string) {
+	return Settings.Web.Canon + "s/" + s.Token()
+}
+
+func (s *ShareLink) AsWebEntity() (ws WebShareLink) {
+	created, _ := ParseDBDate(s.CreatedOn)
+
+	ws.ShareID = s.ShareID
+	ws.Name = s.Name
+	ws.Kind = ShareKindNames[s.Kind]
+	ws.Link = s.Link()
+	ws.Count = s.Count
+	ws.Live = s.Live
+	if s.Expires != "" {
+		expires, _ := ParseDBDate(s.Expires)
+		ws.Expires = WebDate(expires)
+		ws.ExpiresRFC3339 = RFC3339Date(expires)
+	}
+	ws.CreatedOn = WebDate(created)
+	ws.CreatedOnRFC3339 = RFC3339Date(created)
+	return
+}
+
+// Never includes private bookmarks, whatever the kind
+func (s ShareLink) Bookmarks(db *sql.DB) (Bookmarks, error) {
+	order := &BOrder{ Parameter: SortByAdded, Order: OrderDescending }
+	u := UserProfile{ Username: s.Username }
+	var marks Bookmarks
+	var err error
+	switch(s.Kind) {
+	case ShareSelection:
+		marks, err = s.SelectedBookmarks(db)
+	case ShareReadingList:
+		marks, err = u.UnarchivedBookmarks(db, order)
+	case ShareArchive:
+		marks, err = u.ArchivedBookmarks(db, order)
+	}
+	return marks.Public(), err
+}
+
+// A share link's page at /s/{TOKEN}, or its feed at /s/{TOKEN}/{FORMAT}
+func (ux *UserExperience) HandleShare(res *ServerRes, token, format string) {
+	w := res.Writer
+	r := res.Request
+	db := res.DB
+	page := "tmpl/share.html"
+
+	parts := strings.SplitN(token, ".", 2)
+	var s ShareLink
+	var err error = sql.ErrNoRows
+	if len(parts) == 2 { s, err = ShareLinkByID(db, parts[0]) }
+	if err != nil || !s.Live ||
+		!hmac.Equal([]byte(parts[1]), []byte(s.Signature())) {
+		HandleWebError(w, r, http.StatusNotFound)
+		return
+	}
+
+	owner, err := UserByName(db, s.Username)
+	if err != nil || !owner.Active() {
+		HandleWebError(w, r, http.StatusNotFound)
+		return
+	}
+
+	marks, err := s.Bookmarks(db)
+	if err != nil {
+		HandleWebError(w, r, http.StatusServiceUnavailable)
+		log.Println(err)
+		return
+	}
+	// Straight to the site; /out is for the owner's own lists
+	var webmarks []WebBookmark
+	for _, b := range marks {
+		wb := b.AsWebEntity()
+		wb.URL = b.URL
+		webmarks = append(webmarks, wb)
+	}
+
+	meta := FeedMeta{
+		Title: s.Name,
+		Link: s.Link(),
+		Author: owner.DisplayName }
+	w.Header().Set("X-Robots-Tag", "noindex")
+	switch(format) {
+	case "":
+		err = Templates[page].Execute(w, SharePage{
+			Name: s.Name,
+			Owner: owner.AsWebEntity(),
+			Link: s.Link(),
+			Bookmarks: webmarks,
+			UX: ux,
+			Settings: &Settings })
+	case "atom.xml":
+		meta.Self = s.Link() + "/atom.xml"
+		err = WriteAtom(w, meta, marks)
+	case "feed.json":
+		meta.Self = s.Link() + "/feed.json"
+		err = WriteJSONFeed(w, meta, marks)
+	default:
+		HandleWebError(w, r, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		HandleWebError(w, r, http.StatusInternalServerError)
+		log.Println(err)
+	}
+}
+
+// Share links at /u/{USER}/settings/shares
+func (ux *UserExperience) HandleUserShares(res *ServerRes, user UserProfile) {
+	w := res.Writer
+	r := res.Request
+	db := res.DB
+	uname := user.Username
+	page := "tmpl/user-shares.html"
+
+	var created string
+	procErr := false
+	if r.Method == "POST" {
+		if err := r.ParseForm(); err != nil { panic(err) }
+
+		switch(r.FormValue("action")) {
+		case "create":
+			s := ShareLink{
+				ShareID: NewShareID(),
+				Username: uname,
+				Name: strings.TrimSpace(r.FormValue("name")),
+				Kind: r.FormValue("kind") }
+			days, _ := strconv.Atoi(r.FormValue("expires"))
+			var picked []int
+			for _, v := range r.Form["bid"] {
+				if bID, err := strconv.Atoi(v); err == nil {
+					picked = append(picked, bID) }
+			}
+
+			_, known := ShareKindNames[s.Kind]
+			if s.Name == "" || !known || days < 0 ||
+				(s.Kind == ShareSelection && len(picked) == 0) {
+				procErr = true
+				break
+			}
+			s, err := s.Add(db, days, picked)
+			if err != nil {
+				HandleWebError(w, r, http.StatusInternalServerError)
+				log.Println(err)
+				return
+			}
+			log.Printf("User @%s shared %q", uname, s.Name)
+			created = s.Link()
+		case "revoke":
+			err := user.RevokeShareLink(db, r.FormValue("share"))
+			if err != nil {
+				HandleWebError(w, r, http.StatusInternalServerError)
+				log.Println(err)
+				return
+			}
+			http.Redirect(w, r, Settings.Web.Canon + "u/" + uname +
+				"/settings/shares", http.StatusSeeOther)
+			return
+		}
+	}
+
+	shares, err := user.ShareLinks(db)
+	if err != nil {
+		HandleWebError(w, r, http.StatusServiceUnavailable)
+		log.Println(err)
+		return
+	}
+	var webshares []WebShareLink
+	for _, s := range shares {
+		webshares = append(webshares, s.AsWebEntity())
+	}
+
+	order := &BOrder{ Parameter: SortByAdded, Order: OrderDescending }
+	pickable, err := user.UnarchivedBookmarks(db, order)
+	var archived Bookmarks
+	if err == nil { archived, err = user.ArchivedBookmarks(db, order) }
+	if err != nil {
+		HandleWebError(w, r, http.StatusServiceUnavailable)
+		log.Println(err)
+		return
+	}
+	pickable = append(pickable, archived...)
+
+	webuser := user.AsWebEntity()
+	webuser.ThisIsMe = true
+
+	err = Templates[page].Execute(w, UserSharesPage{
+		Canon: Settings.Web.Canon + "u/" + uname,
+		User: webuser,
+		Shares: webshares,
+		Bookmarks: pickable.Public().AsWebEntities(),
+		Created: created,
+		Error: procErr,
+		Title: user.DisplayName + " (" + uname + ") - Share Links",
+		UX: ux,
+		Settings: &Settings })
+	if err != nil {
+		HandleWebError(w, r, http.StatusInternalServerError)
+		log.Println(err)
+	}
+}
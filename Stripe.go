@@ -0,0 +1,359 @@
+package main
+
+import (
+	"database/sql"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Stripe Checkout; the customer pays on a page hosted by Stripe and comes
+// back to /signup/pay with the session ID standing in for the order ID
+type StripeProvider struct {
+	Settings StripeSettings
+	Client http.Client
+}
+
+type StripeSession struct {
+	ID string `json:"id"`
+	URL string `json:"url"`
+	Status string `json:"status"`
+	PaymentStatus string `json:"payment_status"`
+	AmountTotal int `json:"amount_total"`
+	Currency string `json:"currency"`
+	PaymentIntent string `json:"payment_intent"`
+	Mode string `json:"mode"`
+	Subscription string `json:"subscription"`
+}
+
+type StripeSubscription struct {
+	ID string `json:"id"`
+	Status string `json:"status"`
+	CurrentPeriodEnd int64 `json:"current_period_end"`
+	CancelAtPeriodEnd bool `json:"cancel_at_period_end"`
+	Metadata map[string]string `json:"metadata"`
+	Items struct {
+		Data []struct {
+			Price struct {
+				ID string `json:"id"`
+			} `json:"price"`
+		} `json:"data"`
+	} `json:"items"`
+}
+
+type StripeEvent struct {
+	ID string `json:"id"`
+	Type string `json:"type"`
+	Data struct {
+		Object json.RawMessage `json:"object"`
+	} `json:"data"`
+}
+
+type StripeError struct {
+	Error struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// How old a webhook's signature timestamp may be before we call it a replay
+const StripeWebhookTolerance = 5 * time.Minute
+
+func NewStripeProvider(c StripeSettings) (*StripeProvider) {
+	return &StripeProvider{
+		Settings: c,
+		Client: http.Client{ Timeout: 30 * time.Second } }
+}
+
+func (s *StripeProvider) Name() (string) { return "stripe" }
+
+func (s *StripeProvider) CreateOrder(amount float64, currency string) (string, error) {
+	session, err := s.CreateSession(amount, currency)
+	return session.ID, err
+}
+
+func (s *StripeProvider) CreateSession(amount float64, currency string) (session StripeSession, err error) {
+	back := Settings.Web.Canon + "signup/pay?provider=stripe"
+	form := url.Values{
+		"mode": { "payment" },
+		"success_url": { back + "&orderid={CHECKOUT_SESSION_ID}" },
+		"cancel_url": { Settings.Web.Canon + "signup/new" },
+		"line_items[0][quantity]": { "1" },
+		"line_items[0][price_data][currency]": { strings.ToLower(currency) },
+		"line_items[0][price_data][unit_amount]": { strconv.Itoa(Cents(amount)) },
+		"line_items[0][price_data][product_data][name]": {
+			"BookmarkWarrior account activation" } }
+
+	res, err := s.Do(http.MethodPost, "checkout/sessions", form)
+	if err != nil { return }
+	err = json.Unmarshal(res, &session)
+	if err == nil && session.ID == "" {
+		err = errors.New("stripe: no session ID returned") }
+	return
+}
+
+func (s *StripeProvider) VerifyOrder(orderID string, amount float64, currency string) (bool, error) {
+	session, err := s.Session(orderID)
+	if err != nil { return false, err }
+	// Sessions are looked up with our own key so the payee is always us
+	return session.Status == "complete" &&
+		session.PaymentStatus == "paid" &&
+		strings.EqualFold(session.Currency, currency) &&
+		session.AmountTotal == Cents(amount), nil
+}
+
+func (s *StripeProvider) Refund(orderID string) (error) {
+	session, err := s.Session(orderID)
+	if err != nil { return err }
+	if session.PaymentIntent == "" {
+		return errors.New("stripe: session has no payment to refund") }
+
+	_, err = s.Do(http.MethodPost, "refunds", url.Values{
+		"payment_intent": { session.PaymentIntent } })
+	return err
+}
+
+func (s *StripeProvider) CheckoutURL(orderID string) (string, error) {
+	session, err := s.Session(orderID)
+	if err != nil { return "", err }
+	if session.URL == "" {
+		return "", errors.New("stripe: session has no checkout URL") }
+	return session.URL, nil
+}
+
+// Plans are billed through Stripe Prices set up ahead of time in the dashboard
+func (s *StripeProvider) Subscribe(db *sql.DB, u UserProfile, plan Plan, period string) (string, error) {
+	price := plan.StripeMonthlyPrice
+	if period == PeriodYearly { price = plan.StripeYearlyPrice }
+	if price == "" {
+		return "", fmt.Errorf("stripe: no %s price for plan %s", period, plan.ID) }
+
+	back := Settings.Web.Canon + "u/" + u.Username + "/settings/plan"
+	form := url.Values{
+		"mode": { "subscription" },
+		"success_url": { back },
+		"cancel_url": { back },
+		"client_reference_id": { u.Username },
+		"line_items[0][quantity]": { "1" },
+		"line_items[0][price]": { price },
+		"subscription_data[metadata][username]": { u.Username } }
+
+	var session StripeSession
+	res, err := s.Do(http.MethodPost, "checkout/sessions", form)
+	if err != nil { return "", err }
+	if err := json.Unmarshal(res, &session); err != nil { return "", err }
+	if session.URL == "" {
+		return "", errors.New("stripe: session has no checkout URL") }
+	return session.URL, nil
+}
+
+func (s *StripeProvider) CancelSubscription(db *sql.DB, sub Subscription) (error) {
+	_, err := s.Do(http.MethodPost,
+		"subscriptions/" + url.PathEscape(sub.ExternalID), url.Values{
+		"cancel_at_period_end": { "true" } })
+	if err != nil { return err }
+	// The webhook says the same thing shortly, but don't leave the page stale
+	return sub.SetCancelAtPeriodEnd(db, true)
+}
+
+func (s *StripeProvider) Subscription(subID string) (sub StripeSubscription, err error) {
+	res, err := s.Do(http.MethodGet,
+		"subscriptions/" + url.PathEscape(subID), nil)
+	if err != nil { return }
+	err = json.Unmarshal(res, &sub)
+	return
+}
+
+// Records the state Stripe reports for a subscription as the user's plan
+func (s *StripeProvider) SyncSubscription(db *sql.DB, ss StripeSubscription) (error) {
+	uname := ss.Metadata["username"]
+	if uname == "" || len(ss.Items.Data) == 0 {
+		return fmt.Errorf("stripe: subscription %s has no user or price", ss.ID) }
+
+	sub := Subscription{
+		Username: uname,
+		Provider: s.Name(),
+		ExternalID: ss.ID,
+		CancelAtPeriodEnd: ss.CancelAtPeriodEnd }
+	price := ss.Items.Data[0].Price.ID
+	for _, plan := range Settings.Subscriptions.Plans {
+		if price == plan.StripeMonthlyPrice {
+			sub.PlanID, sub.Period = plan.ID, PeriodMonthly }
+		if price == plan.StripeYearlyPrice {
+			sub.PlanID, sub.Period = plan.ID, PeriodYearly }
+	}
+	if sub.PlanID == "" {
+		return fmt.Errorf("stripe: subscription %s has unknown price %s",
+			ss.ID, price) }
+
+	switch(ss.Status) {
+	case "active", "trialing":
+		sub.Status = SubscriptionActive
+	case "past_due", "unpaid", "incomplete":
+		sub.Status = SubscriptionPastDue
+	default:
+		sub.Status = SubscriptionCanceled
+		// An old subscription ending mustn't clobber the one that replaced it
+		cur, err := UserProfile{ Username: uname }.Subscription(db)
+		if err == nil && cur.ExternalID != ss.ID { return nil }
+	}
+	return sub.Save(db, ss.CurrentPeriodEnd)
+}
+
+func (s *StripeProvider) Session(sessionID string) (session StripeSession, err error) {
+	res, err := s.Do(http.MethodGet,
+		"checkout/sessions/" + url.PathEscape(sessionID), nil)
+	if err != nil { return }
+	err = json.Unmarshal(res, &session)
+	return
+}
+
+func (s *StripeProvider) Do(method string,
+	endpoint string,
+	form url.Values) ([]byte, error) {
+
+	var body io.Reader = http.NoBody
+	if form != nil { body = strings.NewReader(form.Encode()) }
+	req, err := http.NewRequest(method, s.Settings.API + endpoint, body)
+	if err != nil { return nil, err }
+	req.Header.Set("Authorization", "Bearer " + s.Settings.SecretKey)
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	resp, err := s.Client.Do(req)
+	if err != nil { return nil, err }
+	defer resp.Body.Close()
+
+	resBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil { return nil, err }
+	if resp.StatusCode >= 400 {
+		var e StripeError
+		json.Unmarshal(resBody, &e)
+		return nil, fmt.Errorf("stripe: %s %s: %s %s", method, endpoint,
+			resp.Status, e.Error.Message)
+	}
+	return resBody, nil
+}
+
+// Checks the Stripe-Signature header: "t=<unix time>,v1=<hex HMAC-SHA256
+// of "<t>.<body>">"; there may be several v1 entries while secrets roll
+func (s *StripeProvider) VerifyWebhook(header string, body []byte, now time.Time) (bool) {
+	var timestamp string
+	var signatures []string
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 { continue }
+		switch(kv[0]) {
+		case "t": timestamp = kv[1]
+		case "v1": signatures = append(signatures, kv[1])
+		}
+	}
+
+	t, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || len(signatures) == 0 { return false }
+	age := now.Sub(time.Unix(t, 0))
+	if age > StripeWebhookTolerance || age < -StripeWebhookTolerance {
+		return false }
+
+	mac := hmac.New(sha256.New, []byte(s.Settings.WebhookSecret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	expected := mac.Sum(nil)
+
+	for _, sig := range signatures {
+		given, err := hex.DecodeString(sig)
+		if err == nil && hmac.Equal(given, expected) { return true }
+	}
+	return false
+}
+
+// Stripe calls /webhooks/stripe when a checkout completes, which finishes
+// signups whose owners closed the tab before being sent back to us, and
+// whenever a subscription renews, lapses or is cancelled
+func HandleStripeWebhook(res *ServerRes) {
+	w := res.Writer
+	r := res.Request
+	db := res.DB
+
+	stripe, ok := Payments["stripe"].(*StripeProvider)
+	if !ok || r.Method != "POST" {
+		HandleWebError(w, r, http.StatusNotFound)
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1 << 16))
+	if err != nil {
+		HandleWebError(w, r, http.StatusBadRequest)
+		return
+	}
+	if !stripe.VerifyWebhook(r.Header.Get("Stripe-Signature"), body,
+		time.Now()) {
+		HandleWebError(w, r, http.StatusBadRequest)
+		log.Println("Stripe webhook with a bad signature from", ClientIP(r))
+		return
+	}
+
+	var event StripeEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		HandleWebError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	switch(event.Type) {
+	case "checkout.session.completed":
+		var session StripeSession
+		json.Unmarshal(event.Data.Object, &session)
+		if session.Mode == "subscription" {
+			sub, err := stripe.Subscription(session.Subscription)
+			if err == nil { err = stripe.SyncSubscription(db, sub) }
+			if err != nil {
+				HandleWebError(w, r, http.StatusInternalServerError)
+				log.Println(err)
+				return
+			}
+			break
+		}
+		if session.PaymentStatus != "paid" { break }
+
+		pending, err := PendingSignupByOrder(db, stripe.Name(), session.ID)
+		if err != nil { break }
+		pay := pending.Payment(stripe.Name(), session.ID)
+		paid, err := pay.Verify()
+		if err != nil || !paid {
+			// Let Stripe try again later
+			HandleWebError(w, r, http.StatusInternalServerError)
+			log.Println("Stripe webhook for unverified session", session.ID, err)
+			return
+		}
+		u, err := pending.Finish(db, pay)
+		if err == ErrPaymentRedeemed || err == sql.ErrNoRows { break }
+		if err != nil {
+			HandleWebError(w, r, http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		log.Printf("Created user %s (%s) from a Stripe webhook\n",
+			u.DisplayName, u.Username)
+	case "customer.subscription.created", "customer.subscription.updated",
+		"customer.subscription.deleted":
+		var sub StripeSubscription
+		json.Unmarshal(event.Data.Object, &sub)
+		if err := stripe.SyncSubscription(db, sub); err != nil {
+			HandleWebError(w, r, http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func stripeSignature(secret string, t int64, body []byte) (string) {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(t, 10) + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestStripeVerifyWebhook(t *testing.T) {
+	s := &StripeProvider{ Settings: StripeSettings{
+		WebhookSecret: "whsec_test" } }
+	body := []byte(`{"type":"checkout.session.completed"}`)
+	now := time.Unix(1700000000, 0)
+	ts := now.Unix()
+	good := stripeSignature("whsec_test", ts, body)
+	stamp := "t=" + strconv.FormatInt(ts, 10)
+	old := ts - int64(StripeWebhookTolerance / time.Second) - 1
+
+	cases := []struct {
+		name string
+		header string
+		body []byte
+		ok bool
+	}{
+		{ "good", stamp + ",v1=" + good, body, true },
+		// Stripe sends more than one while a secret is being rolled
+		{ "one of several", stamp + ",v1=00ff," + "v1=" + good +
+			",v0=ignored", body, true },
+		{ "other secret", stamp + ",v1=" +
+			stripeSignature("whsec_other", ts, body), body, false },
+		{ "other body", stamp + ",v1=" + good, []byte(`{}`), false },
+		{ "other timestamp", "t=" + strconv.FormatInt(ts + 1, 10) +
+			",v1=" + good, body, false },
+		{ "too old", "t=" + strconv.FormatInt(old, 10) + ",v1=" +
+			stripeSignature("whsec_test", old, body), body, false },
+		{ "too far ahead", "t=" + strconv.FormatInt(ts + ts - old, 10) +
+			",v1=" + stripeSignature("whsec_test", ts + ts - old, body),
+			body, false },
+		{ "no timestamp", "v1=" + good, body, false },
+		{ "no signature", stamp, body, false },
+		{ "not hex", stamp + ",v1=zz", body, false },
+		{ "empty", "", body, false },
+	}
+	for _, c := range cases {
+		if s.VerifyWebhook(c.header, c.body, now) != c.ok {
+			t.Errorf("%s: accepted is %v", c.name, !c.ok) }
+	}
+}
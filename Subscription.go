@@ -0,0 +1,276 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// What an account gets to use; zero means no limit
+type Entitlements struct {
+	MaxBookmarks int
+	APIRequestsPerHour int
+}
+
+type Plan struct {
+	ID string
+	Name string
+	MonthlyCost float64
+	YearlyCost float64
+	StripeMonthlyPrice string
+	StripeYearlyPrice string
+	Entitlements Entitlements
+}
+
+type Subscription struct {
+	Username string
+	PlanID string
+	Period string
+	Provider string
+	ExternalID string
+	Status string
+	CurrentPeriodEnd string
+	CancelAtPeriodEnd bool
+	// Whether it still entitles the user to the plan, as of the query
+	Current bool
+}
+
+type WebSubscription struct {
+	Plan Plan
+	Period string
+	Provider string
+	Status string
+	Current bool
+	CancelAtPeriodEnd bool
+	CurrentPeriodEnd string
+	CurrentPeriodEndRFC3339 string
+}
+
+type UserPlanPage struct {
+	Canon string
+	Title string
+	User WebUserProfile
+	Subscription *WebSubscription
+	Entitlements Entitlements
+	Plans []Plan
+	Providers []string
+	ProviderNames map[string]string
+	CanSubscribe bool
+	Error bool
+	UX *UserExperience
+	Settings *Config }
+
+// Providers that can also take money on a schedule
+type SubscriptionProvider interface {
+	PaymentProvider
+	// Starts a subscription and returns where to send the user next
+	Subscribe(db *sql.DB, u UserProfile, plan Plan, period string) (string, error)
+	// Stops it renewing; it runs until the end of the period it's in
+	CancelSubscription(db *sql.DB, s Subscription) error
+}
+
+// Counts API requests per user over the current hour
+type APIRateLimiter struct {
+	mu sync.Mutex
+	hour int64
+	counts map[string]int
+}
+
+const (
+	PeriodMonthly = "monthly"
+	PeriodYearly = "yearly"
+)
+
+const (
+	SubscriptionActive = "active"
+	// Renewal failed; the plan keeps working for GraceDays past the period
+	SubscriptionPastDue = "past_due"
+	SubscriptionCanceled = "canceled"
+)
+
+var APIRate = APIRateLimiter{ counts: map[string]int{} }
+
+func PlanByID(id string) (Plan, bool) {
+	for _, p := range Settings.Subscriptions.Plans {
+		if p.ID == id { return p, true }
+	}
+	return Plan{}, false
+}
+
+func (p Plan) Cost(period string) (float64) {
+	if period == PeriodYearly { return p.YearlyCost }
+	return p.MonthlyCost
+}
+
+func (u UserProfile) Entitlements(db *sql.DB) (Entitlements, error) {
+	s, err := u.Subscription(db)
+	if err == sql.ErrNoRows { return Settings.Subscriptions.Free, nil }
+	if err != nil { return Settings.Subscriptions.Free, err }
+
+	plan, ok := PlanByID(s.PlanID)
+	if !s.Current || !ok { return Settings.Subscriptions.Free, nil }
+	return plan.Entitlements, nil
+}
+
+// Whether there's room for one more bookmark on the user's plan
+func (u UserProfile) CanAddBookmark(db *sql.DB) (bool, error) {
+	e, err := u.Entitlements(db)
+	if err != nil || e.MaxBookmarks == 0 { return err == nil, err }
+	n, err := u.BookmarkCount(db)
+	if err != nil { return false, err }
+	return n < e.MaxBookmarks, nil
+}
+
+func (l *APIRateLimiter) Allow(uname string, limit int) (bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	hour := time.Now().Unix() / 3600
+	if hour != l.hour {
+		l.hour = hour
+		l.counts = map[string]int{}
+	}
+	l.counts[uname]++
+	return limit == 0 || l.counts[uname] <= limit
+}
+
+// Counts a request made with an API token against its owner's hourly allowance
+func (ux *UserExperience) OverAPIRate(db *sql.DB, r *http.Request) (bool) {
+	if !ux.LoggedIn || BearerToken(r) == "" { return false }
+	e, err := UserProfile{ Username: ux.Username }.Entitlements(db)
+	if err != nil { log.Println(err) }
+	return !APIRate.Allow(ux.Username, e.APIRequestsPerHour)
+}
+
+func (s *Subscription) AsWebEntity() (ws WebSubscription) {
+	end, _ := ParseDBDate(s.CurrentPeriodEnd)
+
+	ws.Plan, _ = PlanByID(s.PlanID)
+	if ws.Plan.Name == "" { ws.Plan.Name = s.PlanID }
+	ws.Period = s.Period
+	ws.Provider = PaymentProviderNames[s.Provider]
+	ws.Status = s.Status
+	ws.Current = s.Current
+	ws.CancelAtPeriodEnd = s.CancelAtPeriodEnd
+	ws.CurrentPeriodEnd = WebDate(end)
+	ws.CurrentPeriodEndRFC3339 = RFC3339Date(end)
+	return
+}
+
+func (m *MockPaymentProvider) Subscribe(db *sql.DB, u UserProfile, plan Plan, period string) (string, error) {
+	months := 1
+	if period == PeriodYearly { months = 12 }
+
+	m.mu.Lock()
+	m.next++
+	id := fmt.Sprintf("MOCK-SUB-%d", m.next)
+	m.mu.Unlock()
+
+	s := Subscription{
+		Username: u.Username,
+		PlanID: plan.ID,
+		Period: period,
+		Provider: m.Name(),
+		ExternalID: id,
+		Status: SubscriptionActive }
+	err := s.Save(db, time.Now().AddDate(0, months, 0).Unix())
+	return Settings.Web.Canon + "u/" + u.Username + "/settings/plan", err
+}
+
+func (m *MockPaymentProvider) CancelSubscription(db *sql.DB, s Subscription) (error) {
+	return s.SetCancelAtPeriodEnd(db, true)
+}
+
+// Plans and subscriptions at /u/{USER}/settings/plan
+func (ux *UserExperience) HandleUserPlan(res *ServerRes, user UserProfile) {
+	w := res.Writer
+	r := res.Request
+	db := res.DB
+	uname := user.Username
+	page := "tmpl/user-plan.html"
+
+	sub, err := user.Subscription(db)
+	if err != nil && err != sql.ErrNoRows {
+		HandleWebError(w, r, http.StatusServiceUnavailable)
+		log.Println(err)
+		return
+	}
+	hasSub := err == nil
+
+	procErr := false
+	if r.Method == "POST" {
+		if err := r.ParseForm(); err != nil { panic(err) }
+
+		switch(r.FormValue("action")) {
+		case "subscribe":
+			provider, ok := Payments[r.FormValue("provider")].(SubscriptionProvider)
+			plan, found := PlanByID(r.FormValue("plan"))
+			period := r.FormValue("period")
+			if !ok || !found || (period != PeriodMonthly &&
+				period != PeriodYearly) || (hasSub && sub.Current) {
+				HandleWebError(w, r, http.StatusBadRequest)
+				return
+			}
+			next, err := provider.Subscribe(db, user, plan, period)
+			if err == nil {
+				http.Redirect(w, r, next, http.StatusSeeOther)
+				return
+			}
+			log.Println(err)
+			procErr = true
+		case "cancel":
+			provider, ok := Payments[sub.Provider].(SubscriptionProvider)
+			if !hasSub || !ok {
+				HandleWebError(w, r, http.StatusBadRequest)
+				return
+			}
+			err := provider.CancelSubscription(db, sub)
+			if err == nil {
+				log.Printf("User @%s cancelled their %s plan", uname, sub.PlanID)
+				http.Redirect(w, r, Settings.Web.Canon + "u/" + uname +
+					"/settings/plan", http.StatusSeeOther)
+				return
+			}
+			log.Println(err)
+			procErr = true
+		}
+	}
+
+	var websub *WebSubscription
+	if hasSub {
+		ws := sub.AsWebEntity()
+		websub = &ws
+	}
+	entitlements, err := user.Entitlements(db)
+	if err != nil { log.Println(err) }
+
+	var providers []string
+	for _, name := range Settings.Payments.Providers {
+		if _, ok := Payments[name].(SubscriptionProvider); ok {
+			providers = append(providers, name) }
+	}
+
+	webuser := user.AsWebEntity()
+	webuser.ThisIsMe = true
+
+	err = Templates[page].Execute(w, UserPlanPage{
+		Canon: Settings.Web.Canon + "u/" + uname,
+		User: webuser,
+		Subscription: websub,
+		Entitlements: entitlements,
+		Plans: Settings.Subscriptions.Plans,
+		Providers: providers,
+		ProviderNames: PaymentProviderNames,
+		CanSubscribe: len(providers) > 0 && !(hasSub && sub.Current),
+		Error: procErr,
+		Title: user.DisplayName + " (" + uname + ") - Plan",
+		UX: ux,
+		Settings: &Settings })
+	if err != nil {
+		HandleWebError(w, r, http.StatusInternalServerError)
+		log.Println(err)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// RFC 6238 defaults; every authenticator app understands these
+const (
+	TOTPDigits = 6
+	TOTPPeriod = 30
+	TOTPSkew = 1
+	RecoveryCodeCount = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func NewTOTPSecret() (string) {
+	bytes := make([]byte, 20)
+	rand.Read(bytes)
+	return totpEncoding.EncodeToString(bytes)
+}
+
+// otpauth:// URI which gets rendered as a QR code during enrollment
+func TOTPURI(secret, uname string) (string) {
+	issuer := "BookmarkWarrior"
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	return "otpauth://totp/" + url.PathEscape(issuer + ":" + uname) +
+		"?" + v.Encode()
+}
+
+func TOTPStep(t time.Time) (int64) { return t.Unix() / TOTPPeriod }
+
+// RFC 4226 HOTP truncated to TOTPDigits
+func TOTPCode(secret string, step int64) (string) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil { return "" }
+
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	bin := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	code := make([]byte, TOTPDigits)
+	for i := TOTPDigits - 1; i >= 0; i-- {
+		code[i] = byte('0' + bin % 10)
+		bin /= 10
+	}
+	return string(code)
+}
+
+// Check a code against the steps around now, refusing any step at or before
+// the last one we accepted so a code can't be replayed; returns the step
+// which matched
+func CheckTOTP(secret, code string, lastStep int64) (int64, bool) {
+	code = strings.TrimSpace(code)
+	now := TOTPStep(time.Now())
+	for s := now - TOTPSkew; s <= now + TOTPSkew; s++ {
+		if s <= lastStep { continue }
+		if hmac.Equal([]byte(TOTPCode(secret, s)), []byte(code)) {
+			return s, true
+		}
+	}
+	return 0, false
+}
+
+func NewRecoveryCodes() (codes []string, err error) {
+	for i := 0; i < RecoveryCodeCount; i++ {
+		bytes := make([]byte, 5)
+		if _, err = rand.Read(bytes); err != nil { return nil, err }
+		c := hex.EncodeToString(bytes)
+		codes = append(codes, c[:5] + "-" + c[5:])
+	}
+	return
+}
+
+// Recovery codes are only ever stored hashed
+func HashRecoveryCode(code string) (string) {
+	code = strings.ToLower(strings.TrimSpace(code))
+	hash := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// RFC 6238 appendix B, SHA-1: the ASCII secret "12345678901234567890",
+// truncated to our six digits
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCode(t *testing.T) {
+	cases := []struct {
+		unix int64
+		code string
+	}{
+		{ 59, "287082" },
+		{ 1111111109, "081804" },
+		{ 1111111111, "050471" },
+		{ 1234567890, "005924" },
+		{ 2000000000, "279037" },
+		{ 20000000000, "353130" },
+	}
+	for _, c := range cases {
+		step := TOTPStep(time.Unix(c.unix, 0))
+		if got := TOTPCode(rfc6238Secret, step); got != c.code {
+			t.Errorf("at %d: got %s, want %s", c.unix, got, c.code) }
+	}
+
+	// Secrets get typed in by hand
+	if TOTPCode("gezdgnbvgy3tqojqgezdgnbvgy3tqojq", 1) !=
+		TOTPCode(rfc6238Secret, 1) {
+		t.Error("lowercase secret gives a different code") }
+	if TOTPCode("not base32!", 1) != "" {
+		t.Error("made a code from a bad secret") }
+}
+
+func TestCheckTOTPWindow(t *testing.T) {
+	secret := NewTOTPSecret()
+	now := TOTPStep(time.Now())
+	cases := []struct {
+		step int64
+		ok bool
+	}{
+		{ now - 2, false },
+		{ now - 1, true },
+		{ now, true },
+		{ now + 1, true },
+		{ now + 2, false },
+	}
+	for _, c := range cases {
+		step, ok := CheckTOTP(secret, TOTPCode(secret, c.step), 0)
+		if ok != c.ok {
+			t.Errorf("step now%+d: accepted is %v", c.step - now, ok) }
+		if ok && step != c.step {
+			t.Errorf("step now%+d: matched %d", c.step - now, step) }
+	}
+	if _, ok := CheckTOTP(secret, " " + TOTPCode(secret, now) + " ",
+		0); !ok {
+		t.Error("rejected a code with spaces around it") }
+	if _, ok := CheckTOTP(secret, "", 0); ok {
+		t.Error("accepted an empty code") }
+}
+
+func TestCheckTOTPReplay(t *testing.T) {
+	secret := NewTOTPSecret()
+	code := TOTPCode(secret, TOTPStep(time.Now()))
+
+	step, ok := CheckTOTP(secret, code, 0)
+	if !ok { t.Fatal("rejected a fresh code") }
+	if _, ok := CheckTOTP(secret, code, step); ok {
+		t.Error("accepted the same code twice") }
+	if _, ok := CheckTOTP(secret, TOTPCode(secret, step - 1), step); ok {
+		t.Error("accepted a code older than the last one used") }
+	if _, ok := CheckTOTP(secret, TOTPCode(secret, step + 1), step); !ok {
+		t.Error("rejected the next code after one was used") }
+}
+
+func TestHashRecoveryCode(t *testing.T) {
+	codes, err := NewRecoveryCodes()
+	if err != nil { t.Fatal(err) }
+	if len(codes) != RecoveryCodeCount {
+		t.Fatalf("got %d codes, want %d", len(codes), RecoveryCodeCount) }
+	seen := map[string]bool{}
+	for _, c := range codes {
+		if seen[c] { t.Errorf("code %s came up twice", c) }
+		seen[c] = true
+	}
+	if HashRecoveryCode(" ABCDE-12345 ") != HashRecoveryCode("abcde-12345") {
+		t.Error("recovery codes are case or space sensitive") }
+}
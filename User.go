@@ -1,11 +1,31 @@
 package main
 
 import (
-	"golang.org/x/crypto/bcrypt"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 )
 
+// Where an account stands; only active ones can sign in
+const (
+	AccountActive = "active"
+	AccountRefunded = "refunded"
+	// Signed up while activation is by approval and not yet approved
+	AccountPending = "pending"
+)
+
+// Who can see a user's page and bookmarks
+const (
+	VisibilityPublic = "public"
+	// Anyone with the link, but kept out of search engines and listings
+	VisibilityUnlisted = "unlisted"
+	VisibilityPrivate = "private"
+)
+
+var ErrInactive = errors.New("account is not active")
+var ErrPendingApproval = errors.New("account is waiting for approval")
+
 type WebUserProfile struct {
 	Username string
 	DisplayName string
@@ -13,6 +33,9 @@ type WebUserProfile struct {
 	JoinedOnRFC3339 string
 	Bookmarks []WebBookmark
 	Homepage string
+	Visibility string
+	Followers int
+	Following int
 	ThisIsMe bool
 }
 
@@ -21,7 +44,33 @@ type UserProfile struct {
 	DisplayName string
 	JoinedOn string
 	Shadow string
-	APISecret string
+	TOTPSecret string
+	TOTPEnabled bool
+	TOTPLastStep int64
+	Email string
+	EmailVerified bool
+	Status string
+	Visibility string
+	// Only filled in by UserByName
+	Followers int
+	Following int
+}
+
+func (u UserProfile) Active() (bool) { return u.Status == AccountActive }
+
+func ValidVisibility(v string) (bool) {
+	return v == VisibilityPublic || v == VisibilityUnlisted ||
+		v == VisibilityPrivate
+}
+
+func (ux *UserExperience) IsOwner(uname string) (bool) {
+	return ux.Username == uname && ux.Can(ScopeRead)
+}
+
+// Private pages are for their owner only; unlisted ones for anyone who
+// has the link
+func (u UserProfile) VisibleTo(ux *UserExperience) (bool) {
+	return u.Visibility != VisibilityPrivate || ux.IsOwner(u.Username)
 }
 
 func (u *UserProfile) AsWebEntity() (wu WebUserProfile) {
@@ -32,29 +81,24 @@ func (u *UserProfile) AsWebEntity() (wu WebUserProfile) {
 	wu.JoinedOn = WebDate(t)
 	wu.JoinedOnRFC3339 = RFC3339Date(t)
 	wu.Homepage = Settings.Web.Canon + "u/" + u.Username
+	wu.Visibility = u.Visibility
+	wu.Followers = u.Followers
+	wu.Following = u.Following
 	return
 }
 
-func DoShadow(password string) (string) {
-	hash, _ := bcrypt.GenerateFromPassword(
-		[]byte(password),
-		bcrypt.DefaultCost)
-	return string(hash)
-}
-
-func CompareShadow(shadow, password string) (error) {
-	fail := bcrypt.CompareHashAndPassword([]byte(shadow), []byte(password))
-	return fail
-}
-
-func APISecret() (string) {
-	length := 15
-	bytes := make([]byte, length)
+// Long random token for links we e-mail out; only its hash is stored
+func MailToken() (string) {
+	bytes := make([]byte, 32)
 	rand.Read(bytes)
-
 	return hex.EncodeToString(bytes)
 }
 
+func HashToken(token string) (string) {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
 func ValidUsername(uname string) (bool) {
 	for _, r := range uname {
 		if ((r < 'a' || r > 'z') &&
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/url"
+)
+
+type Passkey struct {
+	CredID string
+	Username string
+	Name string
+	PublicKey []byte
+	SignCount uint32
+	CreatedOn string
+	LastUsed string
+}
+
+type WebPasskey struct {
+	CredID string
+	Name string
+	CreatedOn string
+	CreatedOnRFC3339 string
+	LastUsed string
+	LastUsedRFC3339 string
+}
+
+// What navigator.credentials hands back, base64url-encoded by the browser JS
+type WebAuthnCredential struct {
+	ID string `json:"id"`
+	Name string `json:"name"`
+	Response struct {
+		ClientDataJSON string `json:"clientDataJSON"`
+		AttestationObject string `json:"attestationObject"`
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature string `json:"signature"`
+		UserHandle string `json:"userHandle"`
+	} `json:"response"`
+}
+
+type WebAuthnClientData struct {
+	Type string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin string `json:"origin"`
+}
+
+type AuthenticatorData struct {
+	RPIDHash []byte
+	Flags byte
+	SignCount uint32
+	CredID []byte
+	PublicKey []byte
+}
+
+const (
+	AuthFlagUserPresent = 0x01
+	AuthFlagUserVerified = 0x04
+	AuthFlagAttested = 0x40
+
+	COSEAlgES256 = -7
+	COSEAlgRS256 = -257
+)
+
+var ErrWebAuthn = errors.New("WebAuthn verification failed")
+
+var b64url = base64.RawURLEncoding
+
+func (p *Passkey) AsWebEntity() (wp WebPasskey) {
+	created, _ := ParseDBDate(p.CreatedOn)
+	used, _ := ParseDBDate(p.LastUsed)
+
+	wp.CredID = p.CredID
+	wp.Name = p.Name
+	wp.CreatedOn = WebDate(created)
+	wp.CreatedOnRFC3339 = RFC3339Date(created)
+	if p.LastUsed != "" {
+		wp.LastUsed = WebDate(used)
+		wp.LastUsedRFC3339 = RFC3339Date(used)
+	}
+	return
+}
+
+func NewWebAuthnChallenge() (string) {
+	bytes := make([]byte, 32)
+	rand.Read(bytes)
+	return b64url.EncodeToString(bytes)
+}
+
+// The relying party is whatever host we are canonically served from
+func WebAuthnRPID() (string) {
+	u, err := url.Parse(Settings.Web.Canon)
+	if err != nil { return "" }
+	return u.Hostname()
+}
+
+func WebAuthnOrigin() (string) {
+	u, err := url.Parse(Settings.Web.Canon)
+	if err != nil { return "" }
+	return u.Scheme + "://" + u.Host
+}
+
+// Opaque user handle so the authenticator never stores the username itself
+func WebAuthnUserHandle(uname string) (string) {
+	hash := sha256.Sum256([]byte(uname))
+	return b64url.EncodeToString(hash[:])
+}
+
+// Options for navigator.credentials.create()
+func WebAuthnCreationOptions(u UserProfile, challenge string, existing []Passkey) (map[string]interface{}) {
+	exclude := []map[string]interface{}{}
+	for _, p := range existing {
+		exclude = append(exclude, map[string]interface{}{
+			"type": "public-key",
+			"id": p.CredID })
+	}
+	return map[string]interface{}{
+		"challenge": challenge,
+		"rp": map[string]string{
+			"id": WebAuthnRPID(),
+			"name": "BookmarkWarrior" },
+		"user": map[string]string{
+			"id": WebAuthnUserHandle(u.Username),
+			"name": u.Username,
+			"displayName": u.DisplayName },
+		"pubKeyCredParams": []map[string]interface{}{
+			{ "type": "public-key", "alg": COSEAlgES256 },
+			{ "type": "public-key", "alg": COSEAlgRS256 } },
+		"excludeCredentials": exclude,
+		"authenticatorSelection": map[string]string{
+			"residentKey": "preferred",
+			"userVerification": "preferred" },
+		"attestation": "none",
+		"timeout": 120000 }
+}
+
+// Options for navigator.credentials.get(); no allowed credentials means any
+// discoverable passkey for this site will do. Without a password first the
+// key has to check a PIN or biometric itself, or holding it would be enough
+func WebAuthnRequestOptions(challenge string, allowed []Passkey, passwordless bool) (map[string]interface{}) {
+	verification := "preferred"
+	if passwordless { verification = "required" }
+	allow := []map[string]interface{}{}
+	for _, p := range allowed {
+		allow = append(allow, map[string]interface{}{
+			"type": "public-key",
+			"id": p.CredID })
+	}
+	return map[string]interface{}{
+		"challenge": challenge,
+		"rpId": WebAuthnRPID(),
+		"allowCredentials": allow,
+		"userVerification": verification,
+		"timeout": 120000 }
+}
+
+func VerifyClientData(raw []byte, typ, challenge string) (error) {
+	var cd WebAuthnClientData
+	if err := json.Unmarshal(raw, &cd); err != nil { return err }
+	if cd.Type != typ { return ErrWebAuthn }
+	if cd.Challenge != challenge { return ErrWebAuthn }
+	if cd.Origin != WebAuthnOrigin() { return ErrWebAuthn }
+	return nil
+}
+
+func ParseAuthenticatorData(b []byte) (ad AuthenticatorData, err error) {
+	if len(b) < 37 { return ad, ErrWebAuthn }
+	ad.RPIDHash = b[:32]
+	ad.Flags = b[32]
+	ad.SignCount = binary.BigEndian.Uint32(b[33:37])
+
+	rpid := sha256.Sum256([]byte(WebAuthnRPID()))
+	if !bytes.Equal(ad.RPIDHash, rpid[:]) { return ad, ErrWebAuthn }
+	if ad.Flags & AuthFlagUserPresent == 0 { return ad, ErrWebAuthn }
+
+	if ad.Flags & AuthFlagAttested == 0 { return ad, nil }
+
+	// AAGUID, then the credential ID and its COSE public key
+	rest := b[37:]
+	if len(rest) < 18 { return ad, ErrWebAuthn }
+	idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if len(rest) < idLen { return ad, ErrWebAuthn }
+	ad.CredID = rest[:idLen]
+
+	key, _, err := DecodeCBOR(rest[idLen:])
+	if err != nil { return ad, err }
+	ad.PublicKey, err = COSEToPKIX(key)
+	return ad, err
+}
+
+// Attestation statements aren't checked ("none" is all we ask for); the
+// interesting part is the authenticator data inside
+func ParseAttestationObject(raw []byte) (AuthenticatorData, error) {
+	obj, _, err := DecodeCBOR(raw)
+	if err != nil { return AuthenticatorData{}, err }
+	m, ok := obj.(map[interface{}]interface{})
+	if !ok { return AuthenticatorData{}, ErrWebAuthn }
+	authData, ok := m["authData"].([]byte)
+	if !ok { return AuthenticatorData{}, ErrWebAuthn }
+
+	ad, err := ParseAuthenticatorData(authData)
+	if err != nil { return ad, err }
+	if ad.CredID == nil { return ad, ErrWebAuthn }
+	return ad, nil
+}
+
+func COSEToPKIX(key interface{}) ([]byte, error) {
+	m, ok := key.(map[interface{}]interface{})
+	if !ok { return nil, ErrWebAuthn }
+
+	switch(m[int64(3)]) {
+	case int64(COSEAlgES256):
+		x, okx := m[int64(-2)].([]byte)
+		y, oky := m[int64(-3)].([]byte)
+		if !okx || !oky || m[int64(-1)] != int64(1) {
+			return nil, ErrWebAuthn }
+		pub := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X: new(big.Int).SetBytes(x),
+			Y: new(big.Int).SetBytes(y) }
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) { return nil, ErrWebAuthn }
+		return x509.MarshalPKIXPublicKey(pub)
+	case int64(COSEAlgRS256):
+		n, okn := m[int64(-1)].([]byte)
+		e, oke := m[int64(-2)].([]byte)
+		if !okn || !oke { return nil, ErrWebAuthn }
+		pub := &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()) }
+		return x509.MarshalPKIXPublicKey(pub)
+	}
+	return nil, ErrWebAuthn
+}
+
+// Signature covers the authenticator data followed by a hash of the client
+// data
+func VerifyAssertion(pkix, authData, clientData, sig []byte) (error) {
+	pub, err := x509.ParsePKIXPublicKey(pkix)
+	if err != nil { return err }
+
+	cdHash := sha256.Sum256(clientData)
+	signed := sha256.Sum256(append(append([]byte(nil), authData...),
+		cdHash[:]...))
+
+	switch key := pub.(type) {
+	case *ecdsa.PublicKey:
+		if ecdsa.VerifyASN1(key, signed[:], sig) { return nil }
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, signed[:], sig)
+	}
+	return ErrWebAuthn
+}
+
+// Counters only ever go up; if they don't, the key was cloned. Keys that
+// don't count at all send zero every time
+func (p Passkey) CheckSignCount(count uint32) (error) {
+	if (count != 0 || p.SignCount != 0) && count <= p.SignCount {
+		return ErrWebAuthn }
+	return nil
+}
+
+// Everything a sign-in assertion has to get right, for the key p; for a
+// passwordless sign-in the authenticator must also have verified the user
+func (p Passkey) VerifyLogin(authData, clientData, sig []byte, challenge string, passwordless bool) (AuthenticatorData, error) {
+	err := VerifyClientData(clientData, "webauthn.get", challenge)
+	if err != nil { return AuthenticatorData{}, err }
+	ad, err := ParseAuthenticatorData(authData)
+	if err != nil { return ad, err }
+	if passwordless && ad.Flags & AuthFlagUserVerified == 0 {
+		return ad, ErrWebAuthn }
+	if err = VerifyAssertion(p.PublicKey, authData, clientData, sig); err != nil {
+		return ad, err }
+	return ad, nil
+}
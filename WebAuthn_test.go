@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+)
+
+// A software authenticator: one ES256 key, producing the same bytes a browser
+// would hand us
+
+type testAuthenticator struct {
+	key *ecdsa.PrivateKey
+	credID []byte
+}
+
+// CBOR map with its keys in a fixed order
+type cborPairs [][2]interface{}
+
+const testCanon = "https://bookmarks.example/"
+
+func newTestAuthenticator(t *testing.T) (*testAuthenticator) {
+	Settings.Web.Canon = testCanon
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil { t.Fatal(err) }
+	credID := make([]byte, 16)
+	rand.Read(credID)
+	return &testAuthenticator{ key: key, credID: credID }
+}
+
+func cborHead(major byte, n uint64) ([]byte) {
+	switch {
+	case n < 24: return []byte{ major << 5 | byte(n) }
+	case n < 1 << 8: return []byte{ major << 5 | 24, byte(n) }
+	case n < 1 << 16:
+		b := []byte{ major << 5 | 25, 0, 0 }
+		binary.BigEndian.PutUint16(b[1:], uint16(n))
+		return b
+	}
+	b := []byte{ major << 5 | 26, 0, 0, 0, 0 }
+	binary.BigEndian.PutUint32(b[1:], uint32(n))
+	return b
+}
+
+func cborEncode(v interface{}) ([]byte) {
+	switch v := v.(type) {
+	case int:
+		if v < 0 { return cborHead(1, uint64(-1 - v)) }
+		return cborHead(0, uint64(v))
+	case []byte:
+		return append(cborHead(2, uint64(len(v))), v...)
+	case string:
+		return append(cborHead(3, uint64(len(v))), v...)
+	case cborPairs:
+		b := cborHead(5, uint64(len(v)))
+		for _, kv := range v {
+			b = append(b, cborEncode(kv[0])...)
+			b = append(b, cborEncode(kv[1])...)
+		}
+		return b
+	}
+	panic("can't encode that")
+}
+
+func (a *testAuthenticator) coseKey() ([]byte) {
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	a.key.X.FillBytes(x)
+	a.key.Y.FillBytes(y)
+	return cborEncode(cborPairs{
+		{ 1, 2 },
+		{ 3, COSEAlgES256 },
+		{ -1, 1 },
+		{ -2, x },
+		{ -3, y } })
+}
+
+func (a *testAuthenticator) authData(rpid string, flags byte, count uint32) ([]byte) {
+	hash := sha256.Sum256([]byte(rpid))
+	b := append([]byte(nil), hash[:]...)
+	b = append(b, flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(b[33:], count)
+	if flags & AuthFlagAttested == 0 { return b }
+
+	b = append(b, make([]byte, 16)...) // AAGUID
+	b = append(b, byte(len(a.credID) >> 8), byte(len(a.credID)))
+	b = append(b, a.credID...)
+	return append(b, a.coseKey()...)
+}
+
+func (a *testAuthenticator) attestationObject(authData []byte) ([]byte) {
+	return cborEncode(cborPairs{
+		{ "fmt", "none" },
+		{ "attStmt", cborPairs{} },
+		{ "authData", authData } })
+}
+
+func testClientData(t *testing.T, typ, challenge, origin string) ([]byte) {
+	b, err := json.Marshal(WebAuthnClientData{
+		Type: typ,
+		Challenge: challenge,
+		Origin: origin })
+	if err != nil { t.Fatal(err) }
+	return b
+}
+
+func (a *testAuthenticator) sign(t *testing.T, authData, clientData []byte) ([]byte) {
+	cdHash := sha256.Sum256(clientData)
+	signed := sha256.Sum256(append(append([]byte(nil), authData...),
+		cdHash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, a.key, signed[:])
+	if err != nil { t.Fatal(err) }
+	return sig
+}
+
+func (a *testAuthenticator) pkix(t *testing.T) ([]byte) {
+	b, err := x509.MarshalPKIXPublicKey(&a.key.PublicKey)
+	if err != nil { t.Fatal(err) }
+	return b
+}
+
+func TestParseAttestationObject(t *testing.T) {
+	a := newTestAuthenticator(t)
+	raw := a.attestationObject(a.authData(WebAuthnRPID(),
+		AuthFlagUserPresent | AuthFlagAttested, 0))
+
+	ad, err := ParseAttestationObject(raw)
+	if err != nil { t.Fatal(err) }
+	if !bytes.Equal(ad.CredID, a.credID) {
+		t.Errorf("credential ID is %x, want %x", ad.CredID, a.credID) }
+	if !bytes.Equal(ad.PublicKey, a.pkix(t)) {
+		t.Error("public key doesn't match the authenticator's") }
+}
+
+func TestParseAttestationObjectRejects(t *testing.T) {
+	a := newTestAuthenticator(t)
+	attested := byte(AuthFlagUserPresent | AuthFlagAttested)
+	cases := []struct {
+		name string
+		raw []byte
+	}{
+		{ "wrong RP ID hash", a.attestationObject(
+			a.authData("evil.example", attested, 0)) },
+		{ "user not present", a.attestationObject(
+			a.authData(WebAuthnRPID(), AuthFlagAttested, 0)) },
+		{ "no credential", a.attestationObject(
+			a.authData(WebAuthnRPID(), AuthFlagUserPresent, 0)) },
+		{ "truncated", a.attestationObject(
+			a.authData(WebAuthnRPID(), attested, 0)[:40]) },
+		{ "not CBOR", []byte("{}") },
+	}
+	for _, c := range cases {
+		if _, err := ParseAttestationObject(c.raw); err == nil {
+			t.Errorf("%s: accepted", c.name) }
+	}
+}
+
+func TestVerifyClientData(t *testing.T) {
+	newTestAuthenticator(t)
+	challenge := NewWebAuthnChallenge()
+	origin := WebAuthnOrigin()
+
+	ok := testClientData(t, "webauthn.get", challenge, origin)
+	if err := VerifyClientData(ok, "webauthn.get", challenge); err != nil {
+		t.Errorf("rejected good client data: %s", err) }
+
+	cases := []struct {
+		name string
+		raw []byte
+	}{
+		{ "wrong challenge", testClientData(t, "webauthn.get",
+			NewWebAuthnChallenge(), origin) },
+		{ "wrong origin", testClientData(t, "webauthn.get", challenge,
+			"https://evil.example") },
+		{ "wrong type", testClientData(t, "webauthn.create", challenge,
+			origin) },
+	}
+	for _, c := range cases {
+		if VerifyClientData(c.raw, "webauthn.get", challenge) == nil {
+			t.Errorf("%s: accepted", c.name) }
+	}
+}
+
+func TestVerifyAssertion(t *testing.T) {
+	a := newTestAuthenticator(t)
+	pkix := a.pkix(t)
+	challenge := NewWebAuthnChallenge()
+	clientData := testClientData(t, "webauthn.get", challenge,
+		WebAuthnOrigin())
+	authData := a.authData(WebAuthnRPID(), AuthFlagUserPresent, 5)
+	sig := a.sign(t, authData, clientData)
+
+	ad, err := ParseAuthenticatorData(authData)
+	if err != nil { t.Fatal(err) }
+	if ad.SignCount != 5 { t.Errorf("sign count is %d, want 5", ad.SignCount) }
+	if err := VerifyAssertion(pkix, authData, clientData, sig); err != nil {
+		t.Errorf("rejected a good assertion: %s", err) }
+
+	bad := append([]byte(nil), sig...)
+	bad[len(bad) - 1] ^= 0xff
+	if VerifyAssertion(pkix, authData, clientData, bad) == nil {
+		t.Error("accepted a corrupted signature") }
+
+	other := newTestAuthenticator(t)
+	if VerifyAssertion(other.pkix(t), authData, clientData, sig) == nil {
+		t.Error("accepted a signature from another key") }
+
+	tampered := a.authData(WebAuthnRPID(), AuthFlagUserPresent, 6)
+	if VerifyAssertion(pkix, tampered, clientData, sig) == nil {
+		t.Error("accepted a signature over different authenticator data") }
+
+	replayed := testClientData(t, "webauthn.get", NewWebAuthnChallenge(),
+		WebAuthnOrigin())
+	if VerifyAssertion(pkix, authData, replayed, sig) == nil {
+		t.Error("accepted a signature over different client data") }
+
+	elsewhere := a.authData("evil.example", AuthFlagUserPresent, 5)
+	if _, err := ParseAuthenticatorData(elsewhere); err == nil {
+		t.Error("accepted an assertion for another RP ID") }
+}
+
+func TestCheckSignCount(t *testing.T) {
+	cases := []struct {
+		stored, got uint32
+		ok bool
+	}{
+		{ 0, 0, true }, // doesn't count at all
+		{ 0, 1, true },
+		{ 5, 6, true },
+		{ 5, 5, false },
+		{ 5, 4, false },
+		{ 5, 0, false },
+	}
+	for _, c := range cases {
+		err := Passkey{ SignCount: c.stored }.CheckSignCount(c.got)
+		if (err == nil) != c.ok {
+			t.Errorf("stored %d, got %d: error %v", c.stored, c.got, err) }
+	}
+}
+
+func TestVerifyLogin(t *testing.T) {
+	a := newTestAuthenticator(t)
+	p := Passkey{ PublicKey: a.pkix(t) }
+	challenge := NewWebAuthnChallenge()
+	clientData := testClientData(t, "webauthn.get", challenge,
+		WebAuthnOrigin())
+	verified := a.authData(WebAuthnRPID(),
+		AuthFlagUserPresent | AuthFlagUserVerified, 1)
+	presentOnly := a.authData(WebAuthnRPID(), AuthFlagUserPresent, 1)
+
+	for _, passwordless := range []bool{ false, true } {
+		sig := a.sign(t, verified, clientData)
+		_, err := p.VerifyLogin(verified, clientData, sig, challenge,
+			passwordless)
+		if err != nil {
+			t.Errorf("passwordless=%v: rejected a verified user: %s",
+				passwordless, err) }
+	}
+
+	// A key without a PIN is fine after a password, but not on its own
+	sig := a.sign(t, presentOnly, clientData)
+	if _, err := p.VerifyLogin(presentOnly, clientData, sig, challenge,
+		false); err != nil {
+		t.Errorf("rejected a second factor without UV: %s", err) }
+	if _, err := p.VerifyLogin(presentOnly, clientData, sig, challenge,
+		true); err == nil {
+		t.Error("signed in without a password or user verification") }
+
+	sig = a.sign(t, verified, clientData)
+	if _, err := p.VerifyLogin(verified, clientData, sig,
+		NewWebAuthnChallenge(), true); err == nil {
+		t.Error("accepted an assertion for another challenge") }
+}
+
+func TestWebAuthnRequestOptions(t *testing.T) {
+	newTestAuthenticator(t)
+	for _, c := range []struct {
+		passwordless bool
+		want string
+	}{ { false, "preferred" }, { true, "required" } } {
+		opts := WebAuthnRequestOptions("c", nil, c.passwordless)
+		if opts["userVerification"] != c.want {
+			t.Errorf("passwordless=%v: userVerification is %v",
+				c.passwordless, opts["userVerification"]) }
+	}
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Somewhere of the user's to tell about changes to their bookmarks
+type Webhook struct {
+	HookID int
+	Username string
+	URL string
+	// Signs every delivery, so the receiver knows it came from us
+	Secret string
+	// Comma-separated; see WebhookEvents
+	Events string
+	CreatedOn string
+}
+
+// One event on its way to one webhook; the queue and the log in one
+type WebhookDelivery struct {
+	DeliveryID int
+	HookID int
+	HookURL string
+	Event string
+	Payload string
+	Status string
+	Attempts int
+	ResponseCode int
+	NextAttempt string
+	LastAttempt string
+	CreatedOn string
+}
+
+type WebWebhook struct {
+	HookID int
+	URL string
+	Secret string
+	Events []string
+	CreatedOn string
+	CreatedOnRFC3339 string
+}
+
+type WebWebhookDelivery struct {
+	DeliveryID int
+	HookURL string
+	Event string
+	Status string
+	Attempts int
+	ResponseCode int
+	LastAttempt string
+	LastAttemptRFC3339 string
+	CreatedOn string
+	CreatedOnRFC3339 string
+}
+
+type UserWebhooksPage struct {
+	Canon string
+	Title string
+	User WebUserProfile
+	Webhooks []WebWebhook
+	Deliveries []WebWebhookDelivery
+	Events []string
+	Error bool
+	UX *UserExperience
+	Settings *Config }
+
+// What a webhook receives, as JSON
+type WebhookPayload struct {
+	Event string `json:"event"`
+	Created string `json:"created"`
+	Username string `json:"username"`
+	Bookmark WebhookBookmark `json:"bookmark"`
+}
+
+type WebhookBookmark struct {
+	ID int `json:"id"`
+	URL string `json:"url"`
+	Title string `json:"title"`
+	Unread bool `json:"unread"`
+	Archived bool `json:"archived"`
+	Private bool `json:"private"`
+	AddedOn string `json:"added_on,omitempty"`
+}
+
+const (
+	WebhookAdded = "bookmark.added"
+	WebhookEdited = "bookmark.edited"
+	WebhookRead = "bookmark.read"
+	WebhookUnread = "bookmark.unread"
+	WebhookArchived = "bookmark.archived"
+	WebhookUnarchived = "bookmark.unarchived"
+	WebhookRemoved = "bookmark.removed"
+)
+
+var WebhookEvents = []string{ WebhookAdded, WebhookEdited, WebhookRead,
+	WebhookUnread, WebhookArchived, WebhookUnarchived, WebhookRemoved }
+
+const (
+	DeliveryPending = "pending"
+	DeliveryDelivered = "delivered"
+	// Out of attempts
+	DeliveryFailed = "failed"
+)
+
+// How receivers check a delivery; same scheme as Stripe's
+const WebhookSignatureHeader = "X-BookmarkWarrior-Signature"
+
+var WebhookClient = http.Client{
+	Timeout: 15 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: publicOnly }).DialContext },
+	// A redirect is as good as a failure; the receiver should fix its URL
+	CheckRedirect: func(req *http.Request, via []*http.Request) (error) {
+		return http.ErrUseLastResponse } }
+
+// Only events we know, and at least one of them
+func ParseWebhookEvents(picked []string) (string, bool) {
+	var ok []string
+	for _, e := range WebhookEvents {
+		for _, p := range picked {
+			if p == e { ok = append(ok, e); break }
+		}
+	}
+	return strings.Join(ok, ","), len(ok) > 0
+}
+
+func (h Webhook) Wants(event string) (bool) {
+	for _, e := range strings.Split(h.Events, ",") {
+		if e == event { return true }
+	}
+	return false
+}
+
+// t={UNIX TIME},v1={HMAC-SHA256 of "{t}.{body}" under the hook's secret}
+func WebhookSignature(secret string, body []byte, now time.Time) (string) {
+	t := strconv.FormatInt(now.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(t + "."))
+	mac.Write(body)
+	return "t=" + t + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Seconds until the next try: BaseDelaySeconds, doubled for each failed
+// attempt so far, up to MaxDelayMinutes
+func webhookDelay(attempts int) (int) {
+	c := Settings.Webhooks
+	max := c.MaxDelayMinutes * 60
+	delay := c.BaseDelaySeconds
+	for i := 1; i < attempts && delay < max; i++ { delay *= 2 }
+	if delay > max { delay = max }
+	return delay
+}
+
+func (h *Webhook) AsWebEntity() (wh WebWebhook) {
+	created, _ := ParseDBDate(h.CreatedOn)
+
+	wh.HookID = h.HookID
+	wh.URL = h.URL
+	wh.Secret = h.Secret
+	wh.Events = strings.Split(h.Events, ",")
+	wh.CreatedOn = WebDate(created)
+	wh.CreatedOnRFC3339 = RFC3339Date(created)
+	return
+}
+
+func (d *WebhookDelivery) AsWebEntity() (wd WebWebhookDelivery) {
+	created, _ := ParseDBDate(d.CreatedOn)
+
+	wd.DeliveryID = d.DeliveryID
+	wd.HookURL = d.HookURL
+	wd.Event = d.Event
+	wd.Status = d.Status
+	wd.Attempts = d.Attempts
+	wd.ResponseCode = d.ResponseCode
+	if d.LastAttempt != "" {
+		last, _ := ParseDBDate(d.LastAttempt)
+		wd.LastAttempt = WebDate(last)
+		wd.LastAttemptRFC3339 = RFC3339Date(last)
+	}
+	wd.CreatedOn = WebDate(created)
+	wd.CreatedOnRFC3339 = RFC3339Date(created)
+	return
+}
+
+// Queues event for each of the user's webhooks that wants it; failures are
+// only logged, since the change itself has already been made
+func QueueWebhooks(db *sql.DB, uname, event string, b Bookmark) {
+	hooks, err := UserProfile{ Username: uname }.Webhooks(db)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	added, _ := ParseDBDate(b.AddedOn)
+	payload := WebhookPayload{
+		Event: event,
+		Created: RFC3339Date(time.Now()),
+		Username: uname,
+		Bookmark: WebhookBookmark{
+			ID: b.BId,
+			URL: b.URL,
+			Title: b.Title,
+			Unread: b.Unread,
+			Archived: b.Archived,
+			Private: b.Private } }
+	if b.AddedOn != "" { payload.Bookmark.AddedOn = RFC3339Date(added) }
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	for _, h := range hooks {
+		if !h.Wants(event) { continue }
+		if err := h.Queue(db, event, string(body)); err != nil {
+			log.Println(err) }
+	}
+}
+
+// Tries a delivery once and records how it went
+func (d WebhookDelivery) Attempt(db *sql.DB, h Webhook) (error) {
+	body := []byte(d.Payload)
+	req, err := http.NewRequest("POST", h.URL, bytes.NewReader(body))
+	if err != nil { return d.Failed(db, 0) }
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "BookmarkWarrior-Webhook (+" +
+		Settings.Web.Canon + ")")
+	req.Header.Set("X-BookmarkWarrior-Event", d.Event)
+	req.Header.Set("X-BookmarkWarrior-Delivery", strconv.Itoa(d.DeliveryID))
+	req.Header.Set(WebhookSignatureHeader,
+		WebhookSignature(h.Secret, body, time.Now()))
+
+	resp, err := WebhookClient.Do(req)
+	if err != nil { return d.Failed(db, 0) }
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64 * 1024))
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return d.Failed(db, resp.StatusCode) }
+	return d.Delivered(db, resp.StatusCode)
+}
+
+// Works through whatever's due every few seconds
+func DeliverWebhooksForever() {
+	for {
+		time.Sleep(10 * time.Second)
+
+		db, err := DBConnect(&Settings)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		due, err := DueWebhookDeliveries(db, Settings.Webhooks.BatchSize)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		for _, d := range due {
+			h, err := WebhookByID(db, d.HookID)
+			if err == nil { err = d.Attempt(db, h) }
+			if err != nil { log.Println(err) }
+		}
+	}
+}
+
+// Webhooks and their delivery log at /u/{USER}/settings/webhooks
+func (ux *UserExperience) HandleUserWebhooks(res *ServerRes, user UserProfile) {
+	w := res.Writer
+	r := res.Request
+	db := res.DB
+	uname := user.Username
+	page := "tmpl/user-webhooks.html"
+
+	procErr := false
+	if r.Method == "POST" {
+		if err := r.ParseForm(); err != nil { panic(err) }
+
+		var err error
+		switch(r.FormValue("action")) {
+		case "add":
+			events, ok := ParseWebhookEvents(r.Form["event"])
+			h := Webhook{
+				Username: uname,
+				URL: strings.TrimSpace(r.FormValue("url")),
+				Secret: MailToken(),
+				Events: events }
+			if !ok || IsURL(h.URL) != nil {
+				procErr = true
+				break
+			}
+			err = h.Add(db)
+		case "remove":
+			err = user.RemoveWebhook(db, r.FormValue("hook"))
+		case "redeliver":
+			err = user.Redeliver(db, r.FormValue("delivery"))
+			if err == sql.ErrNoRows {
+				HandleWebError(w, r, http.StatusNotFound)
+				return
+			}
+		default:
+			HandleWebError(w, r, http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			HandleWebError(w, r, http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		if !procErr {
+			http.Redirect(w, r, Settings.Web.Canon + "u/" + uname +
+				"/settings/webhooks", http.StatusSeeOther)
+			return
+		}
+	}
+
+	hooks, err := user.Webhooks(db)
+	var deliveries []WebhookDelivery
+	if err == nil {
+		deliveries, err = user.WebhookDeliveries(db,
+			Settings.Webhooks.LogLength) }
+	if err != nil {
+		HandleWebError(w, r, http.StatusServiceUnavailable)
+		log.Println(err)
+		return
+	}
+	var webhooks []WebWebhook
+	for _, h := range hooks {
+		webhooks = append(webhooks, h.AsWebEntity())
+	}
+	var webdeliveries []WebWebhookDelivery
+	for _, d := range deliveries {
+		webdeliveries = append(webdeliveries, d.AsWebEntity())
+	}
+
+	webuser := user.AsWebEntity()
+	webuser.ThisIsMe = true
+
+	err = Templates[page].Execute(w, UserWebhooksPage{
+		Canon: Settings.Web.Canon + "u/" + uname,
+		User: webuser,
+		Webhooks: webhooks,
+		Deliveries: webdeliveries,
+		Events: WebhookEvents,
+		Error: procErr,
+		Title: user.DisplayName + " (" + uname + ") - Webhooks",
+		UX: ux,
+		Settings: &Settings })
+	if err != nil {
+		HandleWebError(w, r, http.StatusInternalServerError)
+		log.Println(err)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWebhookSignature(t *testing.T) {
+	body := []byte(`{"event":"bookmark.added"}`)
+	now := time.Unix(1700000000, 0)
+
+	// HMAC-SHA256 of "1700000000." + body under "hook-secret", worked out
+	// separately
+	want := "t=1700000000," +
+		"v1=03e32fd028845e95ec4bdec8dc7a4ef28e5a3fc79a36f09b1fd09e546c8e290c"
+	if got := WebhookSignature("hook-secret", body, now); got != want {
+		t.Errorf("got %s, want %s", got, want) }
+
+	if WebhookSignature("other-secret", body, now) == want {
+		t.Error("the secret doesn't change the signature") }
+	if WebhookSignature("hook-secret", []byte(`{}`), now) == want {
+		t.Error("the body doesn't change the signature") }
+
+	// Receivers can check it just as we check Stripe's
+	s := &StripeProvider{ Settings: StripeSettings{
+		WebhookSecret: "hook-secret" } }
+	if !s.VerifyWebhook(want, body, now) {
+		t.Error("not the Stripe scheme receivers are told to expect") }
+}
+
+func TestParseWebhookEvents(t *testing.T) {
+	cases := []struct {
+		picked []string
+		events string
+		ok bool
+	}{
+		{ []string{ WebhookRemoved, WebhookAdded },
+			WebhookAdded + "," + WebhookRemoved, true },
+		{ []string{ WebhookRead, "bookmark.stolen" }, WebhookRead, true },
+		{ []string{ "bookmark.stolen" }, "", false },
+		{ nil, "", false },
+	}
+	for _, c := range cases {
+		events, ok := ParseWebhookEvents(c.picked)
+		if events != c.events || ok != c.ok {
+			t.Errorf("%v: got %q, %v", c.picked, events, ok) }
+	}
+	if !(Webhook{ Events: WebhookAdded + "," + WebhookRead }).Wants(
+		WebhookRead) {
+		t.Error("hook doesn't want an event it picked") }
+	if (Webhook{ Events: WebhookAdded }).Wants(WebhookRead) {
+		t.Error("hook wants an event it didn't pick") }
+}
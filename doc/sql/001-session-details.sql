@@ -0,0 +1,6 @@
+-- Where / when each session was signed in (settings -> sessions)
+ALTER TABLE Sessions
+	ADD COLUMN UserAgent VARCHAR(512) NOT NULL DEFAULT '',
+	ADD COLUMN IP VARCHAR(64) NOT NULL DEFAULT '',
+	ADD COLUMN CreatedOn DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	ADD COLUMN LastSeen DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP;
@@ -0,0 +1,21 @@
+-- RFC 6238 TOTP; the secret is stored before TOTPEnabled while enrolling
+ALTER TABLE Users
+	ADD COLUMN TOTPSecret VARCHAR(64) NOT NULL DEFAULT '',
+	ADD COLUMN TOTPEnabled BOOLEAN NOT NULL DEFAULT false,
+	ADD COLUMN TOTPLastStep BIGINT NOT NULL DEFAULT 0;
+
+-- Single-use; only a SHA-256 of each code is kept
+CREATE TABLE RecoveryCodes (
+	Username VARCHAR(64) NOT NULL,
+	CodeHash CHAR(64) NOT NULL,
+	PRIMARY KEY (Username, CodeHash),
+	FOREIGN KEY (Username) REFERENCES Users(Username) ON DELETE CASCADE
+);
+
+-- Sessions which got the password right but still owe a TOTP code
+CREATE TABLE LoginChallenges (
+	SessID VARCHAR(64) NOT NULL PRIMARY KEY,
+	Username VARCHAR(64) NOT NULL,
+	Expires DATETIME NOT NULL,
+	FOREIGN KEY (Username) REFERENCES Users(Username) ON DELETE CASCADE
+);
@@ -0,0 +1,19 @@
+-- WebAuthn credentials; PublicKey is PKIX DER, CredID is base64url
+CREATE TABLE Passkeys (
+	CredID VARCHAR(255) NOT NULL PRIMARY KEY,
+	Username VARCHAR(64) NOT NULL,
+	Name VARCHAR(64) NOT NULL,
+	PublicKey BLOB NOT NULL,
+	SignCount INT UNSIGNED NOT NULL DEFAULT 0,
+	CreatedOn DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	LastUsed DATETIME NULL,
+	FOREIGN KEY (Username) REFERENCES Users(Username) ON DELETE CASCADE
+);
+
+-- Outstanding registration / sign-in ceremony for a session
+CREATE TABLE WebAuthnChallenges (
+	SessID VARCHAR(64) NOT NULL PRIMARY KEY,
+	Challenge VARCHAR(64) NOT NULL,
+	Username VARCHAR(64) NOT NULL DEFAULT '',
+	Expires DATETIME NOT NULL
+);
@@ -0,0 +1,15 @@
+-- Optional address used for password resets once verified
+ALTER TABLE Users
+	ADD COLUMN Email VARCHAR(254) NOT NULL DEFAULT '',
+	ADD COLUMN EmailVerified BOOLEAN NOT NULL DEFAULT false,
+	ADD INDEX (Email);
+
+-- Single-use links sent by e-mail; only a SHA-256 of the token is kept
+CREATE TABLE MailTokens (
+	TokenHash CHAR(64) NOT NULL PRIMARY KEY,
+	Username VARCHAR(64) NOT NULL,
+	Purpose VARCHAR(16) NOT NULL,
+	Email VARCHAR(254) NOT NULL,
+	Expires DATETIME NOT NULL,
+	FOREIGN KEY (Username) REFERENCES Users(Username) ON DELETE CASCADE
+);
@@ -0,0 +1,2 @@
+-- Argon2id PHC strings (plus the $pepper$ prefix) outgrow bcrypt's 60 chars
+ALTER TABLE Users MODIFY Shadow VARCHAR(255) NOT NULL;
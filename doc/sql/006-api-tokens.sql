@@ -0,0 +1,20 @@
+-- Named, scoped API tokens; only a SHA-256 of each token is stored
+CREATE TABLE APITokens (
+	TokenID INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	Username VARCHAR(64) NOT NULL,
+	Name VARCHAR(64) NOT NULL,
+	TokenHash CHAR(64) NOT NULL UNIQUE,
+	Scope VARCHAR(16) NOT NULL,
+	AllowedIPs VARCHAR(1024) NOT NULL DEFAULT '',
+	CreatedOn DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	Expires DATETIME NULL,
+	LastUsed DATETIME NULL,
+	FOREIGN KEY (Username) REFERENCES Users(Username) ON DELETE CASCADE
+);
+
+-- The old single plaintext secret carries on as a full-access token
+INSERT INTO APITokens (Username, Name, TokenHash, Scope)
+	SELECT Username, 'API secret', SHA2(APISecret, 256), 'full'
+	FROM Users WHERE APISecret != '';
+
+ALTER TABLE Users DROP COLUMN APISecret;
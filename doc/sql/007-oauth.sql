@@ -0,0 +1,43 @@
+-- OAuth 2.0 clients, the grants users give them and the codes / refresh
+-- tokens exchanged along the way; secrets and tokens are stored as SHA-256
+CREATE TABLE OAuthClients (
+	ClientID VARCHAR(64) NOT NULL PRIMARY KEY,
+	SecretHash CHAR(64) NOT NULL DEFAULT '',
+	Name VARCHAR(64) NOT NULL,
+	RedirectURIs TEXT NOT NULL,
+	CreatedOn DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE OAuthCodes (
+	CodeHash CHAR(64) NOT NULL PRIMARY KEY,
+	ClientID VARCHAR(64) NOT NULL,
+	Username VARCHAR(64) NOT NULL,
+	RedirectURI VARCHAR(1024) NOT NULL,
+	Scope VARCHAR(32) NOT NULL,
+	Challenge VARCHAR(128) NOT NULL,
+	Expires DATETIME NOT NULL,
+	FOREIGN KEY (ClientID) REFERENCES OAuthClients(ClientID) ON DELETE CASCADE,
+	FOREIGN KEY (Username) REFERENCES Users(Username) ON DELETE CASCADE
+);
+
+CREATE TABLE OAuthGrants (
+	GrantID INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	ClientID VARCHAR(64) NOT NULL,
+	Username VARCHAR(64) NOT NULL,
+	Scope VARCHAR(32) NOT NULL,
+	CreatedOn DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	UNIQUE (ClientID, Username),
+	FOREIGN KEY (ClientID) REFERENCES OAuthClients(ClientID) ON DELETE CASCADE,
+	FOREIGN KEY (Username) REFERENCES Users(Username) ON DELETE CASCADE
+);
+
+CREATE TABLE OAuthRefreshTokens (
+	TokenHash CHAR(64) NOT NULL PRIMARY KEY,
+	GrantID INT NOT NULL,
+	Expires DATETIME NOT NULL,
+	FOREIGN KEY (GrantID) REFERENCES OAuthGrants(GrantID) ON DELETE CASCADE
+);
+
+-- Access tokens are ordinary API tokens tied to the grant that issued them
+ALTER TABLE APITokens ADD GrantID INT NULL,
+	ADD FOREIGN KEY (GrantID) REFERENCES OAuthGrants(GrantID) ON DELETE CASCADE;
@@ -0,0 +1,10 @@
+-- Every order that paid for an account, so none can be spent twice
+CREATE TABLE Payments (
+	PaymentID INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	Provider VARCHAR(16) NOT NULL,
+	OrderID VARCHAR(255) NOT NULL,
+	Username VARCHAR(64) NULL,
+	CreatedOn DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	UNIQUE (Provider, OrderID),
+	FOREIGN KEY (Username) REFERENCES Users(Username) ON DELETE SET NULL
+);
@@ -0,0 +1,12 @@
+-- Signups waiting to be paid for; the browser only holds a token for one
+CREATE TABLE PendingSignups (
+	TokenHash CHAR(64) NOT NULL PRIMARY KEY,
+	Username VARCHAR(64) NOT NULL,
+	DisplayName VARCHAR(64) NOT NULL,
+	Shadow VARCHAR(255) NOT NULL,
+	Promo VARCHAR(64) NOT NULL DEFAULT '',
+	Provider VARCHAR(16) NULL,
+	OrderID VARCHAR(255) NULL,
+	Expires DATETIME NOT NULL,
+	INDEX (Provider, OrderID)
+);
@@ -0,0 +1,11 @@
+-- What each account paid, with what, and whether it was given back
+ALTER TABLE Payments
+	ADD Amount DECIMAL(10, 2) NOT NULL DEFAULT 0,
+	ADD Currency CHAR(3) NOT NULL DEFAULT '',
+	ADD Promo VARCHAR(64) NOT NULL DEFAULT '',
+	ADD Status VARCHAR(16) NOT NULL DEFAULT 'paid',
+	ADD RefundedOn DATETIME NULL,
+	ADD RefundedBy VARCHAR(64) NULL;
+
+-- Refunded accounts are closed rather than deleted
+ALTER TABLE Users ADD Status VARCHAR(16) NOT NULL DEFAULT 'active';
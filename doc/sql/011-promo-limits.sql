@@ -0,0 +1,15 @@
+-- Promo codes with usage limits, percentage discounts and batches
+ALTER TABLE Promos
+	MODIFY Expires DATETIME NULL,
+	ADD Kind VARCHAR(8) NOT NULL DEFAULT 'fixed',
+	ADD MaxRedemptions INT NULL,
+	ADD Redemptions INT NOT NULL DEFAULT 0,
+	ADD Disabled BOOLEAN NOT NULL DEFAULT FALSE,
+	ADD Batch VARCHAR(64) NOT NULL DEFAULT '',
+	ADD CreatedOn DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP;
+
+-- Count what's been used so far
+UPDATE Promos SET Redemptions =
+	(SELECT COUNT(*) FROM Payments WHERE Payments.Promo=Promos.Code);
+
+CREATE INDEX PaymentsByPromo ON Payments (Promo);
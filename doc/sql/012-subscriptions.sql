@@ -0,0 +1,15 @@
+-- Optional recurring plans; at most one per user, kept in step with the
+-- payment provider by its webhooks
+CREATE TABLE Subscriptions (
+	Username VARCHAR(64) NOT NULL PRIMARY KEY,
+	PlanID VARCHAR(32) NOT NULL,
+	Period VARCHAR(8) NOT NULL,
+	Provider VARCHAR(16) NOT NULL,
+	ExternalID VARCHAR(255) NOT NULL,
+	Status VARCHAR(16) NOT NULL,
+	CurrentPeriodEnd DATETIME NOT NULL,
+	CancelAtPeriodEnd BOOLEAN NOT NULL DEFAULT FALSE,
+	UpdatedOn DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	UNIQUE (Provider, ExternalID),
+	FOREIGN KEY (Username) REFERENCES Users(Username) ON DELETE CASCADE
+);
@@ -0,0 +1,14 @@
+-- Invite links for when activation is by invitation instead of payment
+CREATE TABLE Invites (
+	Code VARCHAR(32) NOT NULL PRIMARY KEY,
+	CreatedBy VARCHAR(64) NOT NULL,
+	CreatedOn DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	Expires DATETIME NULL,
+	UsedBy VARCHAR(64) NULL,
+	UsedOn DATETIME NULL,
+	FOREIGN KEY (CreatedBy) REFERENCES Users(Username) ON DELETE CASCADE,
+	FOREIGN KEY (UsedBy) REFERENCES Users(Username) ON DELETE SET NULL
+);
+
+-- Signups waiting for an admin are Users with Status 'pending'
+CREATE INDEX UsersByStatus ON Users (Status);
@@ -0,0 +1,38 @@
+-- Organizations with a shared bookmark library at /o/{org}
+CREATE TABLE Orgs (
+	OrgName VARCHAR(64) NOT NULL PRIMARY KEY,
+	DisplayName VARCHAR(128) NOT NULL,
+	CreatedOn DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE OrgMembers (
+	OrgName VARCHAR(64) NOT NULL,
+	Username VARCHAR(64) NOT NULL,
+	Role VARCHAR(8) NOT NULL,
+	JoinedOn DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (OrgName, Username),
+	FOREIGN KEY (OrgName) REFERENCES Orgs(OrgName) ON DELETE CASCADE,
+	FOREIGN KEY (Username) REFERENCES Users(Username) ON DELETE CASCADE
+);
+
+-- Outlive whoever added them
+CREATE TABLE OrgBookmarks (
+	BId INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	OrgName VARCHAR(64) NOT NULL,
+	AddedBy VARCHAR(64) NULL,
+	URL TEXT NOT NULL,
+	Title VARCHAR(512) NOT NULL,
+	Archived BOOLEAN NOT NULL DEFAULT FALSE,
+	AddedOn DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (OrgName) REFERENCES Orgs(OrgName) ON DELETE CASCADE,
+	FOREIGN KEY (AddedBy) REFERENCES Users(Username) ON DELETE SET NULL
+);
+
+-- Each member's own read state; no row means unread
+CREATE TABLE OrgBookmarkReads (
+	BId INT NOT NULL,
+	Username VARCHAR(64) NOT NULL,
+	PRIMARY KEY (BId, Username),
+	FOREIGN KEY (BId) REFERENCES OrgBookmarks(BId) ON DELETE CASCADE,
+	FOREIGN KEY (Username) REFERENCES Users(Username) ON DELETE CASCADE
+);
@@ -0,0 +1,3 @@
+-- Who can see a user's page, and bookmarks only their owner can see
+ALTER TABLE Users ADD Visibility VARCHAR(8) NOT NULL DEFAULT 'public';
+ALTER TABLE Bookmarks ADD Private BOOLEAN NOT NULL DEFAULT FALSE;
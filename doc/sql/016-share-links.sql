@@ -0,0 +1,19 @@
+-- Signed, read-only links to some of a user's bookmarks
+CREATE TABLE ShareLinks (
+	ShareID VARCHAR(32) NOT NULL PRIMARY KEY,
+	Username VARCHAR(64) NOT NULL,
+	Name VARCHAR(255) NOT NULL,
+	Kind VARCHAR(16) NOT NULL,
+	Expires DATETIME NULL,
+	CreatedOn DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (Username) REFERENCES Users(Username) ON DELETE CASCADE
+);
+
+-- The bookmarks picked for a 'selection' link
+CREATE TABLE ShareLinkBookmarks (
+	ShareID VARCHAR(32) NOT NULL,
+	BId INT NOT NULL,
+	PRIMARY KEY (ShareID, BId),
+	FOREIGN KEY (ShareID) REFERENCES ShareLinks(ShareID) ON DELETE CASCADE,
+	FOREIGN KEY (BId) REFERENCES Bookmarks(BId) ON DELETE CASCADE
+);
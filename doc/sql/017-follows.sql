@@ -0,0 +1,16 @@
+-- Who follows whom, for the feed at /u/{user}/feed
+CREATE TABLE Follows (
+	Follower VARCHAR(64) NOT NULL,
+	Followee VARCHAR(64) NOT NULL,
+	CreatedOn DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (Follower, Followee),
+	FOREIGN KEY (Follower) REFERENCES Users(Username) ON DELETE CASCADE,
+	FOREIGN KEY (Followee) REFERENCES Users(Username) ON DELETE CASCADE
+);
+CREATE INDEX FollowsByFollowee ON Follows (Followee);
+
+-- Who a bookmark was saved from, when it came out of the feed
+ALTER TABLE Bookmarks ADD COLUMN Via VARCHAR(64) NULL;
+ALTER TABLE Bookmarks ADD FOREIGN KEY (Via)
+	REFERENCES Users(Username) ON DELETE SET NULL;
+CREATE INDEX BookmarksByURL ON Bookmarks (Username, URL(191));
@@ -0,0 +1,29 @@
+-- Outside feeds polled for new bookmarks
+CREATE TABLE FeedSubscriptions (
+	FeedID INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	Username VARCHAR(64) NOT NULL,
+	URL VARCHAR(2048) NOT NULL,
+	Title VARCHAR(255) NULL,
+	Keywords VARCHAR(255) NOT NULL DEFAULT '',
+	Private BOOLEAN NOT NULL DEFAULT false,
+	ETag VARCHAR(255) NULL,
+	LastModified VARCHAR(64) NULL,
+	LastChecked DATETIME NULL,
+	NextCheck DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	Failures INT NOT NULL DEFAULT 0,
+	LastError VARCHAR(255) NULL,
+	Added INT NOT NULL DEFAULT 0,
+	CreatedOn DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (Username) REFERENCES Users(Username) ON DELETE CASCADE
+);
+CREATE INDEX FeedSubscriptionsDue ON FeedSubscriptions (NextCheck);
+
+-- Items the poller has already been through, by the hash of their ID
+CREATE TABLE FeedItemsSeen (
+	FeedID INT NOT NULL,
+	ItemHash CHAR(64) NOT NULL,
+	SeenOn DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (FeedID, ItemHash),
+	FOREIGN KEY (FeedID) REFERENCES FeedSubscriptions(FeedID)
+		ON DELETE CASCADE
+);
@@ -0,0 +1,8 @@
+-- Secret addresses for saving bookmarks by e-mail
+CREATE TABLE MailInAddresses (
+	Username VARCHAR(64) NOT NULL PRIMARY KEY,
+	Token VARCHAR(32) NOT NULL UNIQUE,
+	AllowedSenders TEXT NOT NULL,
+	CreatedOn DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (Username) REFERENCES Users(Username) ON DELETE CASCADE
+);
@@ -0,0 +1,26 @@
+-- Outgoing webhooks on bookmark changes
+CREATE TABLE Webhooks (
+	HookID INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	Username VARCHAR(64) NOT NULL,
+	URL VARCHAR(2048) NOT NULL,
+	Secret CHAR(64) NOT NULL,
+	Events VARCHAR(255) NOT NULL,
+	CreatedOn DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (Username) REFERENCES Users(Username) ON DELETE CASCADE
+);
+
+-- The delivery queue, which doubles as the log
+CREATE TABLE WebhookDeliveries (
+	DeliveryID INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	HookID INT NOT NULL,
+	Event VARCHAR(32) NOT NULL,
+	Payload TEXT NOT NULL,
+	Status VARCHAR(16) NOT NULL,
+	Attempts INT NOT NULL DEFAULT 0,
+	ResponseCode INT NULL,
+	NextAttempt DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	LastAttempt DATETIME NULL,
+	CreatedOn DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (HookID) REFERENCES Webhooks(HookID) ON DELETE CASCADE
+);
+CREATE INDEX WebhookDeliveriesDue ON WebhookDeliveries (Status, NextAttempt);
@@ -0,0 +1,17 @@
+-- Every order made for a pending signup (several, when more than one
+-- provider is offered), so paying one can only ever finish that signup
+CREATE TABLE PendingSignupOrders (
+	Provider VARCHAR(16) NOT NULL,
+	OrderID VARCHAR(255) NOT NULL,
+	TokenHash CHAR(64) NOT NULL,
+	PRIMARY KEY (Provider, OrderID),
+	INDEX (TokenHash)
+);
+
+INSERT INTO PendingSignupOrders (Provider, OrderID, TokenHash)
+	SELECT Provider, OrderID, TokenHash FROM PendingSignups
+	WHERE Provider IS NOT NULL AND OrderID IS NOT NULL;
+
+ALTER TABLE PendingSignups
+	DROP COLUMN Provider,
+	DROP COLUMN OrderID;
@@ -0,0 +1,9 @@
+-- What each pending signup was quoted, so it's charged that and nothing
+-- else. Signups already in flight were never quoted (and their promo codes
+-- never reserved); they're dropped, so run this while signups are paused
+DELETE FROM PendingSignupOrders;
+DELETE FROM PendingSignups;
+
+ALTER TABLE PendingSignups
+	ADD Amount DECIMAL(10, 2) NOT NULL DEFAULT 0,
+	ADD Currency CHAR(3) NOT NULL DEFAULT '';
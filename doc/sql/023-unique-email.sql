@@ -0,0 +1,12 @@
+-- A confirmed address finds exactly one account for password resets.
+-- Addresses confirmed by more than one account go back to unconfirmed, so
+-- whichever owner confirms first keeps it
+UPDATE Users SET EmailVerified=false
+	WHERE EmailVerified AND Email IN (SELECT Email FROM (
+		SELECT Email FROM Users WHERE EmailVerified
+		GROUP BY Email HAVING COUNT(*) > 1) AS Shared);
+
+ALTER TABLE Users
+	ADD COLUMN VerifiedEmail VARCHAR(254)
+		AS (IF(EmailVerified, Email, NULL)) STORED,
+	ADD UNIQUE INDEX (VerifiedEmail);
@@ -0,0 +1,73 @@
+// Passkey registration and sign-in; the server speaks base64url everywhere
+// so binary fields are converted on the way in and out
+
+function b64urlToBuf(s) {
+	s = s.replace(/-/g, '+').replace(/_/g, '/');
+	while (s.length % 4) s += '=';
+	var bin = atob(s);
+	var buf = new Uint8Array(bin.length);
+	for (var i = 0; i < bin.length; i++) buf[i] = bin.charCodeAt(i);
+	return buf.buffer;
+}
+
+function bufToB64url(buf) {
+	var bin = '';
+	var bytes = new Uint8Array(buf);
+	for (var i = 0; i < bytes.length; i++) bin += String.fromCharCode(bytes[i]);
+	return btoa(bin).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+}
+
+function webauthnPost(url, body) {
+	return fetch(url, {
+		method: 'POST',
+		credentials: 'same-origin',
+		headers: { 'Content-Type': 'application/json' },
+		body: body ? JSON.stringify(body) : null
+	}).then(function(res) {
+		if (!res.ok) throw new Error('Request failed: ' + res.status);
+		return res.json();
+	});
+}
+
+function passkeyRegister(canon, name) {
+	return webauthnPost(canon + 'webauthn/register/begin').then(function(opts) {
+		opts.challenge = b64urlToBuf(opts.challenge);
+		opts.user.id = b64urlToBuf(opts.user.id);
+		opts.excludeCredentials.forEach(function(c) { c.id = b64urlToBuf(c.id); });
+		return navigator.credentials.create({ publicKey: opts });
+	}).then(function(cred) {
+		return webauthnPost(canon + 'webauthn/register/finish', {
+			id: cred.id,
+			name: name,
+			response: {
+				clientDataJSON: bufToB64url(cred.response.clientDataJSON),
+				attestationObject: bufToB64url(cred.response.attestationObject)
+			}
+		});
+	});
+}
+
+function passkeyLogin(canon) {
+	return webauthnPost(canon + 'webauthn/login/begin').then(function(opts) {
+		opts.challenge = b64urlToBuf(opts.challenge);
+		opts.allowCredentials.forEach(function(c) { c.id = b64urlToBuf(c.id); });
+		return navigator.credentials.get({ publicKey: opts });
+	}).then(function(cred) {
+		return webauthnPost(canon + 'webauthn/login/finish', {
+			id: cred.id,
+			response: {
+				clientDataJSON: bufToB64url(cred.response.clientDataJSON),
+				authenticatorData: bufToB64url(cred.response.authenticatorData),
+				signature: bufToB64url(cred.response.signature),
+				userHandle: cred.response.userHandle ?
+					bufToB64url(cred.response.userHandle) : ''
+			}
+		});
+	}).then(function(res) { window.location = res.redirect; });
+}
+
+function passkeyFailed(e) {
+	console.log(e);
+	var err = document.getElementById('passkey-error');
+	if (err) err.textContent = "That didn't work; try again?";
+}